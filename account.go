@@ -25,6 +25,37 @@ type User struct {
 	Password    string     `json:"-" gorm:"not null"`
 	Salt        string     `json:"-" gorm:"size:64;not null"`
 	Events      []*Event   `json:"-" gorm:"many2many:events_joined;"`
+	// CalendarToken is the secret part of the users calendar feed url
+	CalendarToken string `json:"-" gorm:"size:64;index"`
+	Role          string `gorm:"size:20"`
+	// Timezone is the IANA time zone reminders are written in, e.g. Europe/Vilnius
+	Timezone string `gorm:"size:64"`
+	// Reputation is only filled in by GetAccountInfo
+	Reputation *Reputation `json:",omitempty" gorm:"-"`
+	// Sports is only filled in by GetAccountInfo
+	Sports []UserSport `json:",omitempty" gorm:"foreignkey:UserID"`
+	// AvatarKey is where the avatar is kept in the blob store
+	AvatarKey string `json:"-" gorm:"size:100"`
+	// Avatar is only filled in by GetAccountInfo and for the users of events
+	Avatar *ImageURLs `json:",omitempty" gorm:"-"`
+	// Stats is only filled in by GetAccountInfo
+	Stats *UserStats `json:",omitempty" gorm:"-"`
+}
+
+// Roles of users with extra permissions
+const (
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+//IsModerator checks if the user can moderate content of other users
+func (user *User) IsModerator() bool {
+	return user.Role == RoleModerator || user.Role == RoleAdmin
+}
+
+//IsAdmin checks if the user can manage the server, e.g. its background jobs
+func (user *User) IsAdmin() bool {
+	return user.Role == RoleAdmin
 }
 
 //RegisterPageHandler decodes user sent in data, verifies that
@@ -45,6 +76,15 @@ func RegisterNewAccount(w http.ResponseWriter, r *http.Request) {
 
 	res, err := PerformUserDataChecks(user.Email, user.Password, user.RepeatPassword)
 
+	//Usernames go through the content filter
+	var violations []ContentViolation
+	if err == nil {
+		var ok bool
+		if violations, ok = filterContent(w, 0, false, ContentField{"Username", user.Username}); !ok {
+			return
+		}
+	}
+
 	w.WriteHeader(res)
 
 	if err != nil {
@@ -64,6 +104,8 @@ func RegisterNewAccount(w http.ResponseWriter, r *http.Request) {
 	}
 	db.Debug().Create(&newUser)
 	db.Save(&newUser)
+	LinkInvitationsToUser(newUser)
+	FlagContent(ReportTargetUser, newUser.ID, newUser.ID, violations)
 
 	JSONResponse(struct{}{}, w)
 	return
@@ -102,6 +144,12 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Suspended users can not log in until their suspension ends
+	if until, suspended := SuspendedUntil(userDatabaseData.ID); suspended {
+		writeSuspended(w, until)
+		return
+	}
+
 	session = CreateAccessToken(userDatabaseData, session)
 	session.Save(r, w)
 
@@ -128,6 +176,13 @@ func GetAccountInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reputation := GetReputation(user.ID)
+	user.Reputation = &reputation
+	user.Sports = userSports(user.ID)
+	user.Avatar = imageURLs(user.AvatarKey)
+	stats := GetUserStatsOf(user)
+	user.Stats = &stats
+
 	JSONResponse(user, w)
 	w.WriteHeader(http.StatusOK)
 	return
@@ -198,6 +253,13 @@ func EditAccountInfo(w http.ResponseWriter, r *http.Request) {
 	var updatedUser User
 	json.NewDecoder(r.Body).Decode(&updatedUser)
 
+	userID := session.Values["userID"].(uint)
+	violations, ok := filterContent(w, userID, false,
+		ContentField{"Username", updatedUser.Username}, ContentField{"Description", updatedUser.Description})
+	if !ok {
+		return
+	}
+
 	if updatedUser.Username != "" {
 		tx.Model(&user).Updates(User{Username: updatedUser.Username})
 	}
@@ -207,7 +269,16 @@ func EditAccountInfo(w http.ResponseWriter, r *http.Request) {
 	if updatedUser.Description != "" {
 		tx.Model(&user).Updates(User{Description: updatedUser.Description})
 	}
+	if updatedUser.Timezone != "" {
+		if _, err := time.LoadLocation(updatedUser.Timezone); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{"Unknown time zone"}, w)
+			return
+		}
+		tx.Model(&user).Updates(User{Timezone: updatedUser.Timezone})
+	}
 	tx.First(&user)
+	FlagContent(ReportTargetUser, userID, userID, violations)
 
 	w.WriteHeader(http.StatusOK)
 	JSONResponse(struct{}{}, w)
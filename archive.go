@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+//UpdateEventStatuses marks published events that have started as ongoing
+//and events that have ended as finished. Events created before statuses
+//existed, or while published events were called scheduled, are published
+func UpdateEventStatuses(now time.Time) error {
+	err := db.Model(&Event{}).
+		Where("status IS NULL OR status IN (?)", []string{"", "scheduled"}).
+		Updates(map[string]interface{}{"status": EventStatusPublished}).Error
+	if err != nil {
+		return err
+	}
+	err = db.Model(&Event{}).
+		Where("status = ? AND start_time <= ? AND end_time > ?", EventStatusPublished, now, now).
+		Updates(map[string]interface{}{"status": EventStatusOngoing}).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&Event{}).
+		Where("status IN (?) AND end_time <= ?", []string{EventStatusPublished, EventStatusOngoing}, now).
+		Updates(map[string]interface{}{"status": EventStatusFinished}).Error
+}
+
+//PurgeExpiredEvents permanently deletes events that ended more than
+//retention ago together with everything that belongs to them.
+//A retention of 0 keeps events forever
+func PurgeExpiredEvents(retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+
+	var events []Event
+	if err := db.Unscoped().Where("end_time < ?", time.Now().Add(-retention)).Find(&events).Error; err != nil {
+		return err
+	}
+
+	for i := range events {
+		purgeEvent(&events[i])
+	}
+	return nil
+}
+
+// purgeEvent deletes an event row and the rows referencing it
+func purgeEvent(event *Event) {
+	db.Exec("DELETE FROM events_joined WHERE event_id = ?", event.ID)
+	db.Where("event_id = ?", event.ID).Delete(Invitation{})
+	db.Where("event_id = ?", event.ID).Delete(InviteLink{})
+	db.Exec("DELETE FROM comment_revisions WHERE comment_id IN (SELECT id FROM comments WHERE event_id = ?)", event.ID)
+	db.Unscoped().Where("event_id = ?", event.ID).Delete(Comment{})
+	db.Where("event_id = ?", event.ID).Delete(ReminderDelivery{})
+	deleteTeams(event.ID)
+	db.Where("event_id = ?", event.ID).Delete(EventOrganizer{})
+	db.Where("event_id = ?", event.ID).Delete(AuditLog{})
+	db.Where("event_id = ?", event.ID).Delete(JoinRequest{})
+	db.Where("event_id = ?", event.ID).Delete(WaitlistEntry{})
+	db.Where("event_id = ?", event.ID).Delete(EventRating{})
+	db.Where("event_id = ?", event.ID).Delete(ParticipantRating{})
+	deleteImages(event.CoverKey)
+	db.Unscoped().Delete(event)
+}
+
+//GetEventHistory returns the finished events a user created or joined,
+//most recent first. Defaults to the logged in user when no id is given
+func GetEventHistory(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	keys := r.URL.Query()
+	id := keys.Get("id")
+
+	var user User
+
+	if id != "" {
+		db.First(&user, id)
+	} else if session.Values["userID"] != nil {
+		db.First(&user, session.Values["userID"].(uint))
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if user.ID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Private events are only shown to users that could see them
+	var events []Event
+	db.Preload("Users").Preload("Creator").Scopes(VisibleTo(session.Values["userID"])).
+		Where("status = ?", EventStatusFinished).
+		Where("creator_id = ? OR id IN (SELECT event_id FROM events_joined WHERE user_id = ?)", user.ID, user.ID).
+		Order("end_time DESC").
+		Find(&events)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(events, w)
+	return
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Attendance of a participant, empty until it is known
+const (
+	AttendanceCheckedIn = "checked_in"
+	AttendanceNoShow    = "no_show"
+)
+
+// Check-in rules
+const (
+	// checkInOpens is how long before the start participants can check in
+	checkInOpens = time.Hour
+	// checkInCloses is how long after the end participants can check in
+	// and unmarked participants of events that used check-in become no-shows
+	checkInCloses = time.Hour
+	qrCodeSize    = 512
+)
+
+//EventParticipant is a row of events_joined, the join table of events and
+//their participants, with the attendance of the participant
+type EventParticipant struct {
+	EventID     uint   `gorm:"primary_key;auto_increment:false"`
+	UserID      uint   `gorm:"primary_key;auto_increment:false"`
+	Attendance  string `gorm:"size:20"`
+	CheckedInAt *time.Time
+	// SkillLevel is the 1 to 5 skill the participant declared, 0 when unknown
+	SkillLevel int
+}
+
+//TableName maps EventParticipant to the many2many table of Event.Users
+func (EventParticipant) TableName() string {
+	return "events_joined"
+}
+
+//AttendanceStats shows how reliably a user comes to the events they join
+type AttendanceStats struct {
+	UserID    uint
+	Joined    int
+	CheckedIn int
+	NoShows   int
+	// Reliability is the share of marked events the user came to, from 0
+	// to 1, or -1 when no attendance was recorded yet
+	Reliability float64
+}
+
+//DeriveKey derives a key for a single purpose from the server secret
+func DeriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+//CheckInCode signs the id and start time of an event, so the code changes
+//when the event is rescheduled
+func CheckInCode(event Event) string {
+	mac := hmac.New(sha256.New, checkInKey)
+	fmt.Fprintf(mac, "check-in:%d:%d", event.ID, event.StartTime.Unix())
+	return fmt.Sprintf("%d.%s", event.ID, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16]))
+}
+
+//GetCheckInCode returns the check-in code of an event and when it can be
+//used. Only the creator can see it
+func GetCheckInCode(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Code       string
+		ValidFrom  time.Time
+		ValidUntil time.Time
+	}{CheckInCode(event), event.StartTime.Add(-checkInOpens), event.EndTime.Add(checkInCloses)}, w)
+	return
+}
+
+//GetCheckInQRCode renders the check-in code of an event as a PNG QR code
+//to show at the venue. Only the creator can see it
+func GetCheckInQRCode(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	png, err := qrcode.Encode(CheckInCode(event), qrcode.Medium, qrCodeSize)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+	return
+}
+
+//CheckIn checks the logged in participant in with a scanned check-in code
+func CheckIn(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	requestData := struct {
+		Code string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	//The code starts with the id of its event
+	var event Event
+	parts := strings.SplitN(requestData.Code, ".", 2)
+	eventID, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || db.First(&event, eventID).RecordNotFound() ||
+		!hmac.Equal([]byte(requestData.Code), []byte(CheckInCode(event))) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Invalid check-in code"}, w)
+		return
+	}
+
+	now := time.Now()
+	if event.Status == EventStatusCancelled || now.Before(event.StartTime.Add(-checkInOpens)) ||
+		now.After(event.EndTime.Add(checkInCloses)) {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Check-in is not open for this event"}, w)
+		return
+	}
+
+	if !isParticipant(event.ID, userID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"Only participants can check in"}, w)
+		return
+	}
+
+	SetAttendance(event.ID, userID, AttendanceCheckedIn)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(event, w)
+	return
+}
+
+//MarkAttendance lets the creator mark a participant as checked in or a
+//no-show once the event has started. An empty attendance clears the mark
+func MarkAttendance(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	//Gets participant id from /events/{id}/users/{userID}/attendance
+	participantID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil || !isParticipant(event.ID, uint(participantID)) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		Attendance string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	switch requestData.Attendance {
+	case "", AttendanceCheckedIn, AttendanceNoShow:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if time.Now().Before(event.StartTime.Add(-checkInOpens)) || event.Status == EventStatusCancelled {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Attendance can only be marked once the event starts"}, w)
+		return
+	}
+
+	SetAttendance(event.ID, uint(participantID), requestData.Attendance)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetEventAttendance lists the participants of an event with their
+//attendance. Only the creator can see it
+func GetEventAttendance(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	participants := []EventParticipant{}
+	db.Where("event_id = ?", event.ID).Order("user_id").Find(&participants)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(participants, w)
+	return
+}
+
+//GetAttendanceStats returns the attendance stats of a user, e.g. for an
+//organizer deciding about a request to join. Defaults to the logged in user
+func GetAttendanceStats(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	var userID uint
+	if id := r.URL.Query().Get("id"); id != "" {
+		parsed, err := strconv.Atoi(id)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		userID = uint(parsed)
+	} else if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(GetAttendanceStatsOf(userID), w)
+	return
+}
+
+//GetAttendanceStatsOf counts the finished events the user joined and how
+//many of them they came to
+func GetAttendanceStatsOf(userID uint) AttendanceStats {
+	stats := AttendanceStats{UserID: userID, Reliability: -1}
+
+	rows, err := db.Table("events_joined").
+		Select("events_joined.attendance, COUNT(*)").
+		Joins("JOIN events ON events.id = events_joined.event_id").
+		Where("events_joined.user_id = ? AND events.status = ? AND events.deleted_at IS NULL", userID, EventStatusFinished).
+		Group("events_joined.attendance").Rows()
+	if err != nil {
+		return stats
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var attendance *string
+		var count int
+		rows.Scan(&attendance, &count)
+
+		stats.Joined += count
+		if attendance == nil {
+			continue
+		}
+		switch *attendance {
+		case AttendanceCheckedIn:
+			stats.CheckedIn = count
+		case AttendanceNoShow:
+			stats.NoShows = count
+		}
+	}
+
+	if marked := stats.CheckedIn + stats.NoShows; marked != 0 {
+		stats.Reliability = float64(stats.CheckedIn) / float64(marked)
+	}
+	return stats
+}
+
+//SetAttendance records the attendance of a participant
+func SetAttendance(eventID uint, userID uint, attendance string) {
+	updates := map[string]interface{}{"attendance": attendance, "checked_in_at": nil}
+	if attendance == AttendanceCheckedIn {
+		updates["checked_in_at"] = time.Now()
+	}
+	db.Model(&EventParticipant{}).Where("event_id = ? AND user_id = ?", eventID, userID).Updates(updates)
+	MarkStatsStale(userID)
+}
+
+//MarkNoShows marks the participants that did not check in to recently
+//finished events as no-shows. Only events where someone checked in are
+//marked, as otherwise check-in was not used
+func MarkNoShows(now time.Time) error {
+	//The ids are loaded first as MySQL can not update a table it selects from
+	var eventIDs []uint
+	err := db.Table("events").
+		Where("status = ? AND end_time <= ? AND end_time > ?",
+			EventStatusFinished, now.Add(-checkInCloses), now.Add(-ratingWindow)).
+		Where("id IN (SELECT event_id FROM events_joined WHERE attendance = ?)", AttendanceCheckedIn).
+		Pluck("id", &eventIDs).Error
+	if err != nil || len(eventIDs) == 0 {
+		return err
+	}
+
+	var userIDs []uint
+	db.Model(&EventParticipant{}).Where("(attendance IS NULL OR attendance = '') AND event_id IN (?)", eventIDs).
+		Pluck("user_id", &userIDs)
+	if len(userIDs) == 0 {
+		return nil
+	}
+	err = db.Model(&EventParticipant{}).
+		Where("(attendance IS NULL OR attendance = '') AND event_id IN (?)", eventIDs).
+		Updates(map[string]interface{}{"attendance": AttendanceNoShow}).Error
+	if err != nil {
+		return err
+	}
+	MarkStatsStale(userIDs...)
+	return nil
+}
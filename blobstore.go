@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//ErrBlobNotFound is returned when nothing is stored under a key
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// blobKeyRegex limits keys to slash separated names with an extension, so
+// they can not leave the local directory or change the S3 url
+var blobKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+(/[a-zA-Z0-9_-]+)*\.[a-z0-9]+$`)
+
+//BlobStore keeps uploaded files, e.g. avatars and event covers, under
+//keys like avatars/4/1f2e3d.jpg
+type BlobStore interface {
+	Put(key string, contentType string, data []byte) error
+	// Get returns ErrBlobNotFound when nothing is stored under the key
+	Get(key string) (data []byte, contentType string, err error)
+	Delete(key string) error
+	// URL is where browsers load the blob from
+	URL(key string) string
+}
+
+//BlobStoreFromEnv sets up where uploaded files are kept. IMAGE_STORE is
+//local, the default, or s3. Local files are written to IMAGE_DIR. The s3
+//store needs S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY,
+//S3_REGION defaults to us-east-1 and S3_PUBLIC_URL is set when the bucket
+//can be read without going through the server
+func BlobStoreFromEnv() (BlobStore, error) {
+	switch store := os.Getenv("IMAGE_STORE"); store {
+	case "", "local":
+		dir := os.Getenv("IMAGE_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return &LocalBlobStore{Dir: dir}, nil
+	case "s3":
+		endpoint, bucket := os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET")
+		accessKey, secretKey := os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY")
+		if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+			return nil, errors.New("IMAGE_STORE=s3 needs S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY")
+		}
+		return NewS3BlobStore(endpoint, os.Getenv("S3_REGION"), bucket, accessKey, secretKey, os.Getenv("S3_PUBLIC_URL")), nil
+	default:
+		return nil, errors.Errorf("Unknown IMAGE_STORE %s, use local or s3", store)
+	}
+}
+
+//LocalBlobStore keeps blobs as files in a directory. The server hands
+//them out at /images/{key}
+type LocalBlobStore struct {
+	Dir string
+}
+
+//Put writes the blob to a temporary file first, so readers never see a
+//half written one
+func (store *LocalBlobStore) Put(key string, contentType string, data []byte) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "creating blob directory")
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "creating blob file")
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.Wrap(err, "writing blob")
+	}
+	return nil
+}
+
+//Get reads the blob, its content type comes from the key extension
+func (store *LocalBlobStore) Get(key string) ([]byte, string, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, "", ErrBlobNotFound
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "reading blob")
+	}
+	return data, mime.TypeByExtension(filepath.Ext(path)), nil
+}
+
+//Delete removes the blob, missing blobs are not an error
+func (store *LocalBlobStore) Delete(key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "deleting blob")
+	}
+	return nil
+}
+
+//URL of the blob on this server
+func (store *LocalBlobStore) URL(key string) string {
+	return "/images/" + key
+}
+
+// path is the file the blob is kept in
+func (store *LocalBlobStore) path(key string) (string, error) {
+	if !blobKeyRegex.MatchString(key) {
+		return "", errors.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(store.Dir, filepath.FromSlash(key)), nil
+}
+
+//S3BlobStore keeps blobs in a bucket of an S3 compatible service, e.g.
+//AWS S3 or MinIO. Buckets are addressed by path, {endpoint}/{bucket}/{key},
+//and requests are signed with AWS Signature Version 4
+type S3BlobStore struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	// PublicURL is where the bucket can be read directly, e.g. a CDN.
+	// Without it blobs are handed out through the server
+	PublicURL string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+//NewS3BlobStore creates a store for the bucket. region defaults to
+//us-east-1, which MinIO also uses
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey, publicURL string) *S3BlobStore {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3BlobStore{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		PublicURL: strings.TrimRight(publicURL, "/"),
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+//Put uploads the blob
+func (store *S3BlobStore) Put(key string, contentType string, data []byte) error {
+	response, err := store.do("PUT", key, contentType, data)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+//Get downloads the blob
+func (store *S3BlobStore) Get(key string) ([]byte, string, error) {
+	response, err := store.do("GET", key, "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "downloading blob")
+	}
+	return data, response.Header.Get("Content-Type"), nil
+}
+
+//Delete removes the blob, S3 does not report missing keys
+func (store *S3BlobStore) Delete(key string) error {
+	response, err := store.do("DELETE", key, "", nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+//URL of the blob in the public bucket, or on this server
+func (store *S3BlobStore) URL(key string) string {
+	if store.PublicURL != "" {
+		return store.PublicURL + "/" + key
+	}
+	return "/images/" + key
+}
+
+// do sends a signed request for the key. Answers other than 2xx are
+// returned as errors, 404 as ErrBlobNotFound
+func (store *S3BlobStore) do(method string, key string, contentType string, body []byte) (*http.Response, error) {
+	if !blobKeyRegex.MatchString(key) {
+		return nil, errors.Errorf("invalid blob key %q", key)
+	}
+
+	request, err := http.NewRequest(method, store.Endpoint+"/"+path.Join(store.Bucket, key), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid S3 endpoint")
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	signS3Request(request, body, store.Region, store.accessKey, store.secretKey, time.Now())
+
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "sending S3 request")
+	}
+	if response.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		log.Println("S3", method, key, "failed:", string(message))
+		return nil, errors.Errorf("S3 answered %s", response.Status)
+	}
+	return response, nil
+}
+
+// signS3Request adds the AWS Signature Version 4 headers to a request for
+// the s3 service. Every header already set on the request is signed
+func signS3Request(request *http.Request, body []byte, region string, accessKey string, secretKey string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	request.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	//Headers are signed lowercased and sorted, host is not kept in
+	//request.Header
+	headers := map[string]string{"host": request.URL.Host}
+	names := []string{"host"}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// sha256Hex hashes data as lowercase hex
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// hmacSHA256 signs data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
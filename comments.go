@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits for comments and their pagination
+const (
+	maxCommentLength    = 2000
+	defaultCommentLimit = 20
+	maxCommentLimit     = 100
+)
+
+// mentionRegex finds @username mentions in a comment
+var mentionRegex = regexp.MustCompile(`@([\p{L}\p{N}_.-]+)`)
+
+//Comment is a message in the discussion of an event. Replies point at the
+//top level comment of their thread with ParentID
+type Comment struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time `json:"-"`
+	EventID   uint       `gorm:"index"`
+	AuthorID  uint
+	Author    User   `gorm:"foreignkey:AuthorID"`
+	ParentID  uint   `gorm:"index"`
+	Body      string `gorm:"size:2000"`
+	Pinned    bool
+	Edited    bool
+	Replies   []Comment `gorm:"-"`
+}
+
+//CommentRevision keeps the previous text of an edited comment
+type CommentRevision struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	CommentID uint   `gorm:"index"`
+	Body      string `gorm:"size:2000"`
+}
+
+func GetComments(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	event, ok := loadCommentEvent(w, r)
+	if !ok {
+		return
+	}
+
+	//Private event discussions are only shown to invited users
+	if !CanViewEvent(event, userID, r.URL.Query().Get("invite")) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	// Gets pagination keys from url. e.x ?page=2&limit=20
+	page, limit := pagination(r, defaultCommentLimit, maxCommentLimit)
+
+	// Pinned threads come first, the rest in the order they were written
+	var total int
+	var comments []Comment
+	tx := db.Model(&Comment{}).Where("event_id = ? AND parent_id = 0", event.ID)
+	tx.Count(&total)
+	tx.Preload("Author").Order("pinned DESC").Order("created_at").
+		Offset((page - 1) * limit).Limit(limit).Find(&comments)
+
+	// Loads the replies of every thread on the page
+	if len(comments) != 0 {
+		threadIDs := make([]uint, len(comments))
+		for i, comment := range comments {
+			threadIDs[i] = comment.ID
+		}
+
+		var replies []Comment
+		db.Preload("Author").Where("parent_id IN (?)", threadIDs).Order("created_at").Find(&replies)
+		for i := range comments {
+			for _, reply := range replies {
+				if reply.ParentID == comments[i].ID {
+					comments[i].Replies = append(comments[i].Replies, reply)
+				}
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Comments []Comment
+		Page     int
+		Limit    int
+		Total    int
+	}{comments, page, limit, total}, w)
+	return
+}
+
+func CreateComment(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	event, ok := loadCommentEvent(w, r)
+	if !ok {
+		return
+	}
+
+	var author User
+	db.First(&author, session.Values["userID"].(uint))
+
+	//Only the creator and participants can discuss private events
+	if !CanComment(event, author.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var comment Comment
+	json.NewDecoder(r.Body).Decode(&comment)
+
+	comment.Body = strings.TrimSpace(comment.Body)
+	if comment.Body == "" || len(comment.Body) > maxCommentLength {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	violations, ok := filterContent(w, author.ID, true, ContentField{"Body", comment.Body})
+	if !ok {
+		return
+	}
+
+	//Replies to replies are added to the thread of the top level comment
+	if comment.ParentID != 0 {
+		var parent Comment
+		if db.First(&parent, "id = ? AND event_id = ?", comment.ParentID, event.ID).RecordNotFound() {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		if parent.ParentID != 0 {
+			comment.ParentID = parent.ParentID
+		}
+	}
+
+	comment = Comment{
+		EventID:  event.ID,
+		AuthorID: author.ID,
+		ParentID: comment.ParentID,
+		Body:     comment.Body,
+	}
+	if db.Create(&comment).Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	comment.Author = author
+	FlagContent(ReportTargetComment, comment.ID, author.ID, violations)
+
+	NotifyMentions(event, comment, "")
+	NotifyCommentParticipants(event, comment)
+	PublishEventUpdate(event, UpdateCommentCreated, comment)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(comment, w)
+	return
+}
+
+//EditComment lets the author change the text of a comment and the event
+//creator pin or unpin it
+func EditComment(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	event, comment, ok := loadComment(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		Body   string
+		Pinned *bool
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	requestData.Body = strings.TrimSpace(requestData.Body)
+
+	if (requestData.Body != "" && comment.AuthorID != userID) ||
+		(requestData.Pinned != nil && !CanManageEvent(event, userID)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if requestData.Body != "" && requestData.Body != comment.Body {
+		if len(requestData.Body) > maxCommentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		violations, ok := filterContent(w, userID, true, ContentField{"Body", requestData.Body})
+		if !ok {
+			return
+		}
+		FlagContent(ReportTargetComment, comment.ID, userID, violations)
+
+		//Keeps the previous text in the edit history
+		db.Create(&CommentRevision{CommentID: comment.ID, Body: comment.Body})
+		previousBody := comment.Body
+		db.Model(&comment).Updates(Comment{Body: requestData.Body, Edited: true})
+		NotifyMentions(event, comment, previousBody)
+	}
+
+	//Only top level comments can be pinned
+	if requestData.Pinned != nil && comment.ParentID == 0 {
+		db.Model(&comment).Updates(map[string]interface{}{"pinned": *requestData.Pinned})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(comment, w)
+	return
+}
+
+//DeleteComment deletes a comment and its replies. Authors can delete their
+//own comments, event creators and moderators can delete any
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+
+	event, comment, ok := loadComment(w, r)
+	if !ok {
+		return
+	}
+
+	if comment.AuthorID != user.ID && !CanManageEvent(event, user.ID) && !user.IsModerator() {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Delete(&comment)
+	if comment.ParentID == 0 {
+		db.Where("parent_id = ?", comment.ID).Delete(Comment{})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetCommentHistory returns the previous versions of a comment, oldest first
+func GetCommentHistory(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	event, comment, ok := loadComment(w, r)
+	if !ok {
+		return
+	}
+
+	if !CanViewEvent(event, userID, r.URL.Query().Get("invite")) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var revisions []CommentRevision
+	db.Where("comment_id = ?", comment.ID).Order("created_at").Find(&revisions)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(revisions, w)
+	return
+}
+
+//CanComment checks if a user can take part in the discussion of an event.
+//Events hidden by a moderator can not be discussed
+func CanComment(event Event, userID uint) bool {
+	if event.Hidden {
+		return false
+	}
+	if event.Visibility != VisibilityPrivate && event.Visibility != VisibilityMembers {
+		return true
+	}
+	if event.Visibility == VisibilityMembers && IsGroupMember(event.GroupID, userID) {
+		return true
+	}
+	return CanManageEvent(event, userID) || isParticipant(event.ID, userID)
+}
+
+//NotifyMentions notifies the users mentioned with @username in a comment
+//that are allowed to see the event. Users already mentioned in the
+//previous text of an edited comment are not notified again
+func NotifyMentions(event Event, comment Comment, previousBody string) {
+	previous := map[string]bool{}
+	for _, match := range mentionRegex.FindAllStringSubmatch(previousBody, -1) {
+		previous[match[1]] = true
+	}
+
+	var usernames []string
+	for _, match := range mentionRegex.FindAllStringSubmatch(comment.Body, -1) {
+		if !previous[match[1]] {
+			usernames = append(usernames, match[1])
+		}
+	}
+	if len(usernames) == 0 {
+		return
+	}
+
+	var mentioned []User
+	db.Where("username IN (?)", usernames).Find(&mentioned)
+
+	var userIDs []uint
+	for _, user := range mentioned {
+		if user.ID != comment.AuthorID && CanViewEvent(event, user.ID, "") {
+			userIDs = append(userIDs, user.ID)
+		}
+	}
+
+	NotifyUsers(userIDs, NotificationCommentMention, event.ID,
+		fmt.Sprintf("%s mentioned you in %s", comment.Author.Username, eventSummary(event)))
+}
+
+//NotifyCommentParticipants tells the creator and participants of the event
+//about a new comment. Mentioned users already got a mention notification
+func NotifyCommentParticipants(event Event, comment Comment) {
+	mentioned := map[string]bool{}
+	for _, match := range mentionRegex.FindAllStringSubmatch(comment.Body, -1) {
+		mentioned[match[1]] = true
+	}
+
+	var users []User
+	db.Where("id IN (?)", eventUserIDs(event, comment.AuthorID)).Find(&users)
+
+	var userIDs []uint
+	for _, user := range users {
+		if !mentioned[user.Username] {
+			userIDs = append(userIDs, user.ID)
+		}
+	}
+
+	NotifyUsers(userIDs, NotificationCommentCreated, event.ID,
+		fmt.Sprintf("%s commented on %s", comment.Author.Username, eventSummary(event)))
+}
+
+// loadCommentEvent loads the event from /events/{id}/comments. Writes the
+// error response when it fails
+func loadCommentEvent(w http.ResponseWriter, r *http.Request) (event Event, ok bool) {
+	params := mux.Vars(r)
+	eventID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	if db.First(&event, eventID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	return event, true
+}
+
+// loadComment loads the event and comment from /events/{id}/comments/{commentID}
+func loadComment(w http.ResponseWriter, r *http.Request) (event Event, comment Comment, ok bool) {
+	event, ok = loadCommentEvent(w, r)
+	if !ok {
+		return event, comment, false
+	}
+
+	commentID, err := strconv.Atoi(mux.Vars(r)["commentID"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return event, comment, false
+	}
+
+	if db.Preload("Author").First(&comment, "id = ? AND event_id = ?", commentID, event.ID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return event, comment, false
+	}
+
+	return event, comment, true
+}
+
+// pagination reads ?page= and ?limit= from the url, pages start at 1
+func pagination(r *http.Request, defaultLimit int, maxLimit int) (page int, limit int) {
+	keys := r.URL.Query()
+
+	page, err := strconv.Atoi(keys.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err = strconv.Atoi(keys.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return page, limit
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Modes of the content filter
+const (
+	// ContentFilterReject refuses text that breaks a rule
+	ContentFilterReject = "reject"
+	// ContentFilterFlag saves the text and reports it to the moderators
+	ContentFilterFlag = "flag"
+	ContentFilterOff  = "off"
+)
+
+// Rules text can break
+const (
+	ContentProfanity = "profanity"
+	ContentLink      = "link"
+	ContentPhone     = "phone"
+	ContentSpam      = "spam"
+)
+
+// Spam rules
+const (
+	// spamWindow is how long posts of a user are remembered
+	spamWindow = 10 * time.Minute
+	// spamRepeats is how many times the same text can be posted in the window
+	spamRepeats = 2
+	// spamMaxPosts is how many posts a user can write in the window
+	spamMaxPosts = 20
+)
+
+// Built-in word lists, words ending with * also match longer words. They
+// are matched after normalizeText, so Lithuanian words are written without
+// diacritics
+var (
+	englishWords = []string{
+		"fuck*", "motherfuck*", "shit*", "bullshit*", "bitch*", "asshole*", "cunt*", "dick", "dickhead*",
+		"bastard*", "slut*", "whore*", "faggot*", "nigger*", "nigga*", "retard*", "wank*", "twat*", "piss",
+	}
+	lithuanianWords = []string{
+		"pyzd*", "pizd*", "bybi*", "bybys", "kurv*", "blet", "bliat*", "blia", "nachui", "nahui", "naxui",
+		"pydar*", "pederast*", "sudas", "sudo", "sudu", "sudai", "sikn*", "kekse*", "kekses", "chuj*",
+		"huj*", "mudak*", "debil*", "lochas", "lochai",
+	}
+)
+
+var (
+	linkRegex = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.` +
+		`(?:com|lt|net|org|io|eu|info|biz|ru|me|co|app|xyz|link|ly|gg)\b(?:/\S*)?`)
+	// phoneRegex finds digits with separators, candidates are phone numbers
+	// when they have enough digits
+	phoneRegex = regexp.MustCompile(`\+?\d[\d\s\-().]{6,}\d`)
+	// dateTimeRegex finds dates like 2026-10-19 or 19.10.2026 and times like
+	// 18:00 or 18.00, they are taken out before looking for phone numbers
+	dateTimeRegex = regexp.MustCompile(`\b(?:19|20)\d\d[-./](?:0?[1-9]|1[0-2])[-./](?:0?[1-9]|[12]\d|3[01])|` +
+		`\b(?:0?[1-9]|[12]\d|3[01])[-./](?:0?[1-9]|1[0-2])[-./](?:19|20)\d\d|` +
+		`\b(?:[01]?\d|2[0-3])[:.][0-5]\d(?::[0-5]\d)?\b`)
+)
+
+// Digits and symbols written instead of letters
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+
+// Lithuanian letters are compared without diacritics
+var diacriticsReplacer = strings.NewReplacer("ą", "a", "č", "c", "ę", "e", "ė", "e", "į", "i", "š", "s", "ų", "u", "ū", "u", "ž", "z")
+
+//ContentField is a piece of user text with the name of the field it is
+//written in
+type ContentField struct {
+	Name string
+	Text string
+}
+
+//ContentViolation is a rule the text of a field breaks
+type ContentViolation struct {
+	Field string
+	Rule  string
+}
+
+//ContentFilter checks text users write for profanity, contact details and
+//spam. Recent posts are remembered in memory, so the spam rules only see
+//the posts of a single server instance
+type ContentFilter struct {
+	Mode     string
+	words    map[string]bool
+	prefixes []string
+
+	mu     sync.Mutex
+	recent map[uint][]recentPost
+}
+
+// recentPost is a post of a user remembered for the spam rules
+type recentPost struct {
+	text string
+	at   time.Time
+}
+
+//NewContentFilter creates a filter with the mode and the blocked words
+func NewContentFilter(mode string, words []string) *ContentFilter {
+	filter := &ContentFilter{Mode: mode, words: map[string]bool{}, recent: map[uint][]recentPost{}}
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		if strings.HasSuffix(word, "*") {
+			filter.prefixes = append(filter.prefixes, normalizeText(strings.TrimSuffix(word, "*")))
+		} else {
+			filter.words[normalizeText(word)] = true
+		}
+	}
+	return filter
+}
+
+//ContentFilterFromEnv sets up the content filter. CONTENT_FILTER_MODE is
+//reject, flag or off and CONTENT_FILTER_WORDS is a file with more blocked
+//words, one per line
+func ContentFilterFromEnv() *ContentFilter {
+	mode := os.Getenv("CONTENT_FILTER_MODE")
+	switch mode {
+	case "":
+		mode = ContentFilterReject
+	case ContentFilterReject, ContentFilterFlag, ContentFilterOff:
+	default:
+		log.Println("Unknown CONTENT_FILTER_MODE", mode, "rejecting filtered content")
+		mode = ContentFilterReject
+	}
+
+	words := append(append([]string{}, englishWords...), lithuanianWords...)
+	if path := os.Getenv("CONTENT_FILTER_WORDS"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Println("Could not read CONTENT_FILTER_WORDS:", err)
+		} else {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				words = append(words, scanner.Text())
+			}
+			file.Close()
+		}
+	}
+	return NewContentFilter(mode, words)
+}
+
+//Check returns the rules the fields break. Posts, e.g. comments and event
+//descriptions, are also checked against the spam rules and remembered
+func (filter *ContentFilter) Check(userID uint, post bool, fields ...ContentField) []ContentViolation {
+	if filter.Mode == ContentFilterOff {
+		return nil
+	}
+
+	var violations []ContentViolation
+	for _, field := range fields {
+		if field.Text == "" {
+			continue
+		}
+		if filter.profane(field.Text) {
+			violations = append(violations, ContentViolation{field.Name, ContentProfanity})
+		}
+		if linkRegex.MatchString(field.Text) {
+			violations = append(violations, ContentViolation{field.Name, ContentLink})
+		}
+		if hasPhoneNumber(field.Text) {
+			violations = append(violations, ContentViolation{field.Name, ContentPhone})
+		}
+		if post && userID != 0 && filter.spam(userID, field.Text) {
+			violations = append(violations, ContentViolation{field.Name, ContentSpam})
+		}
+	}
+	return violations
+}
+
+// profane checks if any word of the text is blocked
+func (filter *ContentFilter) profane(text string) bool {
+	words := strings.FieldsFunc(normalizeText(text), func(r rune) bool { return !unicode.IsLetter(r) })
+	for _, word := range words {
+		if filter.words[word] {
+			return true
+		}
+		for _, prefix := range filter.prefixes {
+			if strings.HasPrefix(word, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spam remembers the post and checks if the user repeats the same text or
+// posts too often
+func (filter *ContentFilter) spam(userID uint, text string) bool {
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+
+	now := time.Now()
+	text = strings.Join(strings.Fields(normalizeText(text)), " ")
+
+	//Forgets posts older than the window, users without recent posts
+	//are dropped
+	posts := filter.recent[userID][:0]
+	repeats := 0
+	for _, post := range filter.recent[userID] {
+		if now.Sub(post.at) > spamWindow {
+			continue
+		}
+		posts = append(posts, post)
+		if post.text == text {
+			repeats++
+		}
+	}
+	posts = append(posts, recentPost{text, now})
+	filter.recent[userID] = posts
+	for id, other := range filter.recent {
+		if len(other) == 0 || now.Sub(other[len(other)-1].at) > spamWindow {
+			delete(filter.recent, id)
+		}
+	}
+
+	return repeats >= spamRepeats || len(posts) > spamMaxPosts
+}
+
+// hasPhoneNumber checks if the text has a number long enough to be a phone
+// number. Dates and times are not counted, so "2026-10-19 18:00" is not one
+func hasPhoneNumber(text string) bool {
+	text = dateTimeRegex.ReplaceAllString(text, "#")
+	for _, candidate := range phoneRegex.FindAllString(text, -1) {
+		digits := 0
+		for _, r := range candidate {
+			if unicode.IsDigit(r) {
+				digits++
+			}
+		}
+		if digits >= 9 && digits <= 15 {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeText lowercases text, removes diacritics, replaces digits used
+// as letters and shortens letters repeated three or more times, so
+// "Šūūūdas" and "5hit" match the word lists
+func normalizeText(text string) string {
+	runes := []rune(leetReplacer.Replace(diacriticsReplacer.Replace(strings.ToLower(text))))
+
+	normalized := make([]rune, 0, len(runes))
+	for i := 0; i < len(runes); {
+		run := 1
+		for i+run < len(runes) && runes[i+run] == runes[i] {
+			run++
+		}
+		if run >= 3 {
+			run = 1
+		}
+		for j := 0; j < run; j++ {
+			normalized = append(normalized, runes[i])
+		}
+		i += run
+		for i < len(runes) && runes[i] == runes[i-1] {
+			i++
+		}
+	}
+	return string(normalized)
+}
+
+// filterContent runs the content filter over the fields. Rejected text gets
+// an error response and ok is false, in flag mode the violations are
+// returned so the content can be flagged once it is saved
+func filterContent(w http.ResponseWriter, userID uint, post bool, fields ...ContentField) (violations []ContentViolation, ok bool) {
+	if contentFilter == nil {
+		return nil, true
+	}
+	violations = contentFilter.Check(userID, post, fields...)
+	if len(violations) != 0 && contentFilter.Mode == ContentFilterReject {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct {
+			Error      string
+			Violations []ContentViolation
+		}{"The text breaks the content rules", violations}, w)
+		return nil, false
+	}
+	return violations, true
+}
+
+//FlagContent reports saved content that broke the content rules to the
+//moderators. The reports have no reporter
+func FlagContent(targetType string, targetID uint, targetUserID uint, violations []ContentViolation) {
+	if len(violations) == 0 {
+		return
+	}
+
+	category := "inappropriate"
+	var details []string
+	for _, violation := range violations {
+		if violation.Rule != ContentProfanity {
+			category = "spam"
+		}
+		details = append(details, violation.Field+": "+violation.Rule)
+	}
+	db.Create(&Report{
+		TargetType:   targetType,
+		TargetID:     targetID,
+		TargetUserID: targetUserID,
+		Category:     category,
+		Details:      "Content filter: " + strings.Join(details, ", "),
+		Status:       ReportOpen,
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestContentFilterWords(t *testing.T) {
+	filter := NewContentFilter(ContentFilterReject, append(append([]string{}, englishWords...), lithuanianWords...))
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"Good game everyone", false},
+		{"What the fuck", true},
+		{"FUUUCKING late again", true},
+		{"This is 5hit", true},
+		{"Šūūūdas, ne žaidimas", true},
+		{"kurva", true},
+		{"Scunthorpe United fans welcome", false},
+		{"Reading Dickens after the game", false},
+		{"Bring a ball and water", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := filter.profane(test.text); got != test.want {
+			t.Errorf("profane(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+
+	custom := NewContentFilter(ContentFilterReject, []string{"# comment", "", " Blogas ", "kvail*"})
+	for text, want := range map[string]bool{"blogas": true, "Kvailys": true, "comment": false, "geras": false} {
+		if got := custom.profane(text); got != want {
+			t.Errorf("custom profane(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
+
+func TestContentFilterLinks(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"Details at https://example.org/game", true},
+		{"Visit www.krepsinis.lt", true},
+		{"Sign up on krepsinis.lt/registracija", true},
+		{"Write to info@sportas.lt", true},
+		{"Join us on Discord.gg", true},
+		{"Meet at 18.00 near the gate", false},
+		{"Bring shoes, e.g. sneakers", false},
+		{"We use node.js at work", false},
+		{"Kaunas, Savanorių pr. 12", false},
+	}
+
+	for _, test := range tests {
+		if got := linkRegex.MatchString(test.text); got != test.want {
+			t.Errorf("link in %q = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestContentFilterPhones(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"Call me +370 612 34567", true},
+		{"Skambink 861234567", true},
+		{"Tel. 8 (612) 34-567", true},
+		{"+37061234567", true},
+		{"2026-10-19 18:00 +370 612 34567", true},
+		{"2026-10-19 18:00", false},
+		{"2026.10.19 18.00 val.", false},
+		{"2026/10/19 18:00:00", false},
+		{"19.10.2026 18:00-20:00", false},
+		{"From 2026-10-19 to 2026-10-26", false},
+		{"18.00-20.00, 2026 10 19", false},
+		{"Limit 10 players, 2 teams of 5", false},
+		{"12345678", false},
+		{"1234567890123456", false},
+	}
+
+	for _, test := range tests {
+		if got := hasPhoneNumber(test.text); got != test.want {
+			t.Errorf("hasPhoneNumber(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
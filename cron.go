@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//CronSchedule is a parsed cron expression with the five usual fields:
+//minute, hour, day of month, month and day of week
+type CronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// When both day fields are restricted a day matching either one runs,
+	// like in cron
+	dayOfMonthAny, dayOfWeekAny bool
+}
+
+// cronField is the range of values of a cron field
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// cronShortcuts are the named schedules that can be used instead of fields
+var cronShortcuts = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+//ParseCron parses a cron expression like "*/5 * * * *" or "@daily".
+//Fields can be *, numbers, ranges (1-5), steps (*/15, 0-30/10) and
+//comma separated lists of those. Sunday is 0 or 7
+func ParseCron(expression string) (CronSchedule, error) {
+	var schedule CronSchedule
+
+	if shortcut, ok := cronShortcuts[strings.TrimSpace(expression)]; ok {
+		expression = shortcut
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return schedule, errors.Errorf("cron expression %q must have 5 fields", expression)
+	}
+
+	values := make([]uint64, len(fields))
+	for i, field := range fields {
+		max := cronFields[i].max
+		//Allows 7 for Sunday in the day of week field
+		if i == 4 {
+			max = 7
+		}
+		bits, err := parseCronField(field, cronFields[i].min, max)
+		if err != nil {
+			return schedule, errors.Wrapf(err, "cron expression %q", expression)
+		}
+		values[i] = bits
+	}
+	if values[4]&(1<<7) != 0 {
+		values[4] |= 1
+	}
+
+	schedule = CronSchedule{
+		minute:        values[0],
+		hour:          values[1],
+		dayOfMonth:    values[2],
+		month:         values[3],
+		dayOfWeek:     values[4],
+		dayOfMonthAny: fields[2] == "*",
+		dayOfWeekAny:  fields[4] == "*",
+	}
+	return schedule, nil
+}
+
+// parseCronField returns the allowed values of a field as bits
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, errors.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			low, err1 = strconv.Atoi(bounds[0])
+			high, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, errors.Errorf("invalid range %q", part)
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, errors.Errorf("invalid value %q", part)
+			}
+			low, high = value, value
+			//A single value with a step runs from the value to the end
+			if step != 1 {
+				high = max
+			}
+		}
+
+		if low < min || high > max || low > high {
+			return 0, errors.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+//Next returns the first time after t the schedule runs, in the location of t.
+//Returns the zero time when nothing matches within five years
+func (schedule CronSchedule) Next(t time.Time) time.Time {
+	location := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if schedule.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !schedule.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			continue
+		}
+		if schedule.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+			continue
+		}
+		if schedule.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchesDay checks the day of month and day of week fields
+func (schedule CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := schedule.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := schedule.dayOfWeek&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case schedule.dayOfMonthAny && schedule.dayOfWeekAny:
+		return true
+	case schedule.dayOfMonthAny:
+		return dayOfWeek
+	case schedule.dayOfWeekAny:
+		return dayOfMonth
+	}
+	return dayOfMonth || dayOfWeek
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        bool
+	}{
+		{"* * * * *", false},
+		{"*/5 * * * *", false},
+		{"0-30/10 8-18 * * 1-5", false},
+		{"0 0 1,15 * 7", false},
+		{"5/15 * * * *", false},
+		{"@daily", false},
+		{" @hourly ", false},
+		{"", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"a * * * *", true},
+		{"1-a * * * *", true},
+		{"@weekdays", true},
+	}
+
+	for _, test := range tests {
+		_, err := ParseCron(test.expression)
+		if test.err && err == nil {
+			t.Errorf("ParseCron(%q) did not fail", test.expression)
+		}
+		if !test.err && err != nil {
+			t.Errorf("ParseCron(%q) failed: %v", test.expression, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	vilnius, err := time.LoadLocation("Europe/Vilnius")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+
+	// 2020-10-20 is a Tuesday
+	from := time.Date(2020, 10, 20, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		{"* * * * *", from, time.Date(2020, 10, 20, 10, 8, 0, 0, time.UTC)},
+		{"*/5 * * * *", from, time.Date(2020, 10, 20, 10, 10, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2020, 10, 20, 10, 10, 0, 0, time.UTC), time.Date(2020, 10, 20, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", from, time.Date(2020, 10, 20, 10, 25, 0, 0, time.UTC)},
+		{"0 * * * *", from, time.Date(2020, 10, 20, 11, 0, 0, 0, time.UTC)},
+		{"30 3 * * *", from, time.Date(2020, 10, 21, 3, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", from, time.Date(2020, 10, 20, 13, 0, 0, 0, time.UTC)},
+		{"@daily", from, time.Date(2020, 10, 21, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", from, time.Date(2020, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", from, time.Date(2020, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 8 * * 1-5", time.Date(2020, 10, 23, 9, 0, 0, 0, time.UTC), time.Date(2020, 10, 26, 8, 0, 0, 0, time.UTC)},
+		{"@monthly", from, time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 1 * 5", from, time.Date(2020, 10, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", from, time.Time{}},
+		// Runs in the location of the given time
+		{"0 3 * * *", time.Date(2020, 10, 20, 12, 0, 0, 0, vilnius), time.Date(2020, 10, 21, 3, 0, 0, 0, vilnius)},
+		// Times skipped by the daylight saving change do not run that day
+		{"30 3 * * *", time.Date(2020, 3, 29, 0, 0, 0, 0, vilnius), time.Date(2020, 3, 30, 3, 30, 0, 0, vilnius)},
+		{"0 12 * * *", time.Date(2020, 10, 24, 13, 0, 0, 0, vilnius), time.Date(2020, 10, 25, 12, 0, 0, 0, vilnius)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expression)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) failed: %v", test.expression, err)
+		}
+		if got := schedule.Next(test.from); !got.Equal(test.want) {
+			t.Errorf("%q after %s: got %s, want %s", test.expression, test.from, got, test.want)
+		}
+	}
+}
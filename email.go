@@ -0,0 +1,52 @@
+package main
+
+import (
+	"mime"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//NotificationReminderEmail turns off reminders by email
+const NotificationReminderEmail = "event_reminder_email"
+
+//EmailChannel sends reminders by email through an SMTP server
+type EmailChannel struct {
+	// Address is host:port of the SMTP server
+	Address  string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+//Name of the channel
+func (channel *EmailChannel) Name() string { return "email" }
+
+//Preference that turns the channel off
+func (channel *EmailChannel) Preference() string { return NotificationReminderEmail }
+
+//Send emails the reminder to the user
+func (channel *EmailChannel) Send(reminder Reminder) error {
+	var auth smtp.Auth
+	if channel.Username != "" {
+		auth = smtp.PlainAuth("", channel.Username, channel.Password, channel.Host)
+	}
+
+	message := strings.Join([]string{
+		"From: " + channel.From,
+		"To: " + reminder.User.Email,
+		"Subject: " + mime.QEncoding.Encode("utf-8", reminder.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		reminder.Body,
+		"",
+	}, "\r\n")
+
+	err := smtp.SendMail(channel.Address, auth, channel.From, []string{reminder.User.Email}, []byte(message))
+	return errors.Wrap(err, "sending email")
+}
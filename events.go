@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -9,31 +10,68 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Lifecycle states of an event, see eventTransitions for the allowed changes
+const (
+	EventStatusDraft     = "draft"
+	EventStatusPublished = "published"
+	EventStatusPostponed = "postponed"
+	EventStatusOngoing   = "ongoing"
+	EventStatusFinished  = "finished"
+	EventStatusCancelled = "cancelled"
 )
 
 type Event struct {
-	ID           uint       `json: "-" gorm:"primary_key"`
-	CreatedAt    time.Time  `json: "-"`
-	UpdatedAt    time.Time  `json: "-"`
-	DeletedAt    *time.Time `json: "-"`
-	Creator      User       `gorm:"foreignkey:CreatorID"`
-	CreatorName  string
-	CreatorID    uint
-	Description  string    `json: "description"`
-	Sport        string    `json: "sport"`
+	ID          uint       `json: "-" gorm:"primary_key"`
+	CreatedAt   time.Time  `json: "-"`
+	UpdatedAt   time.Time  `json: "-"`
+	DeletedAt   *time.Time `json: "-"`
+	Creator     User       `gorm:"foreignkey:CreatorID"`
+	CreatorName string
+	CreatorID   uint
+	// GroupID is the group that owns the event, its organizers manage it
+	GroupID     uint   `gorm:"index"`
+	Description string `json: "description"`
+	Sport       string `json: "sport"`
+	SportID     uint   `gorm:"index"`
+	// Level is the skill level the event is for, empty when anyone can come
+	Level        string    `gorm:"size:20"`
 	Location     string    `json: "location"`
 	StartTime    time.Time `json: "startTime"`
 	EndTime      time.Time `json: "endTime"`
 	Limit        int       `json: "limit"`
 	Participants int       `json:"participants"`
 	Users        []*User   `gorm:"many2many:events_joined;"`
-}
-
-func DeletePassedEvents() {
-	for {
-		db.Where("end_time < ?", time.Now()).Delete(Event{})
-		time.Sleep(time.Minute)
-	}
+	// Occurrences of a recurring event point at their series and remember
+	// the start time the recurrence rule generated for them
+	SeriesID        uint
+	OccurrenceStart *time.Time
+	Detached        bool
+	// Sequence is the iCalendar revision number of the event
+	Sequence int
+	Status   string `gorm:"size:20;index"`
+	// StatusReason explains why an event was cancelled or postponed
+	StatusReason string
+	Visibility   string `gorm:"size:20"`
+	// RequiresApproval makes users ask the organizers before joining
+	RequiresApproval bool
+	// Hidden events were hidden by a moderator, only their organizers see them
+	Hidden bool
+	Teams  []Team `gorm:"foreignkey:EventID"`
+	// TeamsLocked stops the creator from changing the teams
+	TeamsLocked bool
+	// FriendsGoing are the friends and followed users of the logged in
+	// user that organize or joined the event
+	FriendsGoing []*User `json:",omitempty" gorm:"-"`
+	// CoverKey is where the cover image is kept in the blob store
+	CoverKey string `json:"-" gorm:"size:100"`
+	// Cover is only filled in by GetEvents and GetEvent
+	Cover *ImageURLs `json:",omitempty" gorm:"-"`
+	// StatsCounted is set once the stats of its users were updated after
+	// the event finished
+	StatsCounted bool `json:"-" gorm:"index"`
 }
 
 func CreateEvent(w http.ResponseWriter, r *http.Request) {
@@ -48,12 +86,65 @@ func CreateEvent(w http.ResponseWriter, r *http.Request) {
 	var user User
 	db.First(&user, session.Values["userID"].(uint))
 
-	var newEvent Event
+	// Recurring events additionally carry an RRULE, excluded dates and the
+	// time zone the rule is expanded in
+	var eventData struct {
+		Event
+		Recurrence string
+		ExDates    []time.Time
+		TimeZone   string
+	}
 	// Get event data from json body
-	err := json.NewDecoder(r.Body).Decode(&newEvent)
+	err := json.NewDecoder(r.Body).Decode(&eventData)
+	newEvent := eventData.Event
 	newEvent.Creator = user
 	newEvent.CreatorName = user.Username
 	newEvent.Participants = 1
+	//Users join through JoinEvent, which checks bans, approval and limits
+	newEvent.Users = nil
+	newEvent.Teams = nil
+	newEvent.TeamsLocked = false
+	//Occurrences are only created by series
+	newEvent.SeriesID = 0
+	newEvent.OccurrenceStart = nil
+	newEvent.Detached = false
+	newEvent.Sequence = 0
+	//Only moderators hide events
+	newEvent.Hidden = false
+	//Reasons are only given when an event is cancelled or postponed
+	newEvent.StatusReason = ""
+	if !validVisibility(newEvent.Visibility) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	//The sport has to be in the catalog and the limit has to suit it
+	if err == nil {
+		if sportErr := ApplySport(&newEvent); sportErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{sportErr.Error()}, w)
+			return
+		}
+	}
+	if newEvent.Visibility == "" {
+		newEvent.Visibility = VisibilityPublic
+	}
+	//Only organizers create events of a group, members events need one
+	if newEvent.GroupID != 0 && !IsGroupOrganizer(newEvent.GroupID, user.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"Only group organizers can create group events"}, w)
+		return
+	}
+	if newEvent.Visibility == VisibilityMembers && newEvent.GroupID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Members events need a group"}, w)
+		return
+	}
+
+	// Events are published right away unless they are created as drafts
+	if newEvent.Status != EventStatusDraft {
+		newEvent.Status = EventStatusPublished
+	}
 
 	if err != nil {
 		log.Println(err)
@@ -61,6 +152,39 @@ func CreateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Only the description counts towards the spam rules, the same sport
+	//and location are expected on many events of a user
+	violations, ok := filterContent(w, user.ID, true, ContentField{"Description", newEvent.Description})
+	if !ok {
+		return
+	}
+	details, ok := filterContent(w, user.ID, false, ContentField{"Location", newEvent.Location},
+		ContentField{"Sport", newEvent.Sport})
+	if !ok {
+		return
+	}
+	violations = append(violations, details...)
+
+	if eventData.Recurrence != "" {
+		series, err := CreateSeries(user, newEvent, eventData.Recurrence, eventData.ExDates, eventData.TimeZone)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		//Flags the first occurrence, moderators hide the others from there
+		if len(violations) != 0 {
+			var first Event
+			db.Where("series_id = ?", series.ID).Order("start_time").First(&first)
+			FlagContent(ReportTargetEvent, first.ID, user.ID, violations)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
 	// Create an association between creator_id and a users id
 	db.Model(&newEvent).AddForeignKey("creator_id", "users(id)", "RESTRICT", "RESTRICT")
 	// Create event
@@ -69,6 +193,7 @@ func CreateEvent(w http.ResponseWriter, r *http.Request) {
 		JSONResponse(struct{}{}, w)
 		return
 	}
+	FlagContent(ReportTargetEvent, newEvent.ID, user.ID, violations)
 
 	w.WriteHeader(http.StatusCreated)
 	JSONResponse(struct{}{}, w)
@@ -102,36 +227,121 @@ func JoinEvent(w http.ResponseWriter, r *http.Request) {
 	var selectedEvent Event
 	db.Preload("Users").First(&selectedEvent, "id = ?", eventID)
 
-	// check if event is not full
-	if selectedEvent.Limit == selectedEvent.Participants {
+	//Check if event and user exist
+	if selectedEvent.ID == 0 || user.ID == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		JSONResponse(struct{}{}, w)
 		return
 	}
 
-	//Check if event and user exist
-	if selectedEvent.ID == 0 || user.ID == 0 {
-		w.WriteHeader(http.StatusBadRequest)
+	if isParticipant(selectedEvent.ID, user.ID) {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"You already joined the event"}, w)
+		return
+	}
+
+	//Check if the event is open and the user is not its creator, users
+	//are put on the waitlist of full events below
+	err = JoinableBy(selectedEvent, user)
+	full := err == ErrEventFull
+	if err != nil && !full {
+		if err == ErrEventNotJoinable || err == ErrEventHidden {
+			w.WriteHeader(http.StatusConflict)
+		} else if err == ErrBanned {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		JSONResponse(struct{ Error string }{err.Error()}, w)
+		return
+	}
+
+	//Private events can only be joined with an invitation or an invite link
+	if !AuthorizeJoin(selectedEvent, user, r.URL.Query().Get("invite")) {
+		w.WriteHeader(http.StatusForbidden)
 		JSONResponse(struct{}{}, w)
 		return
 	}
 
-	//Check if user is not the creator
-	if user.ID == selectedEvent.CreatorID {
+	//Participants can declare their skill level for splitting teams
+	//e.x {"SkillLevel": 4}
+	joinData := struct {
+		SkillLevel int
+	}{}
+	json.NewDecoder(r.Body).Decode(&joinData)
+	if joinData.SkillLevel != 0 && (joinData.SkillLevel < minSkillLevel || joinData.SkillLevel > maxSkillLevel) {
 		w.WriteHeader(http.StatusBadRequest)
 		JSONResponse(struct{}{}, w)
 		return
 	}
 
+	//Events that require approval are joined once an organizer accepts
+	//the request, co-organizers join right away
+	if selectedEvent.RequiresApproval && !CanManageEvent(selectedEvent, user.ID) {
+		RequestToJoin(w, selectedEvent, user, joinData.SkillLevel)
+		return
+	}
+
+	//Users wait for a place in full events
+	if full {
+		JoinWaitlist(w, selectedEvent, user, joinData.SkillLevel)
+		return
+	}
+
 	//Add user to event
-	db.Model(&selectedEvent).Association("Users").Append(&user)
-	db.Model(&selectedEvent).Updates(Event{Participants: selectedEvent.Participants + 1})
+	AddParticipant(&selectedEvent, &user)
+	if joinData.SkillLevel != 0 {
+		db.Model(&EventParticipant{}).Where("event_id = ? AND user_id = ?", selectedEvent.ID, user.ID).
+			Updates(map[string]interface{}{"skill_level": joinData.SkillLevel})
+	}
 
 	w.WriteHeader(http.StatusOK)
 	JSONResponse(struct{}{}, w)
 	return
 }
 
+// Reasons an event can not be joined
+var (
+	ErrEventNotJoinable  = errors.New("Only published events that have not started can be joined")
+	ErrEventFull         = errors.New("Event is full")
+	ErrCreatorCanNotJoin = errors.New("Creator can not join their own event")
+	ErrBanned            = errors.New("You are banned from the events of this organizer")
+	ErrEventHidden       = errors.New("Event was hidden by a moderator")
+)
+
+//JoinableBy checks if the event is open for the user to join
+func JoinableBy(event Event, user User) error {
+	if event.Hidden {
+		return ErrEventHidden
+	}
+	if event.Status != EventStatusPublished || !event.StartTime.After(time.Now()) {
+		return ErrEventNotJoinable
+	}
+	if user.ID == event.CreatorID {
+		return ErrCreatorCanNotJoin
+	}
+	if IsBanned(event.CreatorID, user.ID) {
+		return ErrBanned
+	}
+	//Checked last, users that get ErrEventFull can wait for a place
+	if event.Limit != 0 && event.Participants >= event.Limit {
+		return ErrEventFull
+	}
+	return nil
+}
+
+//AddParticipant adds the user to the event and counts them in
+func AddParticipant(event *Event, user *User) {
+	db.Model(event).Association("Users").Append(user)
+	countParticipants(event)
+	//Users let in another way no longer wait for approval
+	db.Model(&JoinRequest{}).Where("event_id = ? AND user_id = ? AND status = ?", event.ID, user.ID, JoinRequestPending).
+		Updates(JoinRequest{Status: JoinRequestAccepted})
+	PublishEventUpdate(*event, UpdateParticipantJoined, participantUpdate(*event, *user))
+	NotifyUsers([]uint{event.CreatorID}, NotificationParticipantJoin, event.ID,
+		fmt.Sprintf("%s joined %s", user.Username, eventSummary(*event)))
+}
+
 func LeaveEvent(w http.ResponseWriter, r *http.Request) {
 	//Get user id from auth token
 	session, _ := sessionStore.Get(r, "Access-token")
@@ -166,16 +376,38 @@ func LeaveEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//Check if user is not the creator
+	//Check if user is not the creator, creators have to hand the event
+	//over before leaving it
 	if user.ID == selectedEvent.CreatorID {
 		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Transfer the event to someone else before leaving it"}, w)
+		return
+	}
+
+	//Users that did not join yet withdraw their join request or leave the
+	//waitlist
+	if !isParticipant(selectedEvent.ID, user.ID) {
+		withdrawn := db.Where("event_id = ? AND user_id = ? AND status = ?", selectedEvent.ID, user.ID, JoinRequestPending).
+			Delete(JoinRequest{}).RowsAffected
+		withdrawn += db.Where("event_id = ? AND user_id = ?", selectedEvent.ID, user.ID).Delete(WaitlistEntry{}).RowsAffected
+		if withdrawn == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
 		JSONResponse(struct{}{}, w)
 		return
 	}
 
 	// Delete user from an event
 	db.Model(&selectedEvent).Association("Users").Delete(&user)
-	db.Model(&selectedEvent).Updates(Event{Participants: selectedEvent.Participants - 1})
+	RemoveFromTeams(selectedEvent.ID, user.ID)
+	countParticipants(&selectedEvent)
+	PublishEventUpdate(selectedEvent, UpdateParticipantLeft, participantUpdate(selectedEvent, user))
+	NotifyUsers([]uint{selectedEvent.CreatorID}, NotificationParticipantLeave, selectedEvent.ID,
+		fmt.Sprintf("%s left %s", user.Username, eventSummary(selectedEvent)))
+	PromoteFromWaitlist(&selectedEvent)
 	w.WriteHeader(http.StatusOK)
 	JSONResponse(struct{}{}, w)
 	return
@@ -187,10 +419,17 @@ func GetEvents(w http.ResponseWriter, r *http.Request) {
 	location := keys.Get("location")
 	creatorID := keys.Get("creatorID")
 	sport := keys.Get("sport")
+	sportID := keys.Get("sportId")
+	level := keys.Get("level")
+	friends := keys.Get("friends")
+	status := keys.Get("status")
 	var events []Event
 
 	// Preloads user and creator tables for use in event response
-	tx := db.Preload("Users").Preload("Creator")
+	// and hides private events the user was not invited to
+	session, _ := sessionStore.Get(r, "Access-token")
+	tx := db.Preload("Users").Preload("Creator").Preload("Teams", orderTeams).Preload("Teams.Members").
+		Scopes(VisibleTo(session.Values["userID"]))
 
 	// If a certain tag is not null, it is used to filter events
 	if location != "" {
@@ -202,6 +441,35 @@ func GetEvents(w http.ResponseWriter, r *http.Request) {
 	if sport != "" {
 		tx = tx.Where("sport = ?", sport)
 	}
+	if sportID != "" {
+		tx = tx.Where("sport_id = ?", sportID)
+	}
+	if level != "" {
+		tx = tx.Where("level = ?", level)
+	}
+	// Only lists events friends or followed users organize or joined
+	if friends == "true" && session.Values["userID"] != nil {
+		circle := CircleIDs(session.Values["userID"].(uint))
+		tx = tx.Where("creator_id IN (?) OR id IN (SELECT event_id FROM events_joined WHERE user_id IN (?))",
+			circle, circle)
+	}
+	// Finished and cancelled events are only listed when asked for,
+	// drafts are only listed to their creator
+	switch status {
+	case "":
+		tx = tx.Where("status IN (?)", []string{EventStatusPublished, EventStatusPostponed, EventStatusOngoing})
+	case EventStatusDraft:
+		tx = tx.Where("status = ? AND (creator_id = ? OR group_id IN "+
+			"(SELECT group_id FROM group_members WHERE user_id = ? AND status = ? AND role IN (?)))",
+			status, session.Values["userID"], session.Values["userID"], GroupMemberActive,
+			[]string{GroupRoleOwner, GroupRoleOrganizer})
+	case EventStatusPublished, EventStatusPostponed, EventStatusOngoing, EventStatusFinished, EventStatusCancelled:
+		tx = tx.Where("status = ?", status)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
 	// Finds events based on given parameters
 	tx.Find(&events)
 
@@ -212,6 +480,11 @@ func GetEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	FillImageURLs(events)
+	if session.Values["userID"] != nil {
+		FillFriendsGoing(events, session.Values["userID"].(uint))
+	}
+
 	w.WriteHeader(http.StatusOK)
 	JSONResponse(events, w)
 	return
@@ -242,22 +515,47 @@ func DeleteEvent(w http.ResponseWriter, r *http.Request) {
 	var event Event
 	db.Preload("Users").Where("id = ?", eventID).First(&event)
 
-	//checks if the user that is trying to delete event is its creator
-	if event.CreatorID != userID {
+	//checks if the user that is trying to delete the event owns it,
+	//co-organizers can not delete events
+	if !IsEventOwner(event, userID) {
 		w.WriteHeader(http.StatusUnauthorized)
 		JSONResponse(struct{}{}, w)
 		return
 	}
 
-	//Deletes the record from database
-	if db.Unscoped().Delete(&event).RecordNotFound() {
-		w.WriteHeader(http.StatusBadRequest)
-		JSONResponse(struct{}{}, w)
-		return
+	//Only the organizers of a series can delete its later occurrences
+	deleteFuture := event.SeriesID != 0 && r.URL.Query().Get("scope") == scopeFuture
+	if deleteFuture {
+		if _, err = loadManagedSeries(event, userID); err == ErrSeriesNotManaged {
+			w.WriteHeader(http.StatusUnauthorized)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		}
 	}
 
-	//Deletes associations (users that joined the event)
-	db.Model(&event).Association("Users").Delete(&event.Users)
+	//Lets everyone on the event know it is gone
+	NotifyEventUsers(event, userID, NotificationEventDeleted, eventSummary(event)+" has been deleted")
+	PublishEventUpdate(event, UpdateEventDeleted, nil)
+
+	//Occurrences of a series can be deleted together with every later one,
+	//otherwise the occurrence is excluded from its series
+	if event.SeriesID != 0 {
+		if deleteFuture {
+			if DeleteFutureOccurrences(event, userID) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				JSONResponse(struct{}{}, w)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		ExcludeOccurrence(event, userID)
+	}
+
+	//Deletes the record from database with everything that belongs to it
+	purgeEvent(&event)
 
 	w.WriteHeader(http.StatusOK)
 	JSONResponse(struct{}{}, w)
@@ -289,15 +587,90 @@ func EditEvent(w http.ResponseWriter, r *http.Request) {
 	var event Event
 	tx := db.Preload("Users").Where("id = ?", eventID).First(&event)
 
-	//checks if the user that is trying to delete event is its creator
-	if event.CreatorID != userID {
+	//checks if the user that is trying to change the event manages it
+	if !CanManageEvent(event, userID) {
 		w.WriteHeader(http.StatusUnauthorized)
 		JSONResponse(struct{}{}, w)
 		return
 	}
 
-	var updatedEvent Event
-	json.NewDecoder(r.Body).Decode(&updatedEvent)
+	//Cancelled and finished events can not be changed anymore
+	if event.Status == EventStatusCancelled || event.Status == EventStatusFinished {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Cancelled and finished events can not be edited"}, w)
+		return
+	}
+
+	//RequiresApproval is a pointer so it can be turned off
+	var updatedData struct {
+		Event
+		RequiresApproval *bool
+	}
+	json.NewDecoder(r.Body).Decode(&updatedData)
+	updatedEvent := updatedData.Event
+
+	violations, ok := filterContent(w, userID, true, ContentField{"Description", updatedEvent.Description})
+	if !ok {
+		return
+	}
+	details, ok := filterContent(w, userID, false, ContentField{"Location", updatedEvent.Location},
+		ContentField{"Sport", updatedEvent.Sport})
+	if !ok {
+		return
+	}
+	violations = append(violations, details...)
+
+	//A changed sport, level or limit is checked against the sports catalog
+	if updatedEvent.SportID != 0 || updatedEvent.Sport != "" || updatedEvent.Level != "" || updatedEvent.Limit != 0 {
+		checked := event
+		if updatedEvent.SportID != 0 || updatedEvent.Sport != "" {
+			checked.SportID, checked.Sport = updatedEvent.SportID, updatedEvent.Sport
+		} else if checked.SportID == 0 {
+			//Sports of events created before the catalog are not checked
+			checked.Sport = ""
+		}
+		if updatedEvent.Level != "" {
+			checked.Level = updatedEvent.Level
+		}
+		if updatedEvent.Limit != 0 {
+			checked.Limit = updatedEvent.Limit
+		}
+		if err = ApplySport(&checked); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		}
+		if checked.SportID != 0 {
+			updatedEvent.SportID, updatedEvent.Sport = checked.SportID, checked.Sport
+		}
+		updatedEvent.Level, updatedEvent.Limit = checked.Level, checked.Limit
+	}
+
+	FlagContent(ReportTargetEvent, event.ID, userID, violations)
+
+	//Edits this and every later occurrence of a series
+	if event.SeriesID != 0 && r.URL.Query().Get("scope") == scopeFuture {
+		if err = EditFutureOccurrences(event, updatedEvent, updatedData.RequiresApproval, userID); err == ErrSeriesNotManaged {
+			w.WriteHeader(http.StatusUnauthorized)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		publishEventEdited(event.ID)
+		NotifyEventUsers(event, userID, NotificationEventChanged, eventSummary(event)+" has been changed")
+
+		w.WriteHeader(http.StatusOK)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	previous := event
+	//An occurrence edited on its own is no longer changed with its series
+	if event.SeriesID != 0 {
+		tx.Model(&event).Updates(Event{Detached: true})
+	}
 
 	if updatedEvent.Description != "" {
 		tx.Model(&event).Updates(Event{Description: updatedEvent.Description})
@@ -311,6 +684,33 @@ func EditEvent(w http.ResponseWriter, r *http.Request) {
 	if updatedEvent.Limit != 0 {
 		tx.Model(&event).Updates(Event{Limit: updatedEvent.Limit})
 	}
+	if updatedEvent.SportID != 0 {
+		tx.Model(&event).Updates(Event{SportID: updatedEvent.SportID, Sport: updatedEvent.Sport})
+	}
+	if updatedEvent.Level != "" {
+		tx.Model(&event).Updates(Event{Level: updatedEvent.Level})
+	}
+	if updatedEvent.Visibility != "" && validVisibility(updatedEvent.Visibility) &&
+		(updatedEvent.Visibility != VisibilityMembers || event.GroupID != 0) {
+		tx.Model(&event).Updates(Event{Visibility: updatedEvent.Visibility})
+	}
+	if updatedData.RequiresApproval != nil {
+		tx.Model(&event).Updates(map[string]interface{}{"requires_approval": *updatedData.RequiresApproval})
+	}
+	//A raised limit lets users on the waitlist in
+	if updatedEvent.Limit != 0 {
+		PromoteFromWaitlist(&event)
+	}
+	//Lets calendar clients know the event has changed
+	tx.Model(&event).Updates(Event{Sequence: event.Sequence + 1})
+	publishEventEdited(event.ID)
+	//Participants are told when the event moves to another time
+	if !event.StartTime.Equal(previous.StartTime) {
+		NotifyEventUsers(event, userID, NotificationEventRescheduled,
+			fmt.Sprintf("%s has been moved to %s", eventSummary(previous), event.StartTime.UTC().Format(time.RFC1123)))
+	} else {
+		NotifyEventUsers(event, userID, NotificationEventChanged, eventSummary(previous)+" has been changed")
+	}
 	// //Edits the record in database
 	// if tx.Model(&event).Updates(Event{Description: updatedEvent.Description}).RowsAffected == 0 {
 	// 	w.WriteHeader(http.StatusBadRequest)
@@ -322,3 +722,11 @@ func EditEvent(w http.ResponseWriter, r *http.Request) {
 	JSONResponse(struct{}{}, w)
 	return
 }
+
+// publishEventEdited pushes the current state of an edited event
+func publishEventEdited(eventID uint) {
+	var event Event
+	if !db.Preload("Creator").First(&event, eventID).RecordNotFound() {
+		PublishEventUpdate(event, UpdateEventEdited, event)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Types of feed items
+const (
+	FeedFollowedEvent  = "followed_event"
+	FeedSuggestedEvent = "suggested_event"
+	FeedEventUpdate    = "event_update"
+)
+
+// Feed rules
+const (
+	// feedWindow is how far back the feed looks for new and changed events
+	feedWindow = 30 * 24 * time.Hour
+	// feedSourceLimit bounds the events each source adds to the feed
+	feedSourceLimit = 100
+	// feedCacheTTL is how long a built feed is reused
+	feedCacheTTL = time.Minute
+	// feedCacheSize bounds the feeds a MemoryFeedCache keeps
+	feedCacheSize = 10000
+	// feedLocations is how many of the usual locations of a user are used
+	// for suggestions
+	feedLocations = 3
+)
+
+// Weights of the feed sources, items are ranked by weight and recency
+var feedWeights = map[string]float64{
+	FeedEventUpdate:    1.5,
+	FeedFollowedEvent:  1,
+	FeedSuggestedEvent: 0.5,
+}
+
+//FeedItem is an entry of the activity feed of a user
+type FeedItem struct {
+	Type  string
+	Event Event
+	// Reason explains why the item is in the feed
+	Reason string
+	Time   time.Time
+	Score  float64
+}
+
+//Feed is the ranked feed of a user as of a time
+type Feed struct {
+	AsOf  time.Time
+	Items []FeedItem
+}
+
+//FeedCache keeps built feeds, so paging through a feed does not build it
+//again. The default MemoryFeedCache works for a single server instance
+type FeedCache interface {
+	Get(key string) (Feed, bool)
+	Set(key string, feed Feed, ttl time.Duration)
+}
+
+//MemoryFeedCache is a FeedCache in the memory of the server
+type MemoryFeedCache struct {
+	mu      sync.Mutex
+	entries map[string]feedCacheEntry
+}
+
+// feedCacheEntry is a feed with the time it expires at
+type feedCacheEntry struct {
+	feed    Feed
+	expires time.Time
+}
+
+//NewMemoryFeedCache creates an empty MemoryFeedCache
+func NewMemoryFeedCache() *MemoryFeedCache {
+	return &MemoryFeedCache{entries: map[string]feedCacheEntry{}}
+}
+
+//Get returns the feed stored under key unless it expired
+func (cache *MemoryFeedCache) Get(key string) (Feed, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return Feed{}, false
+	}
+	return entry.feed, true
+}
+
+//Set stores a feed for ttl and drops expired ones. When the cache is full
+//the feed that expires first makes room
+func (cache *MemoryFeedCache) Set(key string, feed Feed, ttl time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	var first string
+	for stored, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, stored)
+		} else if first == "" || entry.expires.Before(cache.entries[first].expires) {
+			first = stored
+		}
+	}
+	if _, ok := cache.entries[key]; !ok && len(cache.entries) >= feedCacheSize {
+		delete(cache.entries, first)
+	}
+	cache.entries[key] = feedCacheEntry{feed, now.Add(ttl)}
+}
+
+//GetFeed returns the activity feed of the logged in user: new events of
+//friends and followed users, suggested events in their sports at their
+//usual locations and changes to events they joined. Pages continue from
+//the Next cursor of the previous one. e.x ?cursor=...&limit=20
+func GetFeed(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	_, limit := pagination(r, 20, 50)
+
+	//The first page shows the latest feed, the cursor of later pages
+	//remembers which feed they belong to and the last item sent
+	var after *feedCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := parseFeedCursor(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		after = &cursor
+	}
+
+	var feed Feed
+	var ok bool
+	if after == nil {
+		feed, ok = feedCache.Get(fmt.Sprintf("feed:%d", userID))
+	} else {
+		feed, ok = feedCache.Get(fmt.Sprintf("feed:%d:%d", userID, after.asOf.UnixNano()))
+	}
+	if !ok {
+		feed.AsOf = time.Now()
+		if after != nil {
+			feed.AsOf = after.asOf
+		}
+		feed.Items = BuildFeed(userID, feed.AsOf)
+		if after == nil {
+			feedCache.Set(fmt.Sprintf("feed:%d", userID), feed, feedCacheTTL)
+		}
+		feedCache.Set(fmt.Sprintf("feed:%d:%d", userID, feed.AsOf.UnixNano()), feed, feedCacheTTL)
+	}
+	items := feed.Items
+
+	//Skips the items up to the cursor. Searching by rank instead of an
+	//offset keeps the place when the feed is built again
+	start := 0
+	if after != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return !feedRanksBefore(items[i], after.score, after.key) && feedItemKey(items[i]) != after.key
+		})
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	page := items[start:end]
+
+	var next string
+	if end < len(items) {
+		last := page[len(page)-1]
+		next = feedCursor{feed.AsOf, last.Score, feedItemKey(last)}.String()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Items []FeedItem
+		Next  string
+	}{page, next}, w)
+	return
+}
+
+//BuildFeed collects and ranks the feed of a user as of a time
+func BuildFeed(userID uint, asOf time.Time) []FeedItem {
+	since := asOf.Add(-feedWindow)
+	open := []string{EventStatusPublished, EventStatusPostponed, EventStatusOngoing}
+	blocked := BlockedIDs(userID)
+	items := []FeedItem{}
+	seen := map[uint]bool{}
+
+	add := func(itemType string, event Event, reason string, at time.Time, boost float64) {
+		if seen[event.ID] {
+			return
+		}
+		seen[event.ID] = true
+		items = append(items, FeedItem{
+			Type:   itemType,
+			Event:  event,
+			Reason: reason,
+			Time:   at,
+			Score:  feedScore(feedWeights[itemType]+boost, asOf.Sub(at)),
+		})
+	}
+
+	//Changes to events the user joined
+	var updated []Event
+	db.Preload("Creator").Scopes(VisibleTo(userID)).
+		Where("id IN (SELECT event_id FROM events_joined WHERE user_id = ?)", userID).
+		Where("sequence > 0 AND updated_at > ? AND updated_at <= ?", since, asOf).
+		Order("updated_at DESC").Limit(feedSourceLimit).Find(&updated)
+	for _, event := range updated {
+		reason := "changed"
+		if event.Status == EventStatusCancelled || event.Status == EventStatusPostponed {
+			reason = event.Status
+		}
+		add(FeedEventUpdate, event, reason, event.UpdatedAt, 0)
+	}
+
+	//New upcoming events of friends and followed users
+	if circle := CircleIDs(userID); len(circle) != 0 {
+		var created []Event
+		db.Preload("Creator").Scopes(VisibleTo(userID)).
+			Where("creator_id IN (?) AND status IN (?) AND start_time > ?", circle, open, asOf).
+			Where("created_at > ? AND created_at <= ?", since, asOf).
+			Order("created_at DESC").Limit(feedSourceLimit).Find(&created)
+		for _, event := range created {
+			add(FeedFollowedEvent, event, event.Creator.Username+" organizes it", event.CreatedAt, 0)
+		}
+	}
+
+	//Upcoming events in the sports of the user at the places they usually go
+	sports := userSports(userID)
+	locations := usualLocations(userID, feedLocations)
+	if len(sports) != 0 && len(locations) != 0 {
+		levels := map[uint]string{}
+		var sportIDs []uint
+		for _, sport := range sports {
+			levels[sport.SportID] = sport.Level
+			sportIDs = append(sportIDs, sport.SportID)
+		}
+
+		tx := db.Preload("Creator").Scopes(VisibleTo(userID)).
+			Where("sport_id IN (?) AND location IN (?) AND status IN (?) AND start_time > ?", sportIDs, locations, open, asOf).
+			Where("created_at > ? AND created_at <= ? AND creator_id <> ?", since, asOf, userID).
+			Where("id NOT IN (SELECT event_id FROM events_joined WHERE user_id = ?)", userID)
+		if len(blocked) != 0 {
+			tx = tx.Where("creator_id NOT IN (?)", blocked)
+		}
+		var suggested []Event
+		tx.Order("created_at DESC").Limit(feedSourceLimit).Find(&suggested)
+		for _, event := range suggested {
+			//Events for the level of the user rank higher
+			boost := 0.0
+			if event.Level != "" && event.Level == levels[event.SportID] {
+				boost = 0.25
+			}
+			add(FeedSuggestedEvent, event, event.Sport+" at "+event.Location, event.CreatedAt, boost)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return feedRanksBefore(items[i], items[j].Score, feedItemKey(items[j]))
+	})
+	return items
+}
+
+// feedScore weighs an item down as it gets older, by half after a day
+func feedScore(weight float64, age time.Duration) float64 {
+	return weight / (1 + age.Hours()/24)
+}
+
+// feedRanksBefore orders items by score and then by key, so every item has
+// a fixed place
+func feedRanksBefore(item FeedItem, score float64, key string) bool {
+	if item.Score != score {
+		return item.Score > score
+	}
+	return feedItemKey(item) < key
+}
+
+// feedItemKey identifies an item of a feed
+func feedItemKey(item FeedItem) string {
+	return fmt.Sprintf("%s-%d", item.Type, item.Event.ID)
+}
+
+// usualLocations returns the locations of the events the user organized
+// or joined most often
+func usualLocations(userID uint, count int) []string {
+	var locations []string
+	db.Table("events").
+		Where("(creator_id = ? OR id IN (SELECT event_id FROM events_joined WHERE user_id = ?)) AND location <> ''",
+			userID, userID).
+		Group("location").Order("COUNT(*) DESC, location").Limit(count).Pluck("location", &locations)
+	return locations
+}
+
+// feedCursor is the place of a page in a feed
+type feedCursor struct {
+	asOf  time.Time
+	score float64
+	key   string
+}
+
+// String encodes the cursor for the url
+func (cursor feedCursor) String() string {
+	value := fmt.Sprintf("%d:%s:%s", cursor.asOf.UnixNano(), strconv.FormatFloat(cursor.score, 'g', -1, 64), cursor.key)
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// parseFeedCursor decodes a cursor made by feedCursor.String. Cursors of
+// feeds from the future or older than the feed window are refused
+func parseFeedCursor(value string) (cursor feedCursor, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	parts := strings.SplitN(string(decoded), ":", 3)
+	if len(parts) != 3 {
+		return cursor, errors.New("Invalid cursor")
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return cursor, err
+	}
+	cursor.score, err = strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return cursor, err
+	}
+	if math.IsNaN(cursor.score) || math.IsInf(cursor.score, 0) {
+		return cursor, errors.New("Invalid cursor")
+	}
+	cursor.asOf = time.Unix(0, unix)
+	if cursor.asOf.After(time.Now()) || time.Since(cursor.asOf) > feedWindow {
+		return cursor, errors.New("Cursor has expired")
+	}
+	cursor.key = parts[2]
+	return cursor, nil
+}
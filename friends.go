@@ -0,0 +1,366 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// States of a friend request
+const (
+	FriendshipPending  = "pending"
+	FriendshipAccepted = "accepted"
+)
+
+// Types of notifications about the social graph
+const (
+	NotificationFriendRequest  = "friend_request"
+	NotificationFriendAccepted = "friend_accepted"
+	NotificationNewFollower    = "new_follower"
+)
+
+//Friendship is a friend request from UserID to FriendID, the users are
+//friends once it is accepted
+type Friendship struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UserID     uint   `gorm:"unique_index:idx_friendship"`
+	FriendID   uint   `gorm:"unique_index:idx_friendship;index"`
+	Status     string `gorm:"size:20"`
+	AcceptedAt *time.Time
+}
+
+//Follow is a user following another one without needing their approval
+type Follow struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	FollowerID uint `gorm:"unique_index:idx_follow"`
+	FolloweeID uint `gorm:"unique_index:idx_follow;index"`
+}
+
+//Block stops BlockedID from following, befriending or contacting UserID
+type Block struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UserID    uint `gorm:"unique_index:idx_block"`
+	BlockedID uint `gorm:"unique_index:idx_block;index"`
+}
+
+//GetFriends lists the friends, friend requests, followed users and
+//followers of the logged in user
+func GetFriends(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	var incomingIDs, outgoingIDs, followingIDs, followerIDs []uint
+	db.Model(&Friendship{}).Where("friend_id = ? AND status = ?", userID, FriendshipPending).
+		Pluck("user_id", &incomingIDs)
+	db.Model(&Friendship{}).Where("user_id = ? AND status = ?", userID, FriendshipPending).
+		Pluck("friend_id", &outgoingIDs)
+	db.Model(&Follow{}).Where("follower_id = ?", userID).Pluck("followee_id", &followingIDs)
+	db.Model(&Follow{}).Where("followee_id = ?", userID).Pluck("follower_id", &followerIDs)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Friends   []User
+		Incoming  []User
+		Outgoing  []User
+		Following []User
+		Followers []User
+	}{
+		usersByID(FriendIDs(userID)),
+		usersByID(incomingIDs),
+		usersByID(outgoingIDs),
+		usersByID(followingIDs),
+		usersByID(followerIDs),
+	}, w)
+	return
+}
+
+//RequestFriend sends a friend request to a user. When the user already
+//asked to be friends their request is accepted instead
+func RequestFriend(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	if IsBlocked(user.ID, other.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"User is blocked"}, w)
+		return
+	}
+
+	var friendship Friendship
+	if !db.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+		user.ID, other.ID, other.ID, user.ID).First(&friendship).RecordNotFound() {
+		if friendship.Status == FriendshipPending && friendship.FriendID == user.ID {
+			acceptFriendship(friendship, user)
+			w.WriteHeader(http.StatusOK)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Friend request already exists"}, w)
+		return
+	}
+
+	db.Create(&Friendship{UserID: user.ID, FriendID: other.ID, Status: FriendshipPending})
+	NotifyUsers([]uint{other.ID}, NotificationFriendRequest, 0, user.Username+" wants to be your friend")
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//AcceptFriend accepts the friend request of a user
+func AcceptFriend(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	var friendship Friendship
+	if db.Where("user_id = ? AND friend_id = ? AND status = ?", other.ID, user.ID, FriendshipPending).
+		First(&friendship).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	acceptFriendship(friendship, user)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//RemoveFriend declines or cancels a friend request, or ends a friendship
+func RemoveFriend(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	if db.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+		user.ID, other.ID, other.ID, user.ID).Delete(Friendship{}).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//FollowUser follows a user
+func FollowUser(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	if IsBlocked(user.ID, other.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"User is blocked"}, w)
+		return
+	}
+
+	follow := Follow{FollowerID: user.ID, FolloweeID: other.ID}
+	if db.Where(follow).First(&Follow{}).RecordNotFound() {
+		db.Create(&follow)
+		NotifyUsers([]uint{other.ID}, NotificationNewFollower, 0, user.Username+" started following you")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//UnfollowUser stops following a user
+func UnfollowUser(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	db.Where("follower_id = ? AND followee_id = ?", user.ID, other.ID).Delete(Follow{})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetBlocks lists the users the logged in user blocked
+func GetBlocks(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var blockedIDs []uint
+	db.Model(&Block{}).Where("user_id = ?", session.Values["userID"]).Pluck("blocked_id", &blockedIDs)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(usersByID(blockedIDs), w)
+	return
+}
+
+//BlockUser blocks a user. Friendships and follows between the users end
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	block := Block{UserID: user.ID, BlockedID: other.ID}
+	if db.Where(block).First(&Block{}).RecordNotFound() {
+		db.Create(&block)
+	}
+	db.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)",
+		user.ID, other.ID, other.ID, user.ID).Delete(Friendship{})
+	db.Where("(follower_id = ? AND followee_id = ?) OR (follower_id = ? AND followee_id = ?)",
+		user.ID, other.ID, other.ID, user.ID).Delete(Follow{})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//UnblockUser removes a block
+func UnblockUser(w http.ResponseWriter, r *http.Request) {
+	user, other, ok := loadOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	db.Where("user_id = ? AND blocked_id = ?", user.ID, other.ID).Delete(Block{})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//FriendIDs returns the ids of the friends of a user
+func FriendIDs(userID uint) []uint {
+	var sent, received []uint
+	db.Model(&Friendship{}).Where("user_id = ? AND status = ?", userID, FriendshipAccepted).Pluck("friend_id", &sent)
+	db.Model(&Friendship{}).Where("friend_id = ? AND status = ?", userID, FriendshipAccepted).Pluck("user_id", &received)
+	return append(sent, received...)
+}
+
+//CircleIDs returns the ids of the friends of a user and of the users they
+//follow, whose activity they see
+func CircleIDs(userID uint) []uint {
+	var followingIDs []uint
+	db.Model(&Follow{}).Where("follower_id = ?", userID).Pluck("followee_id", &followingIDs)
+
+	seen := map[uint]bool{}
+	var ids []uint
+	for _, id := range append(FriendIDs(userID), followingIDs...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//IsBlocked checks if either user blocked the other
+func IsBlocked(userID uint, otherID uint) bool {
+	var count int
+	db.Model(&Block{}).Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)",
+		userID, otherID, otherID, userID).Count(&count)
+	return count != 0
+}
+
+//BlockedIDs returns the ids of the users that blocked the user or that the
+//user blocked
+func BlockedIDs(userID uint) []uint {
+	var blocked, blockedBy []uint
+	db.Model(&Block{}).Where("user_id = ?", userID).Pluck("blocked_id", &blocked)
+	db.Model(&Block{}).Where("blocked_id = ?", userID).Pluck("user_id", &blockedBy)
+	return append(blocked, blockedBy...)
+}
+
+//FillFriendsGoing sets FriendsGoing of events to the friends and followed
+//users of the user that organize or joined them. Events need their users
+//and creator preloaded
+func FillFriendsGoing(events []Event, userID uint) {
+	if userID == 0 || len(events) == 0 {
+		return
+	}
+	circle := map[uint]bool{}
+	for _, id := range CircleIDs(userID) {
+		circle[id] = true
+	}
+	if len(circle) == 0 {
+		return
+	}
+
+	for i := range events {
+		if circle[events[i].CreatorID] {
+			creator := events[i].Creator
+			events[i].FriendsGoing = append(events[i].FriendsGoing, &creator)
+		}
+		for _, user := range events[i].Users {
+			if circle[user.ID] {
+				events[i].FriendsGoing = append(events[i].FriendsGoing, user)
+			}
+		}
+	}
+}
+
+// acceptFriendship accepts a pending friend request sent to user
+func acceptFriendship(friendship Friendship, user User) {
+	now := time.Now()
+	db.Model(&friendship).Updates(Friendship{Status: FriendshipAccepted, AcceptedAt: &now})
+	NotifyUsers([]uint{friendship.UserID}, NotificationFriendAccepted, 0, user.Username+" accepted your friend request")
+}
+
+// usersByID loads users in the order of their ids
+func usersByID(ids []uint) []User {
+	users := []User{}
+	if len(ids) != 0 {
+		db.Where("id IN (?)", ids).Order("id").Find(&users)
+	}
+	return users
+}
+
+// loadOtherUser loads the logged in user and the user from
+// /account/.../{userID}. Writes the error response when either is missing
+// or they are the same user
+func loadOtherUser(w http.ResponseWriter, r *http.Request) (user User, other User, ok bool) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return user, other, false
+	}
+	db.First(&user, session.Values["userID"].(uint))
+
+	otherID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil || uint(otherID) == user.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return user, other, false
+	}
+	if db.First(&other, otherID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return user, other, false
+	}
+	return user, other, true
+}
@@ -7,8 +7,10 @@ require (
 	github.com/gofrs/uuid v3.3.0+incompatible
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/sessions v1.2.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jinzhu/gorm v1.9.12
 	github.com/pkg/errors v0.9.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/wader/gormstore v0.0.0-20200328121358-65a111a20c23
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 )
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Roles of group members
+const (
+	GroupRoleOwner     = "owner"
+	GroupRoleOrganizer = "organizer"
+	GroupRoleMember    = "member"
+)
+
+// States of a group membership
+const (
+	GroupMemberActive  = "active"
+	GroupMemberPending = "pending"
+)
+
+// How users join a group
+const (
+	// Anyone can join open groups right away
+	GroupJoinOpen = "open"
+	// Join requests of approval groups wait for an organizer
+	GroupJoinApproval = "approval"
+)
+
+// Types of notifications about groups
+const (
+	NotificationGroupJoinRequest  = "group_join_request"
+	NotificationGroupJoinApproved = "group_join_approved"
+)
+
+//Group is a club whose organizers run events together
+type Group struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Name        string `gorm:"size:100"`
+	Description string `gorm:"size:1000"`
+	JoinPolicy  string `gorm:"size:20"`
+	OwnerID     uint   `gorm:"index"`
+	// Members is only filled in by GetGroup
+	Members int `gorm:"-"`
+}
+
+//GroupMember is a user in a group, or a request to join it while pending
+type GroupMember struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	GroupID   uint   `gorm:"unique_index:idx_group_member"`
+	UserID    uint   `gorm:"unique_index:idx_group_member;index"`
+	User      *User  `json:",omitempty" gorm:"foreignkey:UserID"`
+	Role      string `gorm:"size:20"`
+	Status    string `gorm:"size:20"`
+}
+
+//CreateGroup creates a group owned by the logged in user
+func CreateGroup(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	var group Group
+	json.NewDecoder(r.Body).Decode(&group)
+	group.ID = 0
+	group.OwnerID = userID
+	if group.JoinPolicy == "" {
+		group.JoinPolicy = GroupJoinOpen
+	}
+	if !validGroup(group) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Create(&group)
+	db.Create(&GroupMember{GroupID: group.ID, UserID: userID, Role: GroupRoleOwner, Status: GroupMemberActive})
+	group.Members = 1
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(group, w)
+	return
+}
+
+//GetGroups lists groups, optionally searched by name. e.x ?q=kaunas&page=2
+func GetGroups(w http.ResponseWriter, r *http.Request) {
+	page, limit := pagination(r, 20, 100)
+
+	tx := db.Model(&Group{})
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		tx = tx.Where("LOWER(name) LIKE ?", "%"+strings.ToLower(q)+"%")
+	}
+
+	groups := []Group{}
+	tx.Order("name").Offset((page - 1) * limit).Limit(limit).Find(&groups)
+	for i := range groups {
+		groups[i].Members = countGroupMembers(groups[i].ID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(groups, w)
+	return
+}
+
+//GetGroup returns a group page with its upcoming events the user can see
+func GetGroup(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	group, ok := loadGroup(w, r)
+	if !ok {
+		return
+	}
+	group.Members = countGroupMembers(group.ID)
+
+	events := []Event{}
+	db.Preload("Creator").Scopes(VisibleTo(userID)).
+		Where("group_id = ? AND start_time > ? AND status IN (?)", group.ID, time.Now(),
+			[]string{EventStatusPublished, EventStatusPostponed}).
+		Order("start_time").Find(&events)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Group  Group
+		Role   string
+		Events []Event
+	}{group, GroupRole(group.ID, userID), events}, w)
+	return
+}
+
+//EditGroup changes the name, description or join policy of a group.
+//Organizers only
+func EditGroup(w http.ResponseWriter, r *http.Request) {
+	group, _, ok := loadManagedGroup(w, r, GroupRoleOrganizer)
+	if !ok {
+		return
+	}
+
+	updated := group
+	json.NewDecoder(r.Body).Decode(&updated)
+	updated.ID = group.ID
+	updated.OwnerID = group.OwnerID
+	if !validGroup(updated) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	db.Model(&group).Updates(map[string]interface{}{
+		"name":        updated.Name,
+		"description": updated.Description,
+		"join_policy": updated.JoinPolicy,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(updated, w)
+	return
+}
+
+//DeleteGroup deletes a group. Its events stay with their creators and
+//members-only events become private. Owner only
+func DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	group, _, ok := loadManagedGroup(w, r, GroupRoleOwner)
+	if !ok {
+		return
+	}
+
+	db.Model(&Event{}).Where("group_id = ? AND visibility = ?", group.ID, VisibilityMembers).
+		Updates(map[string]interface{}{"visibility": VisibilityPrivate})
+	db.Model(&Event{}).Where("group_id = ?", group.ID).Updates(map[string]interface{}{"group_id": 0})
+	db.Model(&EventSeries{}).Where("group_id = ? AND visibility = ?", group.ID, VisibilityMembers).
+		Updates(map[string]interface{}{"visibility": VisibilityPrivate})
+	db.Model(&EventSeries{}).Where("group_id = ?", group.ID).Updates(map[string]interface{}{"group_id": 0})
+	db.Where("group_id = ?", group.ID).Delete(GroupMember{})
+	db.Delete(&group)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetGroupMembers lists the members of a group. Organizers can list the
+//pending join requests with ?status=pending
+func GetGroupMembers(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	group, ok := loadGroup(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = GroupMemberActive
+	}
+	if status != GroupMemberActive && (status != GroupMemberPending || !IsGroupOrganizer(group.ID, userID)) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	members := []GroupMember{}
+	db.Preload("User").Where("group_id = ? AND status = ?", group.ID, status).Order("id").Find(&members)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(members, w)
+	return
+}
+
+//JoinGroup adds the logged in user to an open group, or asks the
+//organizers of an approval group to let them in
+func JoinGroup(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+
+	group, ok := loadGroup(w, r)
+	if !ok {
+		return
+	}
+
+	if !db.Where("group_id = ? AND user_id = ?", group.ID, user.ID).First(&GroupMember{}).RecordNotFound() {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Already a member or asked to join"}, w)
+		return
+	}
+
+	member := GroupMember{GroupID: group.ID, UserID: user.ID, Role: GroupRoleMember, Status: GroupMemberActive}
+	if group.JoinPolicy == GroupJoinApproval {
+		member.Status = GroupMemberPending
+	}
+	db.Create(&member)
+
+	if member.Status == GroupMemberPending {
+		NotifyUsers(groupOrganizerIDs(group.ID), NotificationGroupJoinRequest, 0,
+			user.Username+" asked to join "+group.Name)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(member, w)
+	return
+}
+
+//ApproveGroupMember lets a user that asked to join a group in. Organizers only
+func ApproveGroupMember(w http.ResponseWriter, r *http.Request) {
+	group, _, ok := loadManagedGroup(w, r, GroupRoleOrganizer)
+	if !ok {
+		return
+	}
+
+	//Gets user id from /groups/{id}/members/{userID}/approve
+	var member GroupMember
+	if db.Where("group_id = ? AND user_id = ? AND status = ?", group.ID, mux.Vars(r)["userID"], GroupMemberPending).
+		First(&member).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Model(&member).Updates(GroupMember{Status: GroupMemberActive})
+	NotifyUsers([]uint{member.UserID}, NotificationGroupJoinApproved, 0, "You are now a member of "+group.Name)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(member, w)
+	return
+}
+
+//SetGroupMemberRole makes a member an organizer or a member again. Owner only
+func SetGroupMemberRole(w http.ResponseWriter, r *http.Request) {
+	group, _, ok := loadManagedGroup(w, r, GroupRoleOwner)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		Role string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	if requestData.Role != GroupRoleOrganizer && requestData.Role != GroupRoleMember {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets user id from /groups/{id}/members/{userID}
+	var member GroupMember
+	if db.Where("group_id = ? AND user_id = ? AND status = ?", group.ID, mux.Vars(r)["userID"], GroupMemberActive).
+		First(&member).RecordNotFound() || member.Role == GroupRoleOwner {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Model(&member).Updates(GroupMember{Role: requestData.Role})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(member, w)
+	return
+}
+
+//RemoveGroupMember lets a user leave a group or withdraw their join
+//request, and organizers remove members or decline requests. The owner
+//can not leave their group
+func RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	group, ok := loadGroup(w, r)
+	if !ok {
+		return
+	}
+
+	//Gets user id from /groups/{id}/members/{userID}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	var member GroupMember
+	if err != nil || db.Where("group_id = ? AND user_id = ?", group.ID, memberID).First(&member).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Organizers can only be removed by the owner
+	role := GroupRole(group.ID, userID)
+	allowed := member.UserID == userID ||
+		(role == GroupRoleOwner) ||
+		(role == GroupRoleOrganizer && member.Role == GroupRoleMember)
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	if member.Role == GroupRoleOwner {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The owner can not leave the group"}, w)
+		return
+	}
+
+	db.Delete(&member)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GroupRole returns the role of an active member of a group, or an empty
+//string when the user is not one
+func GroupRole(groupID uint, userID uint) string {
+	if groupID == 0 || userID == 0 {
+		return ""
+	}
+	var member GroupMember
+	if db.Where("group_id = ? AND user_id = ? AND status = ?", groupID, userID, GroupMemberActive).
+		First(&member).RecordNotFound() {
+		return ""
+	}
+	return member.Role
+}
+
+//IsGroupMember checks if the user is an active member of the group
+func IsGroupMember(groupID uint, userID uint) bool {
+	return GroupRole(groupID, userID) != ""
+}
+
+//IsGroupOrganizer checks if the user organizes or owns the group
+func IsGroupOrganizer(groupID uint, userID uint) bool {
+	role := GroupRole(groupID, userID)
+	return role == GroupRoleOwner || role == GroupRoleOrganizer
+}
+
+//CanManageEvent checks if the user can edit and run an event: its owners
+//and co-organizers
+func CanManageEvent(event Event, userID uint) bool {
+	return IsEventOwner(event, userID) || isCoOrganizer(event.ID, userID)
+}
+
+// groupOrganizerIDs returns the ids of the owner and organizers of a group
+func groupOrganizerIDs(groupID uint) []uint {
+	var ids []uint
+	db.Model(&GroupMember{}).Where("group_id = ? AND status = ? AND role IN (?)",
+		groupID, GroupMemberActive, []string{GroupRoleOwner, GroupRoleOrganizer}).Pluck("user_id", &ids)
+	return ids
+}
+
+// countGroupMembers counts the active members of a group
+func countGroupMembers(groupID uint) int {
+	var count int
+	db.Model(&GroupMember{}).Where("group_id = ? AND status = ?", groupID, GroupMemberActive).Count(&count)
+	return count
+}
+
+// validGroup checks the fields of a group
+func validGroup(group Group) bool {
+	return strings.TrimSpace(group.Name) != "" && len(group.Name) <= 100 && len(group.Description) <= 1000 &&
+		(group.JoinPolicy == GroupJoinOpen || group.JoinPolicy == GroupJoinApproval)
+}
+
+// loadGroup loads the group from /groups/{id}. Writes the error response
+// when it does not exist
+func loadGroup(w http.ResponseWriter, r *http.Request) (group Group, ok bool) {
+	groupID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return group, false
+	}
+
+	if db.First(&group, groupID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return group, false
+	}
+	return group, true
+}
+
+// loadManagedGroup loads the group from /groups/{id} and checks that the
+// logged in user has at least the role. Writes the error response when not
+func loadManagedGroup(w http.ResponseWriter, r *http.Request, role string) (group Group, userID uint, ok bool) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return group, 0, false
+	}
+	userID = session.Values["userID"].(uint)
+
+	group, ok = loadGroup(w, r)
+	if !ok {
+		return group, userID, false
+	}
+
+	userRole := GroupRole(group.ID, userID)
+	if userRole != GroupRoleOwner && (role == GroupRoleOwner || userRole != GroupRoleOrganizer) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return group, userID, false
+	}
+	return group, userID, true
+}
@@ -25,6 +25,7 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 
 func HandleFunctions() {
 	r := mux.NewRouter()
+	r.Use(SuspensionMiddleware)
 	r.HandleFunc("/", LandingPage)
 	r.HandleFunc("/login", IsLoggedIn).Methods("GET")
 	r.HandleFunc("/login", Login).Methods("POST")
@@ -34,14 +35,135 @@ func HandleFunctions() {
 	r.HandleFunc("/account", RegisterNewAccount).Methods("POST")
 	r.HandleFunc("/account", GetAccountInfo).Methods("GET")
 	r.HandleFunc("/account", EditAccountInfo).Methods("PATCH")
+	r.HandleFunc("/account/calendar", GetCalendarFeedURL).Methods("GET", "DELETE")
+	r.HandleFunc("/account/history", GetEventHistory).Methods("GET")
+	r.HandleFunc("/account/invitations", GetAccountInvitations).Methods("GET")
+	r.HandleFunc("/account/attendance", GetAttendanceStats).Methods("GET")
+	r.HandleFunc("/account/stats", GetUserStats).Methods("GET")
+	r.HandleFunc("/account/notifications", GetNotificationPreferences).Methods("GET")
+	r.HandleFunc("/account/notifications", EditNotificationPreferences).Methods("PATCH")
+	r.HandleFunc("/account/push", GetPushSubscriptions).Methods("GET")
+	r.HandleFunc("/account/push", AddPushSubscription).Methods("POST")
+	r.HandleFunc("/account/push", DeletePushSubscription).Methods("DELETE")
+	r.HandleFunc("/account/bans", GetBans).Methods("GET")
+	r.HandleFunc("/account/bans/{userID}", Unban).Methods("DELETE")
+	r.HandleFunc("/account/avatar", UploadAvatar).Methods("PUT")
+	r.HandleFunc("/account/avatar", DeleteAvatar).Methods("DELETE")
 
 	r.HandleFunc("/events", GetEvents).Methods("GET")
+	r.HandleFunc("/events/live", EventUpdates).Methods("GET")
+	r.HandleFunc("/events/{id:[0-9]+}.ics", GetEventICalendar).Methods("GET")
+	r.HandleFunc("/calendar/{token}.ics", GetCalendarFeed).Methods("GET")
 
 	r.HandleFunc("/events", CreateEvent).Methods("POST")
+	r.HandleFunc("/events/{id}", GetEvent).Methods("GET")
 	r.HandleFunc("/events/{id}", EditEvent).Methods("PATCH")
 	r.HandleFunc("/events/{id}", DeleteEvent).Methods("DELETE")
+	r.HandleFunc("/events/{id}/publish", PublishEvent).Methods("POST")
+	r.HandleFunc("/events/{id}/postpone", PostponeEvent).Methods("POST")
+	r.HandleFunc("/events/{id}/cancel", CancelEvent).Methods("POST")
 
 	r.HandleFunc("/events/{id}/users", JoinEvent).Methods("PATCH")
 	r.HandleFunc("/events/{id}/users", LeaveEvent).Methods("DELETE")
+	r.HandleFunc("/events/{id}/users/{userID}", RemoveParticipant).Methods("DELETE")
+	r.HandleFunc("/events/{id}/users/{userID}/rating", RateParticipant).Methods("PUT")
+	r.HandleFunc("/events/{id}/requests", GetJoinRequests).Methods("GET")
+	r.HandleFunc("/events/{id}/requests/{userID}/accept", AcceptJoinRequest).Methods("POST")
+	r.HandleFunc("/events/{id}/requests/{userID}/reject", RejectJoinRequest).Methods("POST")
+	r.HandleFunc("/events/{id}/waitlist", GetWaitlist).Methods("GET")
+	r.HandleFunc("/events/{id}/organizers", GetEventOrganizers).Methods("GET")
+	r.HandleFunc("/events/{id}/organizers/{userID}", AddEventOrganizer).Methods("PUT")
+	r.HandleFunc("/events/{id}/organizers/{userID}", RemoveEventOrganizer).Methods("DELETE")
+	r.HandleFunc("/events/{id}/transfer", TransferEvent).Methods("POST")
+	r.HandleFunc("/events/{id}/audit", GetAuditLog).Methods("GET")
+	r.HandleFunc("/events/{id}/cover", UploadEventCover).Methods("PUT")
+	r.HandleFunc("/events/{id}/cover", DeleteEventCover).Methods("DELETE")
+	r.HandleFunc("/images/{key:.+}", GetImage).Methods("GET")
+	r.HandleFunc("/events/{id}/users/{userID}/attendance", MarkAttendance).Methods("PUT")
+	r.HandleFunc("/events/{id}/attendance", GetEventAttendance).Methods("GET")
+	r.HandleFunc("/events/{id}/checkin", GetCheckInCode).Methods("GET")
+	r.HandleFunc("/events/{id}/checkin.png", GetCheckInQRCode).Methods("GET")
+	r.HandleFunc("/checkin", CheckIn).Methods("POST")
+	r.HandleFunc("/events/{id}/ratings", GetEventRatings).Methods("GET")
+	r.HandleFunc("/events/{id}/ratings", RateEvent).Methods("PUT")
+	r.HandleFunc("/sports", GetSports).Methods("GET")
+	r.HandleFunc("/sports", CreateSport).Methods("POST")
+	r.HandleFunc("/sports/{id}", EditSport).Methods("PATCH")
+	r.HandleFunc("/sports/{id}", DeleteSport).Methods("DELETE")
+	r.HandleFunc("/feed", GetFeed).Methods("GET")
+	r.HandleFunc("/conversations", GetConversations).Methods("GET")
+	r.HandleFunc("/conversations", CreateConversation).Methods("POST")
+	r.HandleFunc("/conversations/unread", GetUnreadMessages).Methods("GET")
+	r.HandleFunc("/conversations/{id:[0-9]+}", GetConversation).Methods("GET")
+	r.HandleFunc("/conversations/{id:[0-9]+}", LeaveConversation).Methods("DELETE")
+	r.HandleFunc("/conversations/{id:[0-9]+}/messages", GetMessages).Methods("GET")
+	r.HandleFunc("/conversations/{id:[0-9]+}/messages", SendMessage).Methods("POST")
+	r.HandleFunc("/conversations/{id:[0-9]+}/read", ReadConversation).Methods("POST")
+	r.HandleFunc("/groups", GetGroups).Methods("GET")
+	r.HandleFunc("/groups", CreateGroup).Methods("POST")
+	r.HandleFunc("/groups/{id}", GetGroup).Methods("GET")
+	r.HandleFunc("/groups/{id}", EditGroup).Methods("PATCH")
+	r.HandleFunc("/groups/{id}", DeleteGroup).Methods("DELETE")
+	r.HandleFunc("/groups/{id}/members", GetGroupMembers).Methods("GET")
+	r.HandleFunc("/groups/{id}/members", JoinGroup).Methods("POST")
+	r.HandleFunc("/groups/{id}/members/{userID}", SetGroupMemberRole).Methods("PATCH")
+	r.HandleFunc("/groups/{id}/members/{userID}", RemoveGroupMember).Methods("DELETE")
+	r.HandleFunc("/groups/{id}/members/{userID}/approve", ApproveGroupMember).Methods("POST")
+	r.HandleFunc("/account/friends", GetFriends).Methods("GET")
+	r.HandleFunc("/account/friends/{userID}", RequestFriend).Methods("PUT")
+	r.HandleFunc("/account/friends/{userID}", RemoveFriend).Methods("DELETE")
+	r.HandleFunc("/account/friends/{userID}/accept", AcceptFriend).Methods("POST")
+	r.HandleFunc("/account/friends/{userID}/decline", RemoveFriend).Methods("POST")
+	r.HandleFunc("/account/following/{userID}", FollowUser).Methods("PUT")
+	r.HandleFunc("/account/following/{userID}", UnfollowUser).Methods("DELETE")
+	r.HandleFunc("/account/blocks", GetBlocks).Methods("GET")
+	r.HandleFunc("/account/blocks/{userID}", BlockUser).Methods("PUT")
+	r.HandleFunc("/account/blocks/{userID}", UnblockUser).Methods("DELETE")
+	r.HandleFunc("/account/sports", GetUserSports).Methods("GET")
+	r.HandleFunc("/account/sports/{sportID}", SetUserSport).Methods("PUT")
+	r.HandleFunc("/account/sports/{sportID}", DeleteUserSport).Methods("DELETE")
+	r.HandleFunc("/events/{id}/teams", GetTeams).Methods("GET")
+	r.HandleFunc("/events/{id}/teams", CreateTeams).Methods("POST")
+	r.HandleFunc("/events/{id}/teams", DeleteTeams).Methods("DELETE")
+	r.HandleFunc("/events/{id}/teams/lock", LockTeams).Methods("POST")
+	r.HandleFunc("/events/{id}/teams/lock", UnlockTeams).Methods("DELETE")
+	r.HandleFunc("/events/{id}/teams/{teamID}", RenameTeam).Methods("PATCH")
+	r.HandleFunc("/events/{id}/teams/{teamID}/users/{userID}", MoveTeamPlayer).Methods("PUT")
+
+	r.HandleFunc("/events/{id}/invitations", InviteToEvent).Methods("POST")
+	r.HandleFunc("/events/{id}/invitations", GetEventInvitations).Methods("GET")
+	r.HandleFunc("/events/{id}/links", CreateInviteLink).Methods("POST")
+	r.HandleFunc("/events/{id}/links/{token}", DeleteInviteLink).Methods("DELETE")
+	r.HandleFunc("/invitations/{id}/accept", AcceptInvitation).Methods("POST")
+	r.HandleFunc("/invitations/{id}/decline", DeclineInvitation).Methods("POST")
+
+	r.HandleFunc("/events/{id}/comments", GetComments).Methods("GET")
+	r.HandleFunc("/events/{id}/comments", CreateComment).Methods("POST")
+	r.HandleFunc("/events/{id}/comments/{commentID}", EditComment).Methods("PATCH")
+	r.HandleFunc("/events/{id}/comments/{commentID}", DeleteComment).Methods("DELETE")
+	r.HandleFunc("/events/{id}/comments/{commentID}/history", GetCommentHistory).Methods("GET")
+
+	r.HandleFunc("/notifications", GetNotifications).Methods("GET")
+	r.HandleFunc("/notifications/read", ReadAllNotifications).Methods("POST")
+	r.HandleFunc("/notifications/stream", NotificationStream).Methods("GET")
+	r.HandleFunc("/notifications/{id}/read", ReadNotification).Methods("POST")
+
+	r.HandleFunc("/reports", CreateReport).Methods("POST")
+	r.HandleFunc("/appeals", CreateAppeal).Methods("POST")
+	r.HandleFunc("/account/moderation", GetModerationHistory).Methods("GET")
+	r.HandleFunc("/admin/reports", GetReports).Methods("GET")
+	r.HandleFunc("/admin/reports/{id}", GetReport).Methods("GET")
+	r.HandleFunc("/admin/reports/{id}", EditReport).Methods("PATCH")
+	r.HandleFunc("/admin/reports/{id}/actions", TakeReportAction).Methods("POST")
+	r.HandleFunc("/admin/appeals", GetAppeals).Methods("GET")
+	r.HandleFunc("/admin/appeals/{id}", DecideAppeal).Methods("POST")
+
+	r.HandleFunc("/admin/jobs", GetJobs).Methods("GET")
+	r.HandleFunc("/admin/jobs/{name}/run", RunJobNow).Methods("POST")
+	r.HandleFunc("/admin/jobs/{name}/runs", GetJobRuns).Methods("GET")
+
+	r.HandleFunc("/series/{id}", GetSeries).Methods("GET")
+	r.HandleFunc("/series/{id}/users", JoinSeries).Methods("PATCH")
+	r.HandleFunc("/series/{id}/users", LeaveSeries).Methods("DELETE")
 	http.ListenAndServe(":8000", r)
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// icalDomain is appended to event ids to make their iCalendar UIDs globally unique
+const icalDomain = "semestroprojektasktu2020"
+
+// icalLineLength is the maximum length of a content line in octets before it is folded
+const icalLineLength = 75
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+//WriteICalendar formats events as an RFC 5545 VCALENDAR object
+func WriteICalendar(events []Event, name string) []byte {
+	var buf bytes.Buffer
+
+	writeICalLine(&buf, "BEGIN:VCALENDAR")
+	writeICalLine(&buf, "VERSION:2.0")
+	writeICalLine(&buf, "PRODID:-//Semestro Projektas//Events//LT")
+	writeICalLine(&buf, "CALSCALE:GREGORIAN")
+	writeICalLine(&buf, "METHOD:PUBLISH")
+	if name != "" {
+		writeICalLine(&buf, "X-WR-CALNAME:"+icalEscaper.Replace(name))
+	}
+
+	for _, event := range events {
+		writeICalLine(&buf, "BEGIN:VEVENT")
+		writeICalLine(&buf, fmt.Sprintf("UID:event-%d@%s", event.ID, icalDomain))
+		writeICalLine(&buf, "DTSTAMP:"+formatICalTime(event.UpdatedAt))
+		writeICalLine(&buf, "CREATED:"+formatICalTime(event.CreatedAt))
+		writeICalLine(&buf, "LAST-MODIFIED:"+formatICalTime(event.UpdatedAt))
+		writeICalLine(&buf, "SEQUENCE:"+strconv.Itoa(event.Sequence))
+		writeICalLine(&buf, "DTSTART:"+formatICalTime(event.StartTime))
+		writeICalLine(&buf, "DTEND:"+formatICalTime(event.EndTime))
+		writeICalLine(&buf, "SUMMARY:"+icalEscaper.Replace(eventSummary(event)))
+		writeICalLine(&buf, "STATUS:"+icalStatus(event.Status))
+		if event.Description != "" {
+			writeICalLine(&buf, "DESCRIPTION:"+icalEscaper.Replace(event.Description))
+		}
+		if event.Location != "" {
+			writeICalLine(&buf, "LOCATION:"+icalEscaper.Replace(event.Location))
+		}
+		if event.Creator.Email != "" {
+			name := strings.Replace(event.CreatorName, `"`, "'", -1)
+			writeICalLine(&buf, fmt.Sprintf("ORGANIZER;CN=\"%s\":mailto:%s", name, event.Creator.Email))
+		}
+		writeICalLine(&buf, "END:VEVENT")
+	}
+
+	writeICalLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// eventSummary is the title calendar applications show for the event
+func eventSummary(event Event) string {
+	if event.Sport != "" && event.Location != "" {
+		return event.Sport + " @ " + event.Location
+	}
+	if event.Sport != "" {
+		return event.Sport
+	}
+	return event.Description
+}
+
+// icalStatus maps an event status to the VEVENT STATUS property
+func icalStatus(status string) string {
+	switch status {
+	case EventStatusCancelled:
+		return "CANCELLED"
+	case EventStatusDraft, EventStatusPostponed:
+		return "TENTATIVE"
+	}
+	return "CONFIRMED"
+}
+
+func formatICalTime(t time.Time) string {
+	return t.UTC().Format(icalDateTimeLayout)
+}
+
+// writeICalLine writes a CRLF terminated content line, folding it so that
+// no line is longer than 75 octets without splitting UTF-8 sequences
+func writeICalLine(buf *bytes.Buffer, line string) {
+	length := 0
+	for _, char := range line {
+		size := len(string(char))
+		if length+size > icalLineLength {
+			buf.WriteString("\r\n ")
+			length = 1
+		}
+		buf.WriteRune(char)
+		length += size
+	}
+	buf.WriteString("\r\n")
+}
+
+//GenerateCalendarToken creates the secret used in a users calendar feed url
+func GenerateCalendarToken() string {
+	token := make([]byte, 32)
+	rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+func GetEventICalendar(w http.ResponseWriter, r *http.Request) {
+	//Gets id from /events/{id}.ics
+	params := mux.Vars(r)
+	eventID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	var event Event
+	if db.Preload("Creator").First(&event, eventID).RecordNotFound() ||
+		!CanViewEvent(event, userID, r.URL.Query().Get("invite")) ||
+		(event.Status == EventStatusDraft && !CanManageEvent(event, userID)) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"event-%d.ics\"", event.ID))
+	w.WriteHeader(http.StatusOK)
+	w.Write(WriteICalendar([]Event{event}, ""))
+}
+
+func GetCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	//Gets token from /calendar/{token}.ics
+	params := mux.Vars(r)
+	token := params["token"]
+
+	var user User
+	if token == "" || db.First(&user, "calendar_token = ?", token).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Events the user created or joined
+	var events []Event
+	db.Preload("Creator").
+		Where("creator_id = ? OR id IN (SELECT event_id FROM events_joined WHERE user_id = ?)", user.ID, user.ID).
+		Order("start_time").
+		Find(&events)
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(WriteICalendar(events, user.Username))
+}
+
+//GetCalendarFeedURL returns the secret calendar feed url of the logged in
+//user, creating the token on first use. DELETE rotates the token so that
+//previously shared urls stop working
+func GetCalendarFeedURL(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var user User
+	if db.First(&user, session.Values["userID"].(uint)).RecordNotFound() {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if user.CalendarToken == "" || r.Method == http.MethodDelete {
+		user.CalendarToken = GenerateCalendarToken()
+		db.Model(&user).Updates(User{CalendarToken: user.CalendarToken})
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		URL string
+	}{fmt.Sprint(scheme, "://", r.Host, "/calendar/", user.CalendarToken, ".ics")}, w)
+	return
+}
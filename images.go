@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Upload limits
+const (
+	// maxImageSize is the largest image file that can be uploaded
+	maxImageSize = 8 << 20
+	// maxImagePixels stops small files that decode into huge images. Decoded
+	// images take up to 4 bytes a pixel, so at most 64 MB
+	maxImagePixels = 16000000
+)
+
+//ImageURLs are the urls of an uploaded image and of its thumbnail
+type ImageURLs struct {
+	URL      string
+	ThumbURL string
+}
+
+// imageSize is a size images are resized to. Cropped images are cut to the
+// aspect ratio of the size, the others keep theirs and fit inside it.
+// Images are never enlarged
+type imageSize struct {
+	width  int
+	height int
+	crop   bool
+}
+
+// Sizes of the image and its thumbnail
+var (
+	avatarSizes = [2]imageSize{{512, 512, true}, {128, 128, true}}
+	coverSizes  = [2]imageSize{{1600, 900, false}, {480, 270, true}}
+)
+
+// encodedImage is a resized image ready to be stored
+type encodedImage struct {
+	data        []byte
+	contentType string
+	extension   string
+}
+
+//UploadAvatar sets the avatar of the logged in user. The image is sent
+//as the image field of a multipart form
+func UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+
+	images, ok := readImageUpload(w, r, avatarSizes)
+	if !ok {
+		return
+	}
+	key, ok := storeImages(w, "avatars", user.ID, images)
+	if !ok {
+		return
+	}
+
+	//Updates also sets the key on user, so the old one is read first
+	previous := user.AvatarKey
+	db.Model(&user).Updates(map[string]interface{}{"avatar_key": key})
+	deleteImages(previous)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(imageURLs(key), w)
+	return
+}
+
+//DeleteAvatar removes the avatar of the logged in user
+func DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+
+	previous := user.AvatarKey
+	db.Model(&user).Updates(map[string]interface{}{"avatar_key": ""})
+	deleteImages(previous)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//UploadEventCover sets the cover image of an event, sent as the image
+//field of a multipart form. Only users that manage the event can set it
+func UploadEventCover(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	images, ok := readImageUpload(w, r, coverSizes)
+	if !ok {
+		return
+	}
+	key, ok := storeImages(w, "covers", event.ID, images)
+	if !ok {
+		return
+	}
+
+	//Updates also sets the key on event, so the old one is read first
+	previous := event.CoverKey
+	db.Model(&event).Updates(map[string]interface{}{"cover_key": key})
+	deleteImages(previous)
+	publishEventEdited(event.ID)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(imageURLs(key), w)
+	return
+}
+
+//DeleteEventCover removes the cover image of an event
+func DeleteEventCover(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	previous := event.CoverKey
+	db.Model(&event).Updates(map[string]interface{}{"cover_key": ""})
+	deleteImages(previous)
+	publishEventEdited(event.ID)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetImage hands out an image from the blob store. Keys are never reused,
+//so browsers can cache images for good
+func GetImage(w http.ResponseWriter, r *http.Request) {
+	//Gets key from /images/{key}
+	data, contentType, err := blobStore.Get(mux.Vars(r)["key"])
+	if err == ErrBlobNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	if err != nil {
+		log.Println("Could not load image:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+//FillImageURLs sets the cover urls of events and the avatar urls of their
+//creators and users
+func FillImageURLs(events []Event) {
+	for i := range events {
+		events[i].Cover = imageURLs(events[i].CoverKey)
+		events[i].Creator.Avatar = imageURLs(events[i].Creator.AvatarKey)
+		for _, user := range events[i].Users {
+			user.Avatar = imageURLs(user.AvatarKey)
+		}
+	}
+}
+
+// imageURLs returns the urls of the image stored under key, nil when
+// there is no image
+func imageURLs(key string) *ImageURLs {
+	if key == "" || blobStore == nil {
+		return nil
+	}
+	return &ImageURLs{blobStore.URL(key), blobStore.URL(thumbKey(key))}
+}
+
+// thumbKey is the key of the thumbnail of the image stored under key
+func thumbKey(key string) string {
+	dot := strings.LastIndex(key, ".")
+	return key[:dot] + "_thumb" + key[dot:]
+}
+
+// deleteImages removes an image and its thumbnail from the blob store
+func deleteImages(key string) {
+	if key == "" {
+		return
+	}
+	for _, key := range []string{key, thumbKey(key)} {
+		if err := blobStore.Delete(key); err != nil {
+			log.Println("Could not delete image", key, err)
+		}
+	}
+}
+
+// storeImages puts the image and its thumbnail into the blob store under
+// a new random key. Writes the error response when that fails
+func storeImages(w http.ResponseWriter, prefix string, id uint, images [2]encodedImage) (string, bool) {
+	random := make([]byte, 12)
+	rand.Read(random)
+	key := fmt.Sprintf("%s/%d/%s.%s", prefix, id, hex.EncodeToString(random), images[0].extension)
+
+	err := blobStore.Put(key, images[0].contentType, images[0].data)
+	if err == nil {
+		err = blobStore.Put(thumbKey(key), images[1].contentType, images[1].data)
+	}
+	if err != nil {
+		log.Println("Could not store image:", err)
+		deleteImages(key)
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{ Error string }{"Could not store the image"}, w)
+		return "", false
+	}
+	return key, true
+}
+
+// readImageUpload reads the image field of a multipart form and resizes
+// it to the sizes. The type is sniffed from the content, the name and type
+// the browser sent are ignored. Writes the error response when the upload
+// is not a usable image
+func readImageUpload(w http.ResponseWriter, r *http.Request, sizes [2]imageSize) (images [2]encodedImage, ok bool) {
+	//Leaves room for the rest of the multipart form
+	if r.ContentLength > maxImageSize+64<<10 {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		JSONResponse(struct{ Error string }{fmt.Sprintf("Images can be at most %d MB", maxImageSize>>20)}, w)
+		return images, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+64<<10)
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Send the image as the image field of a multipart form"}, w)
+		return images, false
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil || len(data) > maxImageSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		JSONResponse(struct{ Error string }{fmt.Sprintf("Images can be at most %d MB", maxImageSize>>20)}, w)
+		return images, false
+	}
+
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/gif" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		JSONResponse(struct{ Error string }{"Images must be JPEG, PNG or GIF"}, w)
+		return images, false
+	}
+
+	//The size is checked before decoding, so the pixels of huge images
+	//are never allocated
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Could not read the image"}, w)
+		return images, false
+	}
+	if config.Width*config.Height > maxImagePixels {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"The image has too many pixels"}, w)
+		return images, false
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Could not read the image"}, w)
+		return images, false
+	}
+
+	//Images are encoded again from their pixels, which leaves EXIF and
+	//other metadata behind. Photos are turned the way the camera recorded,
+	//since the orientation tag is lost with the metadata. The large image
+	//is resized straight from the decoded one and turned afterwards, so no
+	//full size copy is made, the thumbnail is resized from the large one
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	large := sizes[0]
+	//Orientations 5 to 8 swap width and height
+	if orientation >= 5 {
+		large.width, large.height = large.height, large.width
+	}
+	var resized [2]*image.RGBA
+	resized[0] = orientImage(resizeImage(decoded, large), orientation)
+	resized[1] = resizeImage(resized[0], sizes[1])
+
+	for i := range sizes {
+		var buf bytes.Buffer
+		if contentType == "image/jpeg" {
+			err = jpeg.Encode(&buf, resized[i], &jpeg.Options{Quality: 85})
+			images[i] = encodedImage{contentType: "image/jpeg", extension: "jpg"}
+		} else {
+			//PNG keeps the transparency of PNG and GIF images
+			err = png.Encode(&buf, resized[i])
+			images[i] = encodedImage{contentType: "image/png", extension: "png"}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			JSONResponse(struct{}{}, w)
+			return images, false
+		}
+		images[i].data = buf.Bytes()
+	}
+	return images, true
+}
+
+// resizeImage crops the image when the size asks for it and shrinks it to
+// fit the size. The source is read a row at a time, so only the resized
+// image is allocated
+func resizeImage(src image.Image, size imageSize) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if size.crop {
+		//Cuts the middle of the image with the aspect ratio of the size
+		cropWidth, cropHeight := width, width*size.height/size.width
+		if cropHeight > height {
+			cropWidth, cropHeight = height*size.width/size.height, height
+		}
+		if cropWidth < 1 {
+			cropWidth = 1
+		}
+		if cropHeight < 1 {
+			cropHeight = 1
+		}
+		x, y := bounds.Min.X+(width-cropWidth)/2, bounds.Min.Y+(height-cropHeight)/2
+		bounds = image.Rect(x, y, x+cropWidth, y+cropHeight)
+		width, height = cropWidth, cropHeight
+	}
+
+	newWidth, newHeight := width, height
+	if size.crop {
+		//The crop already has the aspect ratio, rounding it again could
+		//lose a row
+		if newWidth > size.width {
+			newWidth = size.width
+		}
+		if newHeight > size.height {
+			newHeight = size.height
+		}
+	} else if width > size.width || height > size.height {
+		newWidth, newHeight = size.width, height*size.width/width
+		if newHeight > size.height {
+			newWidth, newHeight = width*size.height/height, size.height
+		}
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+
+	//Every pixel of the smaller image is the average of the pixels it
+	//covers in the larger one. Source rows are converted to RGBA one at a
+	//time and added up
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	row := image.NewRGBA(image.Rect(0, 0, width, 1))
+	sums := make([]uint32, newWidth*4)
+	for y := 0; y < newHeight; y++ {
+		y0, y1 := y*height/newHeight, (y+1)*height/newHeight
+		for i := range sums {
+			sums[i] = 0
+		}
+		for sy := y0; sy < y1; sy++ {
+			draw.Draw(row, row.Bounds(), src, image.Pt(bounds.Min.X, bounds.Min.Y+sy), draw.Src)
+			for x := 0; x < newWidth; x++ {
+				x0, x1 := x*width/newWidth, (x+1)*width/newWidth
+				for offset := x0 * 4; offset < x1*4; offset += 4 {
+					for c := 0; c < 4; c++ {
+						sums[x*4+c] += uint32(row.Pix[offset+c])
+					}
+				}
+			}
+		}
+		for x := 0; x < newWidth; x++ {
+			x0, x1 := x*width/newWidth, (x+1)*width/newWidth
+			count := uint32((x1 - x0) * (y1 - y0))
+			offset := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[offset+c] = uint8(sums[x*4+c] / count)
+			}
+		}
+	}
+	return dst
+}
+
+// orientImage turns and mirrors the image as an EXIF orientation asks
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	newWidth, newHeight := width, height
+	//Orientations 5 to 8 swap width and height
+	if orientation >= 5 {
+		newWidth, newHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = width-1-x, y
+			case 3:
+				sx, sy = width-1-x, height-1-y
+			case 4:
+				sx, sy = x, height-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, height-1-x
+			case 7:
+				sx, sy = width-1-y, height-1-x
+			case 8:
+				sx, sy = width-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation finds the EXIF orientation of a JPEG file, 1 when it has
+// none
+func jpegOrientation(data []byte) int {
+	//Walks the segments before the image data, each is a 0xFF marker
+	//followed by its big endian length
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		if marker == 0xE1 {
+			if orientation := exifOrientation(data[i+4 : i+2+length]); orientation != 0 {
+				return orientation
+			}
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first directory of
+// an EXIF segment, 0 when it is missing
+func exifOrientation(segment []byte) int {
+	if len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := segment[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	directory := int(order.Uint32(tiff[4:]))
+	if directory < 8 || directory+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[directory:]))
+	for n := 0; n < entries; n++ {
+		entry := directory + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestResizeImage(t *testing.T) {
+	tests := []struct {
+		width, height int
+		size          imageSize
+		wantWidth     int
+		wantHeight    int
+	}{
+		{800, 400, imageSize{512, 512, true}, 400, 400},
+		{2000, 1000, imageSize{512, 512, true}, 512, 512},
+		{100, 50, imageSize{128, 128, true}, 50, 50},
+		{3000, 1000, imageSize{1600, 900, false}, 1600, 533},
+		{1000, 3000, imageSize{1600, 900, false}, 300, 900},
+		{300, 200, imageSize{1600, 900, false}, 300, 200},
+		{1000, 1000, imageSize{480, 270, true}, 480, 270},
+		{5000, 1, imageSize{480, 270, false}, 480, 1},
+	}
+
+	for _, test := range tests {
+		sources := []image.Image{
+			image.NewRGBA(image.Rect(0, 0, test.width, test.height)),
+			image.NewNRGBA(image.Rect(10, 10, 10+test.width, 10+test.height)),
+			image.NewYCbCr(image.Rect(0, 0, test.width, test.height), image.YCbCrSubsampleRatio420),
+		}
+		for _, src := range sources {
+			bounds := resizeImage(src, test.size).Bounds()
+			if bounds.Min != (image.Point{}) || bounds.Dx() != test.wantWidth || bounds.Dy() != test.wantHeight {
+				t.Errorf("%T %dx%d to %+v: got %v, want %dx%d", src, test.width, test.height, test.size,
+					bounds, test.wantWidth, test.wantHeight)
+			}
+		}
+	}
+}
+
+func TestResizeImageAverages(t *testing.T) {
+	//Left half black and right half white, cropped to the middle square
+	src := image.NewRGBA(image.Rect(0, 0, 8, 4))
+	for y := 0; y < 4; y++ {
+		for x := 4; x < 8; x++ {
+			src.Set(x, y, color.White)
+		}
+		for x := 0; x < 4; x++ {
+			src.Set(x, y, color.Black)
+		}
+	}
+
+	resized := resizeImage(src, imageSize{2, 2, true})
+	if got := resized.RGBAAt(0, 1); got != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("left pixel = %v, want black", got)
+	}
+	if got := resized.RGBAAt(1, 0); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("right pixel = %v, want white", got)
+	}
+	if got := resizeImage(src, imageSize{1, 1, false}).RGBAAt(0, 0); got != (color.RGBA{127, 127, 127, 255}) {
+		t.Errorf("averaged pixel = %v, want grey", got)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	//The marked top left pixel of a 3x2 image ends up where the orientation
+	//turns it to
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		marked      image.Point
+	}{
+		{0, 3, 2, image.Pt(0, 0)},
+		{1, 3, 2, image.Pt(0, 0)},
+		{2, 3, 2, image.Pt(2, 0)},
+		{3, 3, 2, image.Pt(2, 1)},
+		{4, 3, 2, image.Pt(0, 1)},
+		{5, 2, 3, image.Pt(0, 0)},
+		{6, 2, 3, image.Pt(1, 0)},
+		{7, 2, 3, image.Pt(1, 2)},
+		{8, 2, 3, image.Pt(0, 2)},
+		{9, 3, 2, image.Pt(0, 0)},
+	}
+
+	red := color.RGBA{255, 0, 0, 255}
+	for _, test := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		src.SetRGBA(0, 0, red)
+
+		oriented := orientImage(src, test.orientation)
+		if oriented.Bounds().Dx() != test.width || oriented.Bounds().Dy() != test.height {
+			t.Errorf("orientation %d: size %v, want %dx%d", test.orientation, oriented.Bounds(), test.width, test.height)
+			continue
+		}
+		for y := 0; y < test.height; y++ {
+			for x := 0; x < test.width; x++ {
+				if marked := oriented.RGBAAt(x, y) == red; marked != (image.Pt(x, y) == test.marked) {
+					t.Errorf("orientation %d: pixel %d,%d marked is %v", test.orientation, x, y, marked)
+				}
+			}
+		}
+	}
+}
+
+// exifSegment builds an APP1 EXIF segment with one directory entry
+func exifSegment(order binary.ByteOrder, tag uint16, value uint16) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], tag)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], value)
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	truncated := exifSegment(binary.BigEndian, 0x0112, 6)
+	badOffset := exifSegment(binary.BigEndian, 0x0112, 6)
+	binary.BigEndian.PutUint32(badOffset[10:], 1000)
+	badOrder := exifSegment(binary.BigEndian, 0x0112, 6)
+	copy(badOrder[6:], "XX")
+
+	tests := []struct {
+		name    string
+		segment []byte
+		want    int
+	}{
+		{"big endian", exifSegment(binary.BigEndian, 0x0112, 6), 6},
+		{"little endian", exifSegment(binary.LittleEndian, 0x0112, 3), 3},
+		{"normal", exifSegment(binary.BigEndian, 0x0112, 1), 1},
+		{"invalid value", exifSegment(binary.BigEndian, 0x0112, 9), 0},
+		{"other tag", exifSegment(binary.BigEndian, 0x010F, 6), 0},
+		{"not exif", append([]byte("XMP\x00\x00\x00"), exifSegment(binary.BigEndian, 0x0112, 6)[6:]...), 0},
+		{"truncated entry", truncated[:20], 0},
+		{"directory outside", badOffset, 0},
+		{"unknown byte order", badOrder, 0},
+		{"empty", nil, 0},
+	}
+
+	for _, test := range tests {
+		if got := exifOrientation(test.segment); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	segment := exifSegment(binary.LittleEndian, 0x0112, 8)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	tagged := append(append(append([]byte{}, plain[:2]...), append(app1, segment...)...), plain[2:]...)
+
+	if got := jpegOrientation(plain); got != 1 {
+		t.Errorf("without EXIF: got %d, want 1", got)
+	}
+	if got := jpegOrientation(tagged); got != 8 {
+		t.Errorf("with EXIF: got %d, want 8", got)
+	}
+	if got := jpegOrientation(tagged[:10]); got != 1 {
+		t.Errorf("truncated: got %d, want 1", got)
+	}
+}
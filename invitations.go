@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Visibility settings of an event
+const (
+	// Public events are listed to everyone
+	VisibilityPublic = "public"
+	// Unlisted events are not listed but anyone with the link can see and join them
+	VisibilityUnlisted = "unlisted"
+	// Private events can only be seen and joined by invited users
+	VisibilityPrivate = "private"
+	// Members events can only be seen and joined by members of their group
+	VisibilityMembers = "members"
+)
+
+// Statuses of an invitation
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+)
+
+//Invitation invites a user to an event. Users invited by an email that has
+//no account yet get InviteeID set when they register
+type Invitation struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	EventID   uint `gorm:"index"`
+	InviterID uint
+	InviteeID uint   `gorm:"index"`
+	Email     string `gorm:"size:50;index"`
+	Status    string `gorm:"size:20"`
+}
+
+//InviteLink is a shareable link that lets anyone holding it join an event
+type InviteLink struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	EventID   uint   `gorm:"index"`
+	CreatorID uint   `json:"-"`
+	Token     string `gorm:"size:64;unique_index"`
+	ExpiresAt *time.Time
+	// MaxUses of 0 allows unlimited uses
+	MaxUses int
+	Uses    int
+}
+
+// validVisibility checks the visibility setting of an event, empty means public
+func validVisibility(visibility string) bool {
+	switch visibility {
+	case "", VisibilityPublic, VisibilityUnlisted, VisibilityPrivate, VisibilityMembers:
+		return true
+	}
+	return false
+}
+
+// usable checks if the link has not expired or run out of uses
+func (link *InviteLink) usable() bool {
+	if link.ExpiresAt != nil && link.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	return link.MaxUses == 0 || link.Uses < link.MaxUses
+}
+
+//VisibleTo limits an event query to events the user is allowed to see.
+//A userID of 0 only sees public events, events hidden by moderators are
+//only seen by their creator
+func VisibleTo(userID interface{}) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if userID == nil || userID == uint(0) {
+			return tx.Where("visibility IS NULL OR visibility IN (?)", []string{"", VisibilityPublic}).
+				Where("hidden IS NULL OR hidden = ?", false)
+		}
+		return tx.Where("visibility IS NULL OR visibility IN (?) OR creator_id = ? "+
+			"OR id IN (SELECT event_id FROM events_joined WHERE user_id = ?) "+
+			"OR id IN (SELECT event_id FROM invitations WHERE invitee_id = ? AND status <> ?) "+
+			"OR (visibility = ? AND group_id IN (SELECT group_id FROM group_members WHERE user_id = ? AND status = ?))",
+			[]string{"", VisibilityPublic}, userID, userID, userID, InvitationDeclined,
+			VisibilityMembers, userID, GroupMemberActive).
+			Where("hidden IS NULL OR hidden = ? OR creator_id = ?", false, userID)
+	}
+}
+
+//CanViewEvent checks if a user may see an event that was opened directly,
+//either by its id or with an invite link token
+func CanViewEvent(event Event, userID uint, token string) bool {
+	if event.Hidden {
+		return CanManageEvent(event, userID)
+	}
+	if event.Visibility != VisibilityPrivate && event.Visibility != VisibilityMembers {
+		return true
+	}
+	if userID != 0 && (CanManageEvent(event, userID) || isParticipant(event.ID, userID) || isInvited(event.ID, userID)) {
+		return true
+	}
+	if event.Visibility == VisibilityMembers && IsGroupMember(event.GroupID, userID) {
+		return true
+	}
+
+	var link InviteLink
+	return token != "" && !db.First(&link, "token = ? AND event_id = ?", token, event.ID).RecordNotFound() && link.usable()
+}
+
+// isParticipant checks if a user has joined an event
+func isParticipant(eventID uint, userID uint) bool {
+	var count int
+	db.Table("events_joined").Where("event_id = ? AND user_id = ?", eventID, userID).Count(&count)
+	return count != 0
+}
+
+// isInvited checks if a user has an invitation to an event that was not declined
+func isInvited(eventID uint, userID uint) bool {
+	var count int
+	db.Model(&Invitation{}).Where("event_id = ? AND invitee_id = ? AND status <> ?", eventID, userID, InvitationDeclined).Count(&count)
+	return count != 0
+}
+
+//AuthorizeJoin checks if a user may join a private event. Joining accepts a
+//pending invitation, otherwise one use of the invite link is spent
+func AuthorizeJoin(event Event, user User, token string) bool {
+	if event.Visibility == VisibilityMembers && IsGroupMember(event.GroupID, user.ID) {
+		return true
+	}
+	if event.Visibility != VisibilityPrivate && event.Visibility != VisibilityMembers {
+		return true
+	}
+
+	var invitation Invitation
+	if !db.Where("event_id = ? AND invitee_id = ? AND status <> ?", event.ID, user.ID, InvitationDeclined).First(&invitation).RecordNotFound() {
+		db.Model(&invitation).Updates(Invitation{Status: InvitationAccepted})
+		return true
+	}
+
+	var link InviteLink
+	if token == "" || db.First(&link, "token = ? AND event_id = ?", token, event.ID).RecordNotFound() || !link.usable() {
+		return false
+	}
+
+	// Only counts the use if the link still had one left
+	result := db.Model(&InviteLink{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", link.ID).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	return result.RowsAffected == 1
+}
+
+//LinkInvitationsToUser assigns invitations sent to an email before the
+//account existed to the newly registered user
+func LinkInvitationsToUser(user User) {
+	db.Model(&Invitation{}).
+		Where("email = ? AND invitee_id = 0", strings.ToLower(user.Email)).
+		Updates(Invitation{InviteeID: user.ID})
+}
+
+//GetEvent returns a single event. Private events are only returned to
+//invited users and to holders of an invite link given as ?invite=token
+func GetEvent(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	//Gets id from /events/{id}
+	params := mux.Vars(r)
+	eventID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var event Event
+	if db.Preload("Users").Preload("Creator").Preload("Teams", orderTeams).Preload("Teams.Members").
+		First(&event, eventID).RecordNotFound() ||
+		!CanViewEvent(event, userID, r.URL.Query().Get("invite")) ||
+		(event.Status == EventStatusDraft && !CanManageEvent(event, userID)) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	events := []Event{event}
+	FillImageURLs(events)
+	FillFriendsGoing(events, userID)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(events[0], w)
+	return
+}
+
+//InviteToEvent invites users by id or email to an event of the logged in user
+func InviteToEvent(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		UserIDs []uint
+		Emails  []string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	var invitees []User
+	if len(requestData.UserIDs) != 0 {
+		db.Where("id IN (?)", requestData.UserIDs).Find(&invitees)
+	}
+
+	var invitations []Invitation
+	for _, email := range requestData.Emails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if !emailRegex.MatchString(email) {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{"Bad email format: " + email}, w)
+			return
+		}
+
+		//Emails of existing accounts are invited as those users
+		var user User
+		if !db.First(&user, "email = ?", email).RecordNotFound() {
+			invitees = append(invitees, user)
+			continue
+		}
+		invitations = append(invitations, Invitation{EventID: event.ID, InviterID: event.CreatorID, Email: email})
+	}
+	for _, user := range invitees {
+		if user.ID == event.CreatorID {
+			continue
+		}
+		invitations = append(invitations, Invitation{EventID: event.ID, InviterID: event.CreatorID, InviteeID: user.ID, Email: strings.ToLower(user.Email)})
+	}
+
+	var created []Invitation
+	for _, invitation := range invitations {
+		//Users that were already invited are not invited twice
+		var existing Invitation
+		if !db.Where("event_id = ? AND email = ?", event.ID, invitation.Email).First(&existing).RecordNotFound() {
+			continue
+		}
+
+		invitation.Status = InvitationPending
+		db.Create(&invitation)
+		created = append(created, invitation)
+		if invitation.InviteeID != 0 {
+			NotifyUsers([]uint{invitation.InviteeID}, NotificationEventInvitation, event.ID,
+				fmt.Sprintf("%s invited you to %s", event.CreatorName, eventSummary(event)))
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(created, w)
+	return
+}
+
+//GetEventInvitations lists the invitations of an event to its creator
+func GetEventInvitations(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	var invitations []Invitation
+	db.Where("event_id = ?", event.ID).Find(&invitations)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(invitations, w)
+	return
+}
+
+//GetAccountInvitations lists the pending invitations of the logged in user
+func GetAccountInvitations(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var pending []Invitation
+	db.Where("invitee_id = ? AND status = ?", session.Values["userID"], InvitationPending).Find(&pending)
+
+	//Returns every invitation together with the event it is for
+	invitations := make([]accountInvitation, 0, len(pending))
+	for _, invitation := range pending {
+		var event Event
+		db.Preload("Creator").First(&event, invitation.EventID)
+		invitations = append(invitations, accountInvitation{invitation, event})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(invitations, w)
+	return
+}
+
+// accountInvitation is an invitation of the logged in user with its event
+type accountInvitation struct {
+	Invitation
+	Event Event
+}
+
+//AcceptInvitation accepts an invitation and joins its event
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	answerInvitation(w, r, InvitationAccepted)
+}
+
+//DeclineInvitation declines an invitation
+func DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	answerInvitation(w, r, InvitationDeclined)
+}
+
+// answerInvitation handles accepting and declining an invitation of the logged in user
+func answerInvitation(w http.ResponseWriter, r *http.Request, status string) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets id from /invitations/{id}/...
+	params := mux.Vars(r)
+	invitationID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var invitation Invitation
+	if db.First(&invitation, "id = ? AND invitee_id = ?", invitationID, session.Values["userID"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if status == InvitationAccepted {
+		var user User
+		db.First(&user, invitation.InviteeID)
+		var event Event
+		db.First(&event, invitation.EventID)
+
+		if err = JoinableBy(event, user); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		}
+		if !isParticipant(event.ID, user.ID) {
+			AddParticipant(&event, &user)
+		}
+	}
+
+	db.Model(&invitation).Updates(Invitation{Status: status})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//CreateInviteLink creates a shareable invite link for an event of the
+//logged in user. ExpiresAt and MaxUses are optional
+func CreateInviteLink(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		ExpiresAt *time.Time
+		MaxUses   int
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	if requestData.MaxUses < 0 || (requestData.ExpiresAt != nil && requestData.ExpiresAt.Before(time.Now())) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	link := InviteLink{
+		EventID:   event.ID,
+		CreatorID: event.CreatorID,
+		Token:     GenerateCalendarToken(),
+		ExpiresAt: requestData.ExpiresAt,
+		MaxUses:   requestData.MaxUses,
+	}
+	if db.Create(&link).Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(struct {
+		InviteLink
+		URL string
+	}{link, fmt.Sprint("/events/", event.ID, "?invite=", link.Token)}, w)
+	return
+}
+
+//DeleteInviteLink revokes an invite link of an event of the logged in user
+func DeleteInviteLink(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	if db.Where("event_id = ? AND token = ?", event.ID, mux.Vars(r)["token"]).Delete(InviteLink{}).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+// loadCreatorEvent loads the event from /events/{id}/... and checks that the
+// logged in user created it. Writes the error response when it fails
+func loadCreatorEvent(w http.ResponseWriter, r *http.Request) (event Event, ok bool) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	params := mux.Vars(r)
+	eventID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	if db.First(&event, eventID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	if !CanManageEvent(event, session.Values["userID"].(uint)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	return event, true
+}
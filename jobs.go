@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Statuses of a job run
+const (
+	JobRunRunning   = "running"
+	JobRunSucceeded = "succeeded"
+	JobRunFailed    = "failed"
+)
+
+// What started a job run
+const (
+	JobTriggerSchedule = "schedule"
+	JobTriggerRetry    = "retry"
+	JobTriggerManual   = "manual"
+)
+
+// Timings of the job scheduler
+const (
+	jobPollInterval = 15 * time.Second
+	// defaultJobTimeout is how long a lease lasts when a job does not set
+	// its own, running jobs keep extending it
+	defaultJobTimeout = 10 * time.Minute
+	jobMaxRetries     = 3
+	jobRetryBackoff   = 30 * time.Second
+	// jobRunRetention is how long the run history is kept
+	jobRunRetention = 30 * 24 * time.Hour
+)
+
+//Job is a periodic task. The row is shared by every server instance, the
+//instance that takes the lease runs the job
+type Job struct {
+	ID          uint      `gorm:"primary_key"`
+	Name        string    `gorm:"size:50;unique_index"`
+	Schedule    string    `gorm:"size:100"`
+	NextRunAt   time.Time `gorm:"index"`
+	LockedBy    string    `gorm:"size:100"`
+	LockedUntil *time.Time
+	LastRunAt   *time.Time
+	LastStatus  string `gorm:"size:20"`
+	// Failures counts the failed runs since the last successful one
+	Failures int
+}
+
+//JobRun is an entry in the run history of a job
+type JobRun struct {
+	ID         uint   `gorm:"primary_key"`
+	JobName    string `gorm:"size:50;index"`
+	Trigger    string `gorm:"size:20"`
+	Attempt    int
+	Instance   string `gorm:"size:100"`
+	Status     string `gorm:"size:20"`
+	Error      string `gorm:"size:1000"`
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+//JobFunc is the work of a job, returned errors are retried with backoff
+type JobFunc func() error
+
+// registeredJob is a job known to this instance
+type registeredJob struct {
+	name     string
+	schedule CronSchedule
+	spec     string
+	timeout  time.Duration
+	run      JobFunc
+}
+
+// jobRegistry holds the jobs registered with RegisterJob
+var jobRegistry = map[string]*registeredJob{}
+
+// jobInstance identifies this server instance in job leases
+var jobInstance = newJobInstance()
+
+// newJobInstance names the instance after its host and process
+func newJobInstance() string {
+	host, _ := os.Hostname()
+	random := make([]byte, 4)
+	rand.Read(random)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(random))
+}
+
+//RegisterJob adds a job that runs on a cron schedule. Panics on an invalid
+//schedule as jobs are registered at startup
+func RegisterJob(name string, spec string, timeout time.Duration, run JobFunc) {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		panic(err)
+	}
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+	jobRegistry[name] = &registeredJob{name, schedule, spec, timeout, run}
+}
+
+//RegisterJobs registers the background jobs of the server
+func RegisterJobs() {
+	RegisterJob("update_event_statuses", "* * * * *", 0, func() error {
+		return UpdateEventStatuses(time.Now())
+	})
+	RegisterJob("send_reminders", "* * * * *", 0, func() error {
+		return SendDueReminders(time.Now())
+	})
+	RegisterJob("mark_no_shows", "*/15 * * * *", 0, func() error {
+		return MarkNoShows(time.Now())
+	})
+	RegisterJob("materialize_series", "*/15 * * * *", 0, MaterializeAllSeries)
+	RegisterJob("update_user_stats", "*/5 * * * *", 0, UpdateUserStats)
+	RegisterJob("purge_expired_events", "30 3 * * *", time.Hour, func() error {
+		return PurgeExpiredEvents(eventRetention)
+	})
+	RegisterJob("session_cleanup", "*/5 * * * *", 0, func() error {
+		sessionStore.Cleanup()
+		return nil
+	})
+	RegisterJob("job_run_cleanup", "0 4 * * *", 0, func() error {
+		return db.Where("started_at < ?", time.Now().Add(-jobRunRetention)).Delete(JobRun{}).Error
+	})
+}
+
+//SyncJobs stores the registered jobs in the database and updates the next
+//run of jobs whose schedule changed
+func SyncJobs() {
+	now := time.Now()
+	for _, registered := range jobRegistry {
+		var job Job
+		if db.Where("name = ?", registered.name).First(&job).RecordNotFound() {
+			db.Create(&Job{Name: registered.name, Schedule: registered.spec, NextRunAt: registered.schedule.Next(now)})
+			continue
+		}
+		if job.Schedule != registered.spec {
+			db.Model(&job).Updates(map[string]interface{}{
+				"schedule":    registered.spec,
+				"next_run_at": registered.schedule.Next(now),
+			})
+		}
+	}
+}
+
+//RunJobScheduler starts jobs whose next run has come, forever
+func RunJobScheduler() {
+	SyncJobs()
+	for {
+		RunDueJobs(time.Now())
+		time.Sleep(jobPollInterval)
+	}
+}
+
+//RunDueJobs starts every due job this instance gets the lease of
+func RunDueJobs(now time.Time) {
+	var jobs []Job
+	db.Where("next_run_at <= ?", now).Find(&jobs)
+
+	for _, job := range jobs {
+		registered := jobRegistry[job.Name]
+		if registered == nil {
+			continue
+		}
+
+		trigger := JobTriggerSchedule
+		if job.Failures != 0 {
+			trigger = JobTriggerRetry
+		}
+		if acquireJobLease(registered, now, true) {
+			go runJob(registered, trigger)
+		}
+	}
+}
+
+// acquireJobLease takes the lease of the job unless another run holds it.
+// The conditional update makes sure only one instance gets it
+func acquireJobLease(registered *registeredJob, now time.Time, dueOnly bool) bool {
+	tx := db.Model(&Job{}).Where("name = ? AND (locked_until IS NULL OR locked_until < ?)", registered.name, now)
+	if dueOnly {
+		tx = tx.Where("next_run_at <= ?", now)
+	}
+	return tx.Updates(map[string]interface{}{
+		"locked_by":    jobInstance,
+		"locked_until": now.Add(registered.timeout),
+	}).RowsAffected == 1
+}
+
+// runJob runs a job holding its lease, records the run and schedules the
+// next one. Failed runs are retried with exponential backoff
+func runJob(registered *registeredJob, trigger string) {
+	var job Job
+	db.Where("name = ?", registered.name).First(&job)
+
+	run := JobRun{
+		JobName:   registered.name,
+		Trigger:   trigger,
+		Attempt:   job.Failures + 1,
+		Instance:  jobInstance,
+		Status:    JobRunRunning,
+		StartedAt: time.Now(),
+	}
+	db.Create(&run)
+
+	//Keeps the lease while the job runs longer than its timeout
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(registered.timeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				db.Model(&Job{}).Where("name = ? AND locked_by = ?", registered.name, jobInstance).
+					Updates(map[string]interface{}{"locked_until": time.Now().Add(registered.timeout)})
+			}
+		}
+	}()
+	err := safeRunJob(registered.run)
+	close(done)
+
+	finished := time.Now()
+	updates := map[string]interface{}{
+		"locked_by":    "",
+		"locked_until": nil,
+		"last_run_at":  finished,
+	}
+	runUpdates := map[string]interface{}{"finished_at": finished}
+
+	if err == nil {
+		updates["last_status"] = JobRunSucceeded
+		updates["failures"] = 0
+		updates["next_run_at"] = registered.schedule.Next(finished)
+		runUpdates["status"] = JobRunSucceeded
+	} else {
+		log.Printf("Job %s failed: %v", registered.name, err)
+		updates["last_status"] = JobRunFailed
+		runUpdates["status"] = JobRunFailed
+		runUpdates["error"] = truncate(err.Error(), 1000)
+
+		//Retries sooner than the schedule until the retries run out
+		next := registered.schedule.Next(finished)
+		if job.Failures < jobMaxRetries {
+			retry := finished.Add(jobRetryBackoff << uint(job.Failures))
+			if retry.Before(next) {
+				next = retry
+			}
+			updates["failures"] = job.Failures + 1
+		} else {
+			updates["failures"] = 0
+		}
+		updates["next_run_at"] = next
+	}
+
+	db.Model(&run).Updates(runUpdates)
+	db.Model(&Job{}).Where("name = ? AND locked_by = ?", registered.name, jobInstance).Updates(updates)
+}
+
+// safeRunJob turns a panic of the job into an error
+func safeRunJob(run JobFunc) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = errors.Errorf("panic: %v\n%s", recovered, debug.Stack())
+		}
+	}()
+	return run()
+}
+
+//GetJobs lists the background jobs and their state. Admins only
+func GetJobs(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var jobs []Job
+	db.Find(&jobs)
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(jobs, w)
+	return
+}
+
+//RunJobNow starts a job right away, unless it is already running. Admins only
+func RunJobNow(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	//Gets name from /admin/jobs/{name}/run
+	registered := jobRegistry[mux.Vars(r)["name"]]
+	if registered == nil {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if !acquireJobLease(registered, time.Now(), false) {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Job is already running"}, w)
+		return
+	}
+	go runJob(registered, JobTriggerManual)
+
+	w.WriteHeader(http.StatusAccepted)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetJobRuns returns the run history of a job, newest first. Admins only
+func GetJobRuns(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if jobRegistry[name] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	// Gets pagination keys from url. e.x ?page=2&limit=20
+	page, limit := pagination(r, 20, 100)
+
+	runs := []JobRun{}
+	db.Where("job_name = ?", name).Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&runs)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(runs, w)
+	return
+}
+
+// requireAdmin writes 401 or 403 and returns false unless an admin is logged in
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return false
+	}
+
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+	if !user.IsAdmin() {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// eventTransitions lists the statuses an event can move to from each status.
+// Cancelled and finished events can not change anymore
+var eventTransitions = map[string][]string{
+	EventStatusDraft:     {EventStatusPublished, EventStatusCancelled},
+	EventStatusPublished: {EventStatusPostponed, EventStatusCancelled, EventStatusOngoing, EventStatusFinished},
+	EventStatusPostponed: {EventStatusPublished, EventStatusCancelled},
+	EventStatusOngoing:   {EventStatusFinished, EventStatusCancelled},
+}
+
+//ErrInvalidTransition is returned when an event can not move to the requested status
+var ErrInvalidTransition = errors.New("Invalid event status transition")
+
+//CanTransition checks if an event in status from can move to status to
+func CanTransition(from string, to string) bool {
+	for _, status := range eventTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+//TransitionEvent moves the event to a new status and stores the reason
+func TransitionEvent(event *Event, status string, reason string) error {
+	if !CanTransition(event.Status, status) {
+		return errors.Wrapf(ErrInvalidTransition, "can not change a %s event to %s", event.Status, status)
+	}
+
+	event.Status = status
+	event.StatusReason = reason
+	return db.Model(event).Updates(map[string]interface{}{
+		"status":        status,
+		"status_reason": reason,
+		"sequence":      event.Sequence + 1,
+	}).Error
+}
+
+//PublishEvent publishes a draft or reschedules a postponed event.
+//Postponed events can be given new start and end times
+func PublishEvent(w http.ResponseWriter, r *http.Request) {
+	changeEventStatus(w, r, EventStatusPublished)
+}
+
+//CancelEvent cancels an event with a reason and tells everyone on it
+func CancelEvent(w http.ResponseWriter, r *http.Request) {
+	changeEventStatus(w, r, EventStatusCancelled)
+}
+
+//PostponeEvent postpones an event until it is published again with new times
+func PostponeEvent(w http.ResponseWriter, r *http.Request) {
+	changeEventStatus(w, r, EventStatusPostponed)
+}
+
+// validEventTimes checks that an event starts in the future and ends after
+// it starts
+func validEventTimes(startTime time.Time, endTime time.Time) error {
+	if !startTime.After(time.Now()) {
+		return errors.New("Event can not start in the past")
+	}
+	if !endTime.After(startTime) {
+		return errors.New("Event must end after it starts")
+	}
+	return nil
+}
+
+// changeEventStatus handles the status change endpoints, used by the
+// creator, co-organizers and group organizers of the event
+func changeEventStatus(w http.ResponseWriter, r *http.Request, status string) {
+	//Loads creator id from authentication token
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	//Gets id from /events/{id}/...
+	params := mux.Vars(r)
+	eventID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var event Event
+	if db.Preload("Creator").First(&event, eventID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//checks if the user that is trying to change the event manages it
+	if !CanManageEvent(event, userID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		Reason    string
+		StartTime time.Time
+		EndTime   time.Time
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	//A postponed event gets its new times when it is published again
+	startTime, endTime := event.StartTime, event.EndTime
+	if requestData.StartTime.Year() != 1 {
+		startTime = requestData.StartTime
+	}
+	if requestData.EndTime.Year() != 1 {
+		endTime = requestData.EndTime
+	}
+	rescheduled := event.Status == EventStatusPostponed && status == EventStatusPublished
+	if rescheduled {
+		if err = validEventTimes(startTime, endTime); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		}
+	}
+	//Drafts are published with the times they were given when edited
+	if event.Status == EventStatusDraft && status == EventStatusPublished {
+		if err = validEventTimes(event.StartTime, event.EndTime); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		}
+	}
+
+	previousStatus := event.Status
+	if err = TransitionEvent(&event, status, requestData.Reason); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{err.Error()}, w)
+		return
+	}
+
+	if rescheduled {
+		event.StartTime, event.EndTime = startTime, endTime
+		db.Model(&event).Updates(Event{StartTime: event.StartTime, EndTime: event.EndTime})
+	}
+
+	PublishEventUpdate(event, UpdateEventEdited, event)
+
+	switch {
+	case status == EventStatusCancelled:
+		NotifyEventUsers(event, userID, NotificationEventCancelled,
+			fmt.Sprintf("%s has been cancelled: %s", eventSummary(event), requestData.Reason))
+	case status == EventStatusPostponed:
+		NotifyEventUsers(event, userID, NotificationEventPostponed,
+			fmt.Sprintf("%s has been postponed: %s", eventSummary(event), requestData.Reason))
+	case previousStatus == EventStatusPostponed:
+		NotifyEventUsers(event, userID, NotificationEventRescheduled,
+			fmt.Sprintf("%s has been rescheduled to %s", eventSummary(event), event.StartTime.UTC().Format(time.RFC1123)))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(event, w)
+	return
+}
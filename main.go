@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -21,14 +22,28 @@ var db *gorm.DB
 var sessionStore *gormstore.Store
 var passwordRegex *regexp.Regexp
 var emailRegex *regexp.Regexp
+var eventRetention time.Duration
+var pubsub PubSub
+var reminderOffsets []time.Duration
+var reminderChannels []ReminderChannel
+var checkInKey []byte
+var feedCache FeedCache
+var contentFilter *ContentFilter
+var blobStore BlobStore
 
 // ------------------------------------------------------------
 type envData struct {
-	dbUsername string
-	dbPassword string
-	secret     []byte
+	dbUsername      string
+	dbPassword      string
+	secret          []byte
+	eventRetention  time.Duration
+	reminderOffsets []time.Duration
 }
 
+// defaultEventRetention is how long finished events are kept when
+// EVENT_RETENTION_DAYS is not set
+const defaultEventRetention = 2 * 365 * 24 * time.Hour
+
 //JSONResponse sends a json response to user based on message
 func JSONResponse(response interface{}, w http.ResponseWriter) {
 
@@ -52,7 +67,28 @@ func GetEnvironmentVariables() (env envData, err error) {
 		return env, errors.New("Missing credentials, please check if the envriorement variables are set")
 	}
 
-	env = envData{dbUsername, dbPassword, []byte(cookieSecret)}
+	//Finished events older than the retention period are purged,
+	//0 keeps them forever
+	retention := defaultEventRetention
+	if retentionDays := os.Getenv("EVENT_RETENTION_DAYS"); retentionDays != "" {
+		days, err := strconv.Atoi(retentionDays)
+		if err != nil || days < 0 {
+			return env, errors.New("EVENT_RETENTION_DAYS must be a non negative number of days")
+		}
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+
+	//Reminders are sent this long before events start, e.g. 24h,1h
+	offsets := os.Getenv("REMINDER_OFFSETS")
+	if offsets == "" {
+		offsets = defaultReminderOffsets
+	}
+	reminders, err := ParseReminderOffsets(offsets)
+	if err != nil {
+		return env, errors.Wrap(err, "REMINDER_OFFSETS")
+	}
+
+	env = envData{dbUsername, dbPassword, []byte(cookieSecret), retention, reminders}
 
 	return env, nil
 }
@@ -86,13 +122,143 @@ func main() {
 	if !db.HasTable(&Event{}) {
 		db.CreateTable(&Event{})
 	}
+	if !db.HasTable(&EventSeries{}) {
+		db.CreateTable(&EventSeries{})
+	}
+	if !db.HasTable(&Notification{}) {
+		db.CreateTable(&Notification{})
+	}
+	if !db.HasTable(&NotificationPreference{}) {
+		db.CreateTable(&NotificationPreference{})
+	}
+	if !db.HasTable(&ReminderDelivery{}) {
+		db.CreateTable(&ReminderDelivery{})
+	}
+	if !db.HasTable(&PushSubscription{}) {
+		db.CreateTable(&PushSubscription{})
+	}
+	if !db.HasTable(&EventRating{}) {
+		db.CreateTable(&EventRating{})
+	}
+	if !db.HasTable(&ParticipantRating{}) {
+		db.CreateTable(&ParticipantRating{})
+	}
+	if !db.HasTable(&Job{}) {
+		db.CreateTable(&Job{})
+	}
+	if !db.HasTable(&JobRun{}) {
+		db.CreateTable(&JobRun{})
+	}
+	if !db.HasTable(&Invitation{}) {
+		db.CreateTable(&Invitation{})
+	}
+	if !db.HasTable(&InviteLink{}) {
+		db.CreateTable(&InviteLink{})
+	}
+	if !db.HasTable(&Comment{}) {
+		db.CreateTable(&Comment{})
+	}
+	if !db.HasTable(&CommentRevision{}) {
+		db.CreateTable(&CommentRevision{})
+	}
+	if !db.HasTable(&Team{}) {
+		db.CreateTable(&Team{})
+	}
+	if !db.HasTable(&Sport{}) {
+		db.CreateTable(&Sport{})
+	}
+	if !db.HasTable(&UserSport{}) {
+		db.CreateTable(&UserSport{})
+	}
+	if !db.HasTable(&Friendship{}) {
+		db.CreateTable(&Friendship{})
+	}
+	if !db.HasTable(&Follow{}) {
+		db.CreateTable(&Follow{})
+	}
+	if !db.HasTable(&Block{}) {
+		db.CreateTable(&Block{})
+	}
+	if !db.HasTable(&Group{}) {
+		db.CreateTable(&Group{})
+	}
+	if !db.HasTable(&GroupMember{}) {
+		db.CreateTable(&GroupMember{})
+	}
+	if !db.HasTable(&EventOrganizer{}) {
+		db.CreateTable(&EventOrganizer{})
+	}
+	if !db.HasTable(&AuditLog{}) {
+		db.CreateTable(&AuditLog{})
+	}
+	if !db.HasTable(&JoinRequest{}) {
+		db.CreateTable(&JoinRequest{})
+	}
+	if !db.HasTable(&EventBan{}) {
+		db.CreateTable(&EventBan{})
+	}
+	if !db.HasTable(&WaitlistEntry{}) {
+		db.CreateTable(&WaitlistEntry{})
+	}
+	if !db.HasTable(&Conversation{}) {
+		db.CreateTable(&Conversation{})
+	}
+	if !db.HasTable(&ConversationMember{}) {
+		db.CreateTable(&ConversationMember{})
+	}
+	if !db.HasTable(&Message{}) {
+		db.CreateTable(&Message{})
+	}
+	if !db.HasTable(&Report{}) {
+		db.CreateTable(&Report{})
+	}
+	if !db.HasTable(&ModerationAction{}) {
+		db.CreateTable(&ModerationAction{})
+	}
+	if !db.HasTable(&Appeal{}) {
+		db.CreateTable(&Appeal{})
+	}
+	if !db.HasTable(&UserStats{}) {
+		db.CreateTable(&UserStats{})
+	}
+	if !db.HasTable(&UserSportStats{}) {
+		db.CreateTable(&UserSportStats{})
+	}
+	if !db.HasTable(&UserBadge{}) {
+		db.CreateTable(&UserBadge{})
+	}
+	//Adds columns introduced after the tables were first created
+	db.AutoMigrate(&User{}, &Event{}, &EventSeries{}, &Notification{}, &EventParticipant{})
+	SeedSports()
 
-	//Creates a table in the database for storing sessions
-	//and sets a cleanup time
+	//Creates a table in the database for storing sessions,
+	//expired sessions are cleaned up by the session_cleanup job
 	sessionStore = gormstore.New(db, []byte(envData.secret))
-	quit := make(chan struct{})
-	go sessionStore.PeriodicCleanup(time.Minute, quit)
-	go DeletePassedEvents()
+	//Check-in codes are signed with a key derived from the cookie secret
+	checkInKey = DeriveKey(envData.secret, "check-in")
+	eventRetention = envData.eventRetention
+	//Real-time updates are only shared inside this instance, use
+	//NewBrokerPubSub to fan them out across several instances
+	pubsub = NewLocalPubSub()
+	reminderOffsets = envData.reminderOffsets
+	reminderChannels = ReminderChannelsFromEnv()
+	//Feeds are cached per instance, a shared FeedCache lets instances
+	//reuse each others feeds
+	feedCache = NewMemoryFeedCache()
+	//Text users write is checked for profanity, contact details and spam
+	contentFilter = ContentFilterFromEnv()
+	//Avatars and event covers are kept on disk unless an S3 bucket is
+	//configured
+	blobStore, err = BlobStoreFromEnv()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	//Event archiving, reminders and cleanups run as jobs, only one
+	//instance runs each of them at a time
+	RegisterJobs()
+	go RunJobScheduler()
 
 	//Handles the requests and redirects them to functions
 	HandleFunctions()
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Messaging rules
+const (
+	// maxConversationMembers bounds group conversations, including the
+	// user that starts them
+	maxConversationMembers = 10
+	maxMessageLength       = 2000
+	maxConversationTitle   = 100
+)
+
+// Types of real-time message updates
+const (
+	MessageUpdateMessage = "message"
+	MessageUpdateRead    = "read"
+)
+
+//Conversation is a private conversation between two or a few users
+type Conversation struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	Title         string `gorm:"size:100"`
+	CreatorID     uint
+	LastMessageAt *time.Time           `gorm:"index"`
+	Members       []ConversationMember `gorm:"foreignkey:ConversationID"`
+	// LastMessage and Unread are filled for the logged in user
+	LastMessage *Message `json:",omitempty" gorm:"-"`
+	Unread      int      `gorm:"-"`
+}
+
+//ConversationMember is a user taking part in a conversation. LastReadID is
+//the last message they read, which other members see as a read receipt
+type ConversationMember struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	ConversationID uint  `gorm:"unique_index:idx_conversation_member"`
+	UserID         uint  `gorm:"unique_index:idx_conversation_member;index"`
+	User           *User `json:",omitempty" gorm:"foreignkey:UserID"`
+	LastReadID     uint
+	LastReadAt     *time.Time
+}
+
+//Message is a message sent in a conversation
+type Message struct {
+	ID             uint `gorm:"primary_key"`
+	CreatedAt      time.Time
+	ConversationID uint `gorm:"index"`
+	SenderID       uint
+	Body           string `gorm:"size:2000"`
+}
+
+//MessageUpdate is pushed to the notification streams of the members of a
+//conversation when a message is sent or read
+type MessageUpdate struct {
+	Type           string
+	ConversationID uint
+	Message        *Message `json:",omitempty"`
+	// UserID and LastReadID tell which member read up to which message
+	UserID     uint `json:",omitempty"`
+	LastReadID uint `json:",omitempty"`
+}
+
+//CreateConversation starts a conversation with other users.
+//e.x {"UserIDs": [2, 3], "Title": "Sunday football"}. Starting a
+//conversation with a single user returns the one they already have
+func CreateConversation(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	requestData := struct {
+		UserIDs []uint
+		Title   string
+	}{}
+	if json.NewDecoder(r.Body).Decode(&requestData) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Members are unique and do not include the user starting it
+	memberIDs := []uint{}
+	seen := map[uint]bool{userID: true}
+	for _, id := range requestData.UserIDs {
+		if !seen[id] {
+			seen[id] = true
+			memberIDs = append(memberIDs, id)
+		}
+	}
+	if len(memberIDs) == 0 || len(memberIDs)+1 > maxConversationMembers || len(requestData.Title) > maxConversationTitle {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{fmt.Sprintf("Conversations have 2 to %d members", maxConversationMembers)}, w)
+		return
+	}
+	if len(usersByID(memberIDs)) != len(memberIDs) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	for _, id := range memberIDs {
+		if IsBlocked(userID, id) {
+			w.WriteHeader(http.StatusForbidden)
+			JSONResponse(struct{ Error string }{"User is blocked"}, w)
+			return
+		}
+	}
+
+	//Two users only ever have one conversation without a title
+	if len(memberIDs) == 1 && requestData.Title == "" {
+		if conversation, ok := directConversation(userID, memberIDs[0]); ok {
+			w.WriteHeader(http.StatusOK)
+			JSONResponse(conversation, w)
+			return
+		}
+	}
+
+	conversation := Conversation{Title: strings.TrimSpace(requestData.Title), CreatorID: userID}
+	tx := db.Begin()
+	if tx.Create(&conversation).Error != nil {
+		tx.Rollback()
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	for _, id := range append([]uint{userID}, memberIDs...) {
+		tx.Create(&ConversationMember{ConversationID: conversation.ID, UserID: id})
+	}
+	tx.Commit()
+
+	db.Preload("Members.User").First(&conversation, conversation.ID)
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(conversation, w)
+	return
+}
+
+//GetConversations lists the conversations of the logged in user with
+//their last message and unread count, most recent first.
+//e.x ?page=2&limit=20
+func GetConversations(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	page, limit := pagination(r, 20, 100)
+
+	conversations := []Conversation{}
+	db.Preload("Members.User").
+		Where("id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?)", userID).
+		Order("last_message_at DESC, id DESC").Offset((page - 1) * limit).Limit(limit).Find(&conversations)
+
+	blocked := BlockedIDs(userID)
+	for i := range conversations {
+		fillConversation(&conversations[i], userID, blocked)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(conversations, w)
+	return
+}
+
+//GetConversation returns a conversation of the logged in user with the
+//read receipts of its members
+func GetConversation(w http.ResponseWriter, r *http.Request) {
+	conversation, userID, ok := loadConversation(w, r)
+	if !ok {
+		return
+	}
+
+	db.Preload("Members.User").First(&conversation, conversation.ID)
+	fillConversation(&conversation, userID, BlockedIDs(userID))
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(conversation, w)
+	return
+}
+
+//GetUnreadMessages counts the unread messages of the logged in user
+func GetUnreadMessages(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	var members []ConversationMember
+	db.Where("user_id = ?", userID).Find(&members)
+
+	blocked := BlockedIDs(userID)
+	unread, conversations := 0, 0
+	for _, member := range members {
+		if count := unreadMessages(member, blocked); count != 0 {
+			unread += count
+			conversations++
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Unread        int
+		Conversations int
+	}{unread, conversations}, w)
+	return
+}
+
+//GetMessages returns the messages of a conversation, newest first. Older
+//pages continue before the oldest message of the previous one.
+//e.x ?before=120&limit=50
+func GetMessages(w http.ResponseWriter, r *http.Request) {
+	conversation, userID, ok := loadConversation(w, r)
+	if !ok {
+		return
+	}
+
+	_, limit := pagination(r, 50, 100)
+
+	tx := db.Where("conversation_id = ?", conversation.ID)
+	if before := r.URL.Query().Get("before"); before != "" {
+		beforeID, err := strconv.Atoi(before)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		tx = tx.Where("id < ?", beforeID)
+	}
+	//Messages of blocked users are hidden
+	if blocked := BlockedIDs(userID); len(blocked) != 0 {
+		tx = tx.Where("sender_id NOT IN (?)", blocked)
+	}
+
+	messages := []Message{}
+	tx.Order("id DESC").Limit(limit).Find(&messages)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(messages, w)
+	return
+}
+
+//SendMessage sends a message to a conversation. e.x {"Body": "See you there"}.
+//Members with an open notification stream get it right away, the others
+//when they load the conversation
+func SendMessage(w http.ResponseWriter, r *http.Request) {
+	conversation, userID, ok := loadConversation(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		Body string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	body := strings.TrimSpace(requestData.Body)
+	if body == "" || len(body) > maxMessageLength {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{fmt.Sprintf("Messages have 1 to %d characters", maxMessageLength)}, w)
+		return
+	}
+
+	//Members that blocked the sender or were blocked by them do not get
+	//the message, a conversation between two of them is closed
+	var memberIDs []uint
+	db.Model(&ConversationMember{}).Where("conversation_id = ? AND user_id <> ?", conversation.ID, userID).
+		Pluck("user_id", &memberIDs)
+	blocked := map[uint]bool{}
+	for _, id := range BlockedIDs(userID) {
+		blocked[id] = true
+	}
+	recipients := []uint{}
+	for _, id := range memberIDs {
+		if !blocked[id] {
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"User is blocked"}, w)
+		return
+	}
+
+	message := Message{ConversationID: conversation.ID, SenderID: userID, Body: body}
+	if db.Create(&message).Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	db.Model(&conversation).Updates(Conversation{LastMessageAt: &message.CreatedAt})
+	//Senders have read their own message
+	readConversation(conversation.ID, userID, message.ID)
+
+	publishMessageUpdate(recipients, MessageUpdate{
+		Type:           MessageUpdateMessage,
+		ConversationID: conversation.ID,
+		Message:        &message,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(message, w)
+	return
+}
+
+//ReadConversation marks the messages of a conversation as read, up to
+//MessageID when given. e.x {"MessageID": 120}. The other members see it as
+//a read receipt
+func ReadConversation(w http.ResponseWriter, r *http.Request) {
+	conversation, userID, ok := loadConversation(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		MessageID uint
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	var last Message
+	tx := db.Where("conversation_id = ?", conversation.ID)
+	if requestData.MessageID != 0 {
+		tx = tx.Where("id <= ?", requestData.MessageID)
+	}
+	if tx.Order("id DESC").First(&last).RecordNotFound() {
+		w.WriteHeader(http.StatusOK)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if readConversation(conversation.ID, userID, last.ID) {
+		var memberIDs []uint
+		db.Model(&ConversationMember{}).Where("conversation_id = ? AND user_id <> ?", conversation.ID, userID).
+			Pluck("user_id", &memberIDs)
+		publishMessageUpdate(memberIDs, MessageUpdate{
+			Type:           MessageUpdateRead,
+			ConversationID: conversation.ID,
+			UserID:         userID,
+			LastReadID:     last.ID,
+		})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//LeaveConversation removes the logged in user from a group conversation.
+//Conversations between two users can not be left
+func LeaveConversation(w http.ResponseWriter, r *http.Request) {
+	conversation, userID, ok := loadConversation(w, r)
+	if !ok {
+		return
+	}
+
+	var members int
+	db.Model(&ConversationMember{}).Where("conversation_id = ?", conversation.ID).Count(&members)
+	if members <= 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Only group conversations can be left"}, w)
+		return
+	}
+
+	db.Where("conversation_id = ? AND user_id = ?", conversation.ID, userID).Delete(ConversationMember{})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+// directConversation finds the conversation without a title between just
+// the two users
+func directConversation(userID uint, otherID uint) (conversation Conversation, ok bool) {
+	notFound := db.Preload("Members.User").
+		Where("title = '' AND id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?)", userID).
+		Where("id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?)", otherID).
+		Where("(SELECT COUNT(*) FROM conversation_members WHERE conversation_id = conversations.id) = 2").
+		First(&conversation).RecordNotFound()
+	return conversation, !notFound
+}
+
+// fillConversation sets the last message and unread count of a
+// conversation for the user, leaving out messages of blocked users
+func fillConversation(conversation *Conversation, userID uint, blocked []uint) {
+	tx := db.Where("conversation_id = ?", conversation.ID)
+	if len(blocked) != 0 {
+		tx = tx.Where("sender_id NOT IN (?)", blocked)
+	}
+	var last Message
+	if !tx.Order("id DESC").First(&last).RecordNotFound() {
+		conversation.LastMessage = &last
+	}
+
+	for _, member := range conversation.Members {
+		if member.UserID == userID {
+			conversation.Unread = unreadMessages(member, blocked)
+		}
+	}
+}
+
+// unreadMessages counts the messages of others the member did not read
+func unreadMessages(member ConversationMember, blocked []uint) int {
+	tx := db.Model(&Message{}).
+		Where("conversation_id = ? AND id > ? AND sender_id <> ?", member.ConversationID, member.LastReadID, member.UserID)
+	if len(blocked) != 0 {
+		tx = tx.Where("sender_id NOT IN (?)", blocked)
+	}
+	var count int
+	tx.Count(&count)
+	return count
+}
+
+// readConversation moves the read receipt of the user forward to the
+// message, false when they had already read it
+func readConversation(conversationID uint, userID uint, messageID uint) bool {
+	now := time.Now()
+	return db.Model(&ConversationMember{}).
+		Where("conversation_id = ? AND user_id = ? AND last_read_id < ?", conversationID, userID, messageID).
+		Updates(ConversationMember{LastReadID: messageID, LastReadAt: &now}).RowsAffected != 0
+}
+
+// publishMessageUpdate pushes an update to the message topics of the users
+func publishMessageUpdate(userIDs []uint, update MessageUpdate) {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+	for _, userID := range userIDs {
+		if err = pubsub.Publish(messageTopic(userID), payload); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// messageTopic is the topic of the message updates of a user
+func messageTopic(userID uint) string {
+	return fmt.Sprintf("messages:%d", userID)
+}
+
+// loadConversation loads the conversation from /conversations/{id} and the
+// logged in user, who has to be a member of it. Writes the error response
+// when they are not
+func loadConversation(w http.ResponseWriter, r *http.Request) (conversation Conversation, userID uint, ok bool) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return conversation, 0, false
+	}
+	userID = session.Values["userID"].(uint)
+
+	if db.Where("id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?)", userID).
+		First(&conversation, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return conversation, userID, false
+	}
+	return conversation, userID, true
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Things users can report
+const (
+	ReportTargetUser    = "user"
+	ReportTargetEvent   = "event"
+	ReportTargetComment = "comment"
+)
+
+// Reasons users report content for
+var reportCategories = []string{"spam", "harassment", "inappropriate", "fake", "other"}
+
+// Statuses of reports
+const (
+	ReportOpen      = "open"
+	ReportInReview  = "in_review"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// Actions moderators take on reports
+const (
+	ModerationDismiss = "dismiss"
+	ModerationHide    = "hide"
+	ModerationWarn    = "warn"
+	ModerationSuspend = "suspend"
+)
+
+// Statuses of appeals
+const (
+	AppealPending = "pending"
+	AppealGranted = "granted"
+	AppealDenied  = "denied"
+)
+
+// Types of notifications about moderation. Only NotificationReportResolved
+// can be turned off
+const (
+	NotificationReportResolved   = "report_resolved"
+	NotificationModerationWarn   = "moderation_warning"
+	NotificationContentHidden    = "content_hidden"
+	NotificationAccountSuspended = "account_suspended"
+	NotificationAppealDecided    = "appeal_decided"
+)
+
+// Moderation rules
+const (
+	maxReportDetails     = 1000
+	maxSuspension        = 365 * 24 * time.Hour
+	defaultReportLimit   = 20
+	maxReportLimit       = 100
+	maxAppealLength      = 1000
+	maxModerationComment = 255
+)
+
+//Report is a complaint of a user about another user, an event or a comment
+type Report struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	ReporterID uint
+	Reporter   *User  `json:",omitempty" gorm:"foreignkey:ReporterID"`
+	TargetType string `gorm:"size:20;index:idx_report_target"`
+	TargetID   uint   `gorm:"index:idx_report_target"`
+	// TargetUserID is the reported user or the author of the reported content
+	TargetUserID uint   `gorm:"index"`
+	Category     string `gorm:"size:30"`
+	Details      string `gorm:"size:1000"`
+	Status       string `gorm:"size:20;index"`
+	AssigneeID   uint   `gorm:"index"`
+	// Resolution is the action taken on the report
+	Resolution string `gorm:"size:20"`
+}
+
+//ModerationAction is a warning, suspension or hidden content of a user. A
+//granted appeal revokes it
+type ModerationAction struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	ReportID    uint
+	ModeratorID uint
+	UserID      uint   `gorm:"index"`
+	Action      string `gorm:"size:20"`
+	TargetType  string `gorm:"size:20"`
+	TargetID    uint
+	Reason      string `gorm:"size:255"`
+	// Until is when a suspension ends
+	Until     *time.Time
+	RevokedAt *time.Time
+	Appeal    *Appeal `json:",omitempty" gorm:"foreignkey:ActionID"`
+}
+
+//Appeal asks the moderators to take back an action against a user
+type Appeal struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ActionID    uint   `gorm:"unique_index"`
+	UserID      uint   `gorm:"index"`
+	Body        string `gorm:"size:1000"`
+	Status      string `gorm:"size:20;index"`
+	ModeratorID uint
+	Response    string `gorm:"size:255"`
+}
+
+//CreateReport reports a user, an event or a comment to the moderators.
+//e.x {"TargetType": "comment", "TargetID": 12, "Category": "spam", "Details": "..."}
+func CreateReport(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	var report Report
+	if json.NewDecoder(r.Body).Decode(&report) != nil || !validReportCategory(report.Category) ||
+		len(report.Details) > maxReportDetails {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Reports need a target and one of the categories " +
+			strings.Join(reportCategories, ", ")}, w)
+		return
+	}
+
+	targetUserID, ok := reportTargetUser(report.TargetType, report.TargetID, userID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	if targetUserID == userID {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"You can not report yourself"}, w)
+		return
+	}
+
+	//Users report the same thing once while it waits for a moderator
+	var count int
+	db.Model(&Report{}).Where("reporter_id = ? AND target_type = ? AND target_id = ? AND status IN (?)",
+		userID, report.TargetType, report.TargetID, []string{ReportOpen, ReportInReview}).Count(&count)
+	if count != 0 {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"You already reported it"}, w)
+		return
+	}
+
+	report = Report{
+		ReporterID:   userID,
+		TargetType:   report.TargetType,
+		TargetID:     report.TargetID,
+		TargetUserID: targetUserID,
+		Category:     report.Category,
+		Details:      strings.TrimSpace(report.Details),
+		Status:       ReportOpen,
+	}
+	db.Create(&report)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(report, w)
+	return
+}
+
+//GetReports returns the moderation queue, oldest first. Open reports by
+//default. e.x ?status=in_review&assignee=me&type=event&page=2
+func GetReports(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := loadModerator(w, r)
+	if !ok {
+		return
+	}
+
+	keys := r.URL.Query()
+	status := keys.Get("status")
+	if status == "" {
+		status = ReportOpen
+	}
+	page, limit := pagination(r, defaultReportLimit, maxReportLimit)
+
+	tx := db.Model(&Report{}).Where("status = ?", status)
+	if assignee := keys.Get("assignee"); assignee == "me" {
+		tx = tx.Where("assignee_id = ?", moderator.ID)
+	} else if assignee != "" {
+		tx = tx.Where("assignee_id = ?", assignee)
+	}
+	if targetType := keys.Get("type"); targetType != "" {
+		tx = tx.Where("target_type = ?", targetType)
+	}
+
+	var total int
+	reports := []Report{}
+	tx.Count(&total)
+	tx.Preload("Reporter").Order("id").Offset((page - 1) * limit).Limit(limit).Find(&reports)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Reports []Report
+		Page    int
+		Limit   int
+		Total   int
+	}{reports, page, limit, total}, w)
+	return
+}
+
+//GetReport returns a report with the earlier actions against the reported
+//user
+func GetReport(w http.ResponseWriter, r *http.Request) {
+	_, report, ok := loadReport(w, r)
+	if !ok {
+		return
+	}
+
+	actions := []ModerationAction{}
+	db.Preload("Appeal").Where("user_id = ?", report.TargetUserID).Order("id DESC").Find(&actions)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Report  Report
+		Actions []ModerationAction
+	}{report, actions}, w)
+	return
+}
+
+//EditReport changes the status of a report or assigns it to a moderator.
+//e.x {"Status": "in_review", "AssigneeID": 3}. Assigned open reports go
+//in review
+func EditReport(w http.ResponseWriter, r *http.Request) {
+	_, report, ok := loadReport(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		Status string
+		// AssigneeID is a pointer so a report can be unassigned with 0
+		AssigneeID *uint
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	if report.Status == ReportResolved || report.Status == ReportDismissed {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The report was already handled"}, w)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if requestData.AssigneeID != nil {
+		if *requestData.AssigneeID != 0 {
+			var assignee User
+			if db.First(&assignee, *requestData.AssigneeID).RecordNotFound() || !assignee.IsModerator() {
+				w.WriteHeader(http.StatusBadRequest)
+				JSONResponse(struct{ Error string }{"Reports can only be assigned to moderators"}, w)
+				return
+			}
+			if report.Status == ReportOpen {
+				updates["status"] = ReportInReview
+			}
+		}
+		updates["assignee_id"] = *requestData.AssigneeID
+	}
+	if requestData.Status != "" {
+		if requestData.Status != ReportOpen && requestData.Status != ReportInReview {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{"Reports are resolved by taking an action"}, w)
+			return
+		}
+		updates["status"] = requestData.Status
+	}
+	db.Model(&report).Updates(updates)
+	db.Preload("Reporter").First(&report, report.ID)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(report, w)
+	return
+}
+
+//TakeReportAction resolves a report and every other open report of the
+//same target. e.x {"Action": "suspend", "Reason": "...", "Duration": "72h"}.
+//Actions are dismiss, hide, warn and suspend, suspensions need a duration
+func TakeReportAction(w http.ResponseWriter, r *http.Request) {
+	moderator, report, ok := loadReport(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		Action   string
+		Reason   string
+		Duration string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	reason := truncate(strings.TrimSpace(requestData.Reason), maxModerationComment)
+
+	if report.Status == ReportResolved || report.Status == ReportDismissed {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The report was already handled"}, w)
+		return
+	}
+
+	action := ModerationAction{
+		ReportID:    report.ID,
+		ModeratorID: moderator.ID,
+		UserID:      report.TargetUserID,
+		Action:      requestData.Action,
+		TargetType:  report.TargetType,
+		TargetID:    report.TargetID,
+		Reason:      reason,
+	}
+	var target User
+	db.First(&target, report.TargetUserID)
+
+	switch requestData.Action {
+	case ModerationDismiss:
+	case ModerationWarn:
+	case ModerationHide:
+		if report.TargetType == ReportTargetUser {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{"Users can not be hidden, suspend them instead"}, w)
+			return
+		}
+	case ModerationSuspend:
+		duration, err := time.ParseDuration(requestData.Duration)
+		if err != nil || duration <= 0 || duration > maxSuspension {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{"Suspensions need a duration of up to a year, e.g. 72h"}, w)
+			return
+		}
+		//Only admins can suspend other moderators
+		if target.IsModerator() && !moderator.IsAdmin() {
+			w.WriteHeader(http.StatusForbidden)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		until := time.Now().Add(duration)
+		action.Until = &until
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Unknown action"}, w)
+		return
+	}
+
+	status := ReportResolved
+	if requestData.Action == ModerationDismiss {
+		status = ReportDismissed
+	} else {
+		db.Create(&action)
+		applyModerationAction(action, target)
+	}
+
+	//Every open report of the target is handled by the same action
+	var reporterIDs []uint
+	tx := db.Model(&Report{}).Where("target_type = ? AND target_id = ? AND status IN (?)",
+		report.TargetType, report.TargetID, []string{ReportOpen, ReportInReview})
+	tx.Pluck("reporter_id", &reporterIDs)
+	tx.Updates(map[string]interface{}{"status": status, "resolution": requestData.Action})
+	if status == ReportResolved {
+		NotifyUsers(reporterIDs, NotificationReportResolved, 0,
+			"Thank you for your report, a moderator took action")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(action, w)
+	return
+}
+
+//GetModerationHistory returns the actions taken against the logged in user
+//with their appeals. Suspended users can see it
+func GetModerationHistory(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	actions := []ModerationAction{}
+	db.Preload("Appeal").Where("user_id = ?", session.Values["userID"].(uint)).Order("id DESC").Find(&actions)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(actions, w)
+	return
+}
+
+//CreateAppeal appeals an action taken against the logged in user, once per
+//action. e.x {"ActionID": 4, "Body": "..."}. Suspended users can appeal
+func CreateAppeal(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	requestData := struct {
+		ActionID uint
+		Body     string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	body := strings.TrimSpace(requestData.Body)
+	if body == "" || len(body) > maxAppealLength {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{fmt.Sprintf("Appeals have 1 to %d characters", maxAppealLength)}, w)
+		return
+	}
+
+	var action ModerationAction
+	if db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", requestData.ActionID, userID).
+		First(&action).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var count int
+	db.Model(&Appeal{}).Where("action_id = ?", action.ID).Count(&count)
+	if count != 0 {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The action was already appealed"}, w)
+		return
+	}
+
+	appeal := Appeal{ActionID: action.ID, UserID: userID, Body: body, Status: AppealPending}
+	db.Create(&appeal)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(appeal, w)
+	return
+}
+
+//GetAppeals lists appeals for moderators, pending ones oldest first unless
+//another status is asked for. e.x ?status=denied
+func GetAppeals(w http.ResponseWriter, r *http.Request) {
+	if _, ok := loadModerator(w, r); !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = AppealPending
+	}
+	page, limit := pagination(r, defaultReportLimit, maxReportLimit)
+
+	appeals := []Appeal{}
+	db.Where("status = ?", status).Order("id").Offset((page - 1) * limit).Limit(limit).Find(&appeals)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(appeals, w)
+	return
+}
+
+//DecideAppeal grants or denies a pending appeal. Granting it revokes the
+//action: hidden content is shown again and suspensions end.
+//e.x {"Granted": true, "Response": "..."}
+func DecideAppeal(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := loadModerator(w, r)
+	if !ok {
+		return
+	}
+
+	//Gets id from /admin/appeals/{id}
+	var appeal Appeal
+	if db.Where("status = ?", AppealPending).First(&appeal, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		Granted  bool
+		Response string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	var action ModerationAction
+	db.First(&action, appeal.ActionID)
+	//Moderators do not decide appeals of their own actions
+	if action.ModeratorID == moderator.ID && !moderator.IsAdmin() {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"Another moderator has to decide the appeal"}, w)
+		return
+	}
+
+	status := AppealDenied
+	message := "Your appeal was denied"
+	if requestData.Granted {
+		status = AppealGranted
+		message = "Your appeal was granted"
+		revokeModerationAction(action)
+	}
+	db.Model(&appeal).Updates(Appeal{
+		Status:      status,
+		ModeratorID: moderator.ID,
+		Response:    truncate(strings.TrimSpace(requestData.Response), maxModerationComment),
+	})
+	if appeal.Response != "" {
+		message += ": " + appeal.Response
+	}
+	NotifyUsers([]uint{appeal.UserID}, NotificationAppealDecided, 0, message)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(appeal, w)
+	return
+}
+
+//SuspensionMiddleware refuses every request of suspended users except the
+//ones they need to log out, see why they were suspended and appeal
+func SuspensionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := sessionStore.Get(r, "Access-token")
+		if session.Values["userID"] != nil && !allowedWhileSuspended(r) {
+			if until, suspended := SuspendedUntil(session.Values["userID"].(uint)); suspended {
+				writeSuspended(w, until)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//SuspendedUntil returns when the suspension of a user ends, if they are
+//suspended
+func SuspendedUntil(userID uint) (time.Time, bool) {
+	var action ModerationAction
+	if db.Where("user_id = ? AND action = ? AND until > ? AND revoked_at IS NULL", userID, ModerationSuspend, time.Now()).
+		Order("until DESC").First(&action).RecordNotFound() {
+		return time.Time{}, false
+	}
+	return *action.Until, true
+}
+
+// writeSuspended refuses a request of a suspended user
+func writeSuspended(w http.ResponseWriter, until time.Time) {
+	w.WriteHeader(http.StatusForbidden)
+	JSONResponse(struct {
+		Error string
+		Until time.Time
+	}{"Your account is suspended", until}, w)
+}
+
+// allowedWhileSuspended checks if the request is one suspended users can
+// still make
+func allowedWhileSuspended(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	switch r.Method + " " + path {
+	case "GET /login", "DELETE /login", "GET /account/moderation", "POST /appeals":
+		return true
+	}
+	return false
+}
+
+// applyModerationAction hides the reported content or lets the user know
+// about the warning or suspension
+func applyModerationAction(action ModerationAction, user User) {
+	switch action.Action {
+	case ModerationHide:
+		if action.TargetType == ReportTargetEvent {
+			db.Model(&Event{}).Where("id = ?", action.TargetID).Updates(map[string]interface{}{"hidden": true})
+		} else {
+			db.Where("id = ?", action.TargetID).Delete(Comment{})
+		}
+		NotifyUsers([]uint{user.ID}, NotificationContentHidden, 0,
+			moderationMessage("Your "+action.TargetType+" was hidden by a moderator", action.Reason))
+	case ModerationWarn:
+		NotifyUsers([]uint{user.ID}, NotificationModerationWarn, 0,
+			moderationMessage("You received a warning from a moderator", action.Reason))
+	case ModerationSuspend:
+		NotifyUsers([]uint{user.ID}, NotificationAccountSuspended, 0,
+			moderationMessage("Your account is suspended until "+action.Until.UTC().Format(time.RFC1123), action.Reason))
+	}
+}
+
+// revokeModerationAction takes back an action after a granted appeal
+func revokeModerationAction(action ModerationAction) {
+	if action.Action == ModerationHide {
+		if action.TargetType == ReportTargetEvent {
+			db.Model(&Event{}).Where("id = ?", action.TargetID).Updates(map[string]interface{}{"hidden": false})
+		} else {
+			db.Unscoped().Model(&Comment{}).Where("id = ?", action.TargetID).Update("deleted_at", nil)
+		}
+	}
+	now := time.Now()
+	db.Model(&action).Updates(ModerationAction{RevokedAt: &now})
+}
+
+// moderationMessage adds the reason of a moderator to a notification
+func moderationMessage(message string, reason string) string {
+	if reason == "" {
+		return message
+	}
+	return message + ": " + reason
+}
+
+// reportTargetUser returns the reported user or the author of the reported
+// content, which the reporter has to be able to see
+func reportTargetUser(targetType string, targetID uint, reporterID uint) (uint, bool) {
+	switch targetType {
+	case ReportTargetUser:
+		var user User
+		return targetID, !db.First(&user, targetID).RecordNotFound()
+	case ReportTargetEvent:
+		var event Event
+		if db.First(&event, targetID).RecordNotFound() || !CanViewEvent(event, reporterID, "") {
+			return 0, false
+		}
+		return event.CreatorID, true
+	case ReportTargetComment:
+		var comment Comment
+		var event Event
+		if db.First(&comment, targetID).RecordNotFound() || db.First(&event, comment.EventID).RecordNotFound() ||
+			!CanViewEvent(event, reporterID, "") {
+			return 0, false
+		}
+		return comment.AuthorID, true
+	}
+	return 0, false
+}
+
+// validReportCategory checks if the category is one of reportCategories
+func validReportCategory(category string) bool {
+	for _, valid := range reportCategories {
+		if category == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// loadModerator loads the logged in user, who has to be a moderator.
+// Writes the error response when they are not
+func loadModerator(w http.ResponseWriter, r *http.Request) (user User, ok bool) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return user, false
+	}
+
+	db.First(&user, session.Values["userID"].(uint))
+	if !user.IsModerator() {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return user, false
+	}
+	return user, true
+}
+
+// loadReport loads the moderator and the report from /admin/reports/{id}.
+// Writes the error response when either is missing
+func loadReport(w http.ResponseWriter, r *http.Request) (moderator User, report Report, ok bool) {
+	moderator, ok = loadModerator(w, r)
+	if !ok {
+		return moderator, report, false
+	}
+
+	if db.Preload("Reporter").First(&report, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return moderator, report, false
+	}
+	return moderator, report, true
+}
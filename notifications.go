@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Types of notifications sent to users
+const (
+	NotificationEventCancelled   = "event_cancelled"
+	NotificationEventPostponed   = "event_postponed"
+	NotificationEventRescheduled = "event_rescheduled"
+	NotificationEventDeleted     = "event_deleted"
+	NotificationEventInvitation  = "event_invitation"
+	NotificationCommentMention   = "comment_mention"
+	NotificationParticipantJoin  = "participant_joined"
+	NotificationParticipantLeave = "participant_left"
+	NotificationEventChanged     = "event_changed"
+	NotificationCommentCreated   = "comment_created"
+)
+
+// notificationTypes lists every notification type users can turn off
+var notificationTypes = []string{
+	NotificationEventCancelled,
+	NotificationEventPostponed,
+	NotificationEventRescheduled,
+	NotificationEventDeleted,
+	NotificationEventInvitation,
+	NotificationCommentMention,
+	NotificationParticipantJoin,
+	NotificationParticipantLeave,
+	NotificationEventChanged,
+	NotificationCommentCreated,
+	NotificationEventReminder,
+	NotificationReminderEmail,
+	NotificationReminderPush,
+	NotificationTeamsLocked,
+	NotificationFriendRequest,
+	NotificationFriendAccepted,
+	NotificationNewFollower,
+	NotificationGroupJoinRequest,
+	NotificationGroupJoinApproved,
+	NotificationCoOrganizerAdded,
+	NotificationCoOrganizerRemoved,
+	NotificationEventTransferred,
+	NotificationJoinRequest,
+	NotificationJoinRequestAccepted,
+	NotificationJoinRequestRejected,
+	NotificationParticipantRemoved,
+	NotificationWaitlistPromoted,
+	NotificationReportResolved,
+	NotificationBadgeAwarded,
+}
+
+// Limits of the notification list
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+// Limits of the notification stream
+const (
+	// maxStreamsPerUser is how many streams a user can have open at once
+	maxStreamsPerUser = 3
+	streamKeepAlive   = 25 * time.Second
+	// streamBuffer is how many notifications can wait for a stream, slower
+	// streams are closed and resume with Last-Event-ID when they reconnect
+	streamBuffer = 32
+)
+
+// openStreams counts the notification streams open for each user
+var openStreams = struct {
+	sync.Mutex
+	count map[uint]int
+}{count: map[uint]int{}}
+
+//Notification is a message about something that happened to an event
+//the user is part of
+type Notification struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	Type      string `gorm:"size:40"`
+	EventID   uint
+	Message   string `gorm:"size:255"`
+	ReadAt    *time.Time
+}
+
+//NotificationPreference turns a type of notifications on or off for a user.
+//Types without a preference are turned on
+type NotificationPreference struct {
+	ID      uint   `gorm:"primary_key"`
+	UserID  uint   `gorm:"unique_index:idx_notification_preference"`
+	Type    string `gorm:"size:40;unique_index:idx_notification_preference"`
+	Enabled bool
+}
+
+//NotifyUsers records a notification for every given user and pushes it
+//to their open notification streams. Users that turned the type off are skipped
+func NotifyUsers(userIDs []uint, notificationType string, eventID uint, message string) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	var disabledIDs []uint
+	db.Model(&NotificationPreference{}).
+		Where("user_id IN (?) AND type = ? AND enabled = ?", userIDs, notificationType, false).
+		Pluck("user_id", &disabledIDs)
+	disabled := map[uint]bool{}
+	for _, userID := range disabledIDs {
+		disabled[userID] = true
+	}
+
+	for _, userID := range userIDs {
+		if disabled[userID] {
+			continue
+		}
+		notification := Notification{
+			UserID:  userID,
+			Type:    notificationType,
+			EventID: eventID,
+			Message: message,
+		}
+		if db.Create(&notification).Error != nil {
+			continue
+		}
+
+		payload, err := json.Marshal(notification)
+		if err != nil {
+			continue
+		}
+		if err = pubsub.Publish(userTopic(userID), payload); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// userTopic is the topic of the notifications of a user
+func userTopic(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+//NotifyEventUsers notifies the creator and every participant of an event
+//except the user that caused the notification
+func NotifyEventUsers(event Event, actorID uint, notificationType string, message string) {
+	NotifyUsers(eventUserIDs(event, actorID), notificationType, event.ID, message)
+}
+
+// eventUserIDs returns the ids of the creator, co-organizers and
+// participants of an event without the excluded user
+func eventUserIDs(event Event, excludedID uint) []uint {
+	var userIDs, organizerIDs []uint
+	db.Table("events_joined").Where("event_id = ?", event.ID).Pluck("user_id", &userIDs)
+	db.Model(&EventOrganizer{}).Where("event_id = ?", event.ID).Pluck("user_id", &organizerIDs)
+	userIDs = append(append(userIDs, organizerIDs...), event.CreatorID)
+
+	filtered := userIDs[:0]
+	seen := map[uint]bool{excludedID: true}
+	for _, userID := range userIDs {
+		if !seen[userID] {
+			seen[userID] = true
+			filtered = append(filtered, userID)
+		}
+	}
+	return filtered
+}
+
+//NotificationStream streams the notifications of the user as Server-Sent
+//Events. Clients reconnecting with Last-Event-ID first get every
+//notification they missed. New messages and read receipts of their
+//conversations come as message and read events without an id
+func NotificationStream(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if !openStream(userID) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		JSONResponse(struct{ Error string }{"Too many open notification streams"}, w)
+		return
+	}
+	defer closeStream(userID)
+
+	//Subscribes before loading missed notifications so none are lost in between
+	notifications := make(chan []byte, streamBuffer)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	unsubscribe := pubsub.Subscribe(userTopic(userID), func(payload []byte) {
+		select {
+		case notifications <- payload:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+	messages := make(chan []byte, streamBuffer)
+	unsubscribeMessages := pubsub.Subscribe(messageTopic(userID), func(payload []byte) {
+		select {
+		case messages <- payload:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribeMessages()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+
+	//Browsers send the id of the last event they got when reconnecting
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID uint
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return
+		}
+		lastID = uint(id)
+
+		var missed []Notification
+		db.Where("user_id = ? AND id > ?", userID, lastID).Order("id").Find(&missed)
+		for _, notification := range missed {
+			writeNotificationEvent(w, notification)
+			lastID = notification.ID
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-overflow:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case payload := <-notifications:
+			var notification Notification
+			//Skips notifications already sent from the log
+			if json.Unmarshal(payload, &notification) != nil || notification.ID <= lastID {
+				continue
+			}
+			writeNotificationEvent(w, notification)
+			lastID = notification.ID
+			flusher.Flush()
+		case payload := <-messages:
+			//Missed messages are loaded from the conversations, so these
+			//events have no id to resume from
+			var update MessageUpdate
+			if json.Unmarshal(payload, &update) != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", update.Type, payload)
+			flusher.Flush()
+		}
+	}
+}
+
+// writeNotificationEvent writes a notification as a Server-Sent Event
+func writeNotificationEvent(w http.ResponseWriter, notification Notification) {
+	data, _ := json.Marshal(notification)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", notification.ID, notification.Type, data)
+}
+
+// openStream counts a new stream of the user, false when they have too many
+func openStream(userID uint) bool {
+	openStreams.Lock()
+	defer openStreams.Unlock()
+
+	if openStreams.count[userID] >= maxStreamsPerUser {
+		return false
+	}
+	openStreams.count[userID]++
+	return true
+}
+
+// closeStream stops counting a closed stream of the user
+func closeStream(userID uint) {
+	openStreams.Lock()
+	defer openStreams.Unlock()
+
+	openStreams.count[userID]--
+	if openStreams.count[userID] == 0 {
+		delete(openStreams.count, userID)
+	}
+}
+
+//GetNotifications returns the notifications of the user, newest first.
+//?unread=true only returns the ones that were not read yet
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	// Gets pagination keys from url. e.x ?page=2&limit=20&unread=true
+	page, limit := pagination(r, defaultNotificationLimit, maxNotificationLimit)
+
+	tx := db.Model(&Notification{}).Where("user_id = ?", userID)
+	if r.URL.Query().Get("unread") == "true" {
+		tx = tx.Where("read_at IS NULL")
+	}
+
+	var total int
+	tx.Count(&total)
+	var unread int
+	db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&unread)
+
+	notifications := []Notification{}
+	tx.Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&notifications)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Notifications []Notification
+		Page          int
+		Limit         int
+		Total         int
+		Unread        int
+	}{notifications, page, limit, total, unread}, w)
+	return
+}
+
+//ReadNotification marks a notification of the user as read
+func ReadNotification(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets id from /notifications/{id}/read
+	notificationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var notification Notification
+	if db.First(&notification, "id = ? AND user_id = ?", notificationID, session.Values["userID"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if notification.ReadAt == nil {
+		now := time.Now()
+		notification.ReadAt = &now
+		db.Model(&notification).Updates(map[string]interface{}{"read_at": now})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(notification, w)
+	return
+}
+
+//ReadAllNotifications marks every notification of the user as read
+func ReadAllNotifications(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", session.Values["userID"]).
+		Updates(map[string]interface{}{"read_at": time.Now()})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetNotificationPreferences returns every notification type and whether
+//the user wants to get it
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(notificationPreferences(session.Values["userID"].(uint)), w)
+	return
+}
+
+//EditNotificationPreferences turns notification types on or off, the body
+//maps types to true or false. e.x {"participant_joined": false}
+func EditNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	var preferences map[string]bool
+	if json.NewDecoder(r.Body).Decode(&preferences) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	known := notificationPreferences(0)
+	for notificationType := range preferences {
+		if _, ok := known[notificationType]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{ Error string }{"Unknown notification type " + notificationType}, w)
+			return
+		}
+	}
+
+	for notificationType, enabled := range preferences {
+		var preference NotificationPreference
+		db.Where(NotificationPreference{UserID: userID, Type: notificationType}).FirstOrInit(&preference)
+		preference.Enabled = enabled
+		db.Save(&preference)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(notificationPreferences(userID), w)
+	return
+}
+
+// notificationPreferences maps every notification type to whether the user
+// gets it
+func notificationPreferences(userID uint) map[string]bool {
+	preferences := map[string]bool{}
+	for _, notificationType := range notificationTypes {
+		preferences[notificationType] = true
+	}
+
+	var stored []NotificationPreference
+	db.Where("user_id = ?", userID).Find(&stored)
+	for _, preference := range stored {
+		preferences[preference.Type] = preference.Enabled
+	}
+	return preferences
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions recorded in the audit log of an event
+const (
+	AuditCoOrganizerAdded     = "co_organizer_added"
+	AuditCoOrganizerRemoved   = "co_organizer_removed"
+	AuditOwnershipTransferred = "ownership_transferred"
+	AuditParticipantRemoved   = "participant_removed"
+	AuditUserBanned           = "user_banned"
+)
+
+// Types of notifications about the organizers of an event
+const (
+	NotificationCoOrganizerAdded   = "co_organizer_added"
+	NotificationCoOrganizerRemoved = "co_organizer_removed"
+	NotificationEventTransferred   = "event_transferred"
+)
+
+//EventOrganizer is a co-organizer of an event. Co-organizers can edit the
+//event, manage its participants and check them in, but not delete it
+type EventOrganizer struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	EventID   uint  `gorm:"unique_index:idx_event_organizer"`
+	UserID    uint  `gorm:"unique_index:idx_event_organizer;index"`
+	User      *User `json:",omitempty" gorm:"foreignkey:UserID"`
+	AddedByID uint
+}
+
+//AuditLog records who changed the organizers and participants of an event
+type AuditLog struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	EventID   uint `gorm:"index"`
+	ActorID   uint
+	Action    string `gorm:"size:50"`
+	TargetID  uint
+	Details   string `gorm:"size:255"`
+}
+
+//GetEventOrganizers lists the co-organizers of an event
+func GetEventOrganizers(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	//Gets id from /events/{id}/organizers
+	eventID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var event Event
+	if db.First(&event, eventID).RecordNotFound() || !CanViewEvent(event, userID, r.URL.Query().Get("invite")) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	organizers := []EventOrganizer{}
+	db.Preload("User").Where("event_id = ?", event.ID).Order("id").Find(&organizers)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(organizers, w)
+	return
+}
+
+//AddEventOrganizer makes a user a co-organizer of an event. Only the
+//creator and the organizers of its group can add co-organizers
+func AddEventOrganizer(w http.ResponseWriter, r *http.Request) {
+	event, actor, ok := loadOwnedEvent(w, r)
+	if !ok {
+		return
+	}
+
+	//Gets user id from /events/{id}/organizers/{userID}
+	var user User
+	if db.First(&user, mux.Vars(r)["userID"]).RecordNotFound() || user.ID == event.CreatorID {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	if IsBlocked(actor.ID, user.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"User is blocked"}, w)
+		return
+	}
+
+	if isCoOrganizer(event.ID, user.ID) {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"User already organizes the event"}, w)
+		return
+	}
+
+	organizer := EventOrganizer{EventID: event.ID, UserID: user.ID, AddedByID: actor.ID}
+	db.Create(&organizer)
+	writeAuditLog(event.ID, actor.ID, AuditCoOrganizerAdded, user.ID, user.Username)
+	NotifyUsers([]uint{user.ID}, NotificationCoOrganizerAdded, event.ID,
+		fmt.Sprintf("%s made you a co-organizer of %s", actor.Username, eventSummary(event)))
+
+	organizer.User = &user
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(organizer, w)
+	return
+}
+
+//RemoveEventOrganizer removes a co-organizer from an event. Co-organizers
+//can step down themselves
+func RemoveEventOrganizer(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	var actor User
+	db.First(&actor, session.Values["userID"].(uint))
+
+	//Gets ids from /events/{id}/organizers/{userID}
+	params := mux.Vars(r)
+	var event Event
+	if db.First(&event, params["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var organizer EventOrganizer
+	if db.Preload("User").Where("event_id = ? AND user_id = ?", event.ID, params["userID"]).
+		First(&organizer).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if organizer.UserID != actor.ID && !IsEventOwner(event, actor.ID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Delete(&organizer)
+	writeAuditLog(event.ID, actor.ID, AuditCoOrganizerRemoved, organizer.UserID, organizer.User.Username)
+	if organizer.UserID != actor.ID {
+		NotifyUsers([]uint{organizer.UserID}, NotificationCoOrganizerRemoved, event.ID,
+			fmt.Sprintf("%s removed you from the organizers of %s", actor.Username, eventSummary(event)))
+	} else {
+		NotifyUsers([]uint{event.CreatorID}, NotificationCoOrganizerRemoved, event.ID,
+			fmt.Sprintf("%s stopped organizing %s", actor.Username, eventSummary(event)))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//TransferEvent hands an event over to one of its co-organizers or
+//participants. e.x {"UserID": 4}. The previous creator stays on the event
+//as a participant and can leave it afterwards. Events of a series are not
+//handed over. Creator only
+func TransferEvent(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	var actor User
+	db.First(&actor, session.Values["userID"].(uint))
+
+	//Gets id from /events/{id}/transfer
+	var event Event
+	if db.First(&event, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	if event.CreatorID != actor.ID {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Series are managed by their creator, an occurrence handed to someone
+	//else could no longer be edited together with its series
+	if event.SeriesID != 0 {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Events of a series can not be handed over"}, w)
+		return
+	}
+
+	requestData := struct {
+		UserID uint
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	var owner User
+	if requestData.UserID == actor.ID || db.First(&owner, requestData.UserID).RecordNotFound() ||
+		(!isCoOrganizer(event.ID, owner.ID) && !isParticipant(event.ID, owner.ID)) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Events can only be handed to co-organizers and participants"}, w)
+		return
+	}
+
+	//The new creator is no longer a participant or co-organizer, the
+	//previous one takes their place as a participant
+	db.Model(&event).Association("Users").Delete(&owner)
+	db.Where("event_id = ? AND user_id = ?", event.ID, owner.ID).Delete(EventOrganizer{})
+	db.Model(&event).Association("Users").Append(&actor)
+	countParticipants(&event)
+
+	db.Model(&event).Updates(map[string]interface{}{
+		"creator_id":   owner.ID,
+		"creator_name": owner.Username,
+		"sequence":     event.Sequence + 1,
+	})
+	writeAuditLog(event.ID, actor.ID, AuditOwnershipTransferred, owner.ID, owner.Username)
+
+	previous := event
+	db.Preload("Creator").First(&event, event.ID)
+	publishEventEdited(event.ID)
+	NotifyUsers([]uint{owner.ID}, NotificationEventTransferred, event.ID,
+		fmt.Sprintf("%s handed %s over to you", actor.Username, eventSummary(previous)))
+	var others []uint
+	for _, userID := range eventUserIDs(event, actor.ID) {
+		if userID != owner.ID {
+			others = append(others, userID)
+		}
+	}
+	NotifyUsers(others, NotificationEventChanged, event.ID,
+		fmt.Sprintf("%s is now organized by %s", eventSummary(previous), owner.Username))
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(event, w)
+	return
+}
+
+//GetAuditLog returns the audit log of an event, newest first. Only users
+//that manage the event can see it
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	// Gets pagination keys from url. e.x ?page=2&limit=20
+	page, limit := pagination(r, 20, 100)
+
+	logs := []AuditLog{}
+	db.Where("event_id = ?", event.ID).Order("id DESC").Offset((page - 1) * limit).Limit(limit).Find(&logs)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(logs, w)
+	return
+}
+
+//IsEventOwner checks if the user can delete an event and choose its
+//co-organizers: its creator and the organizers of the group that owns it
+func IsEventOwner(event Event, userID uint) bool {
+	if userID == 0 {
+		return false
+	}
+	return event.CreatorID == userID || (event.GroupID != 0 && IsGroupOrganizer(event.GroupID, userID))
+}
+
+// isCoOrganizer checks if the user is a co-organizer of the event
+func isCoOrganizer(eventID uint, userID uint) bool {
+	var count int
+	db.Model(&EventOrganizer{}).Where("event_id = ? AND user_id = ?", eventID, userID).Count(&count)
+	return count != 0
+}
+
+// writeAuditLog records an action on an event
+func writeAuditLog(eventID uint, actorID uint, action string, targetID uint, details string) {
+	db.Create(&AuditLog{EventID: eventID, ActorID: actorID, Action: action, TargetID: targetID, Details: truncate(details, 255)})
+}
+
+// loadOwnedEvent loads the event from /events/{id} and the logged in user,
+// who has to own it. Writes the error response when they do not
+func loadOwnedEvent(w http.ResponseWriter, r *http.Request) (event Event, user User, ok bool) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return event, user, false
+	}
+	db.First(&user, session.Values["userID"].(uint))
+
+	if db.First(&event, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return event, user, false
+	}
+
+	if !IsEventOwner(event, user.ID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return event, user, false
+	}
+	return event, user, true
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of join requests
+const (
+	JoinRequestPending  = "pending"
+	JoinRequestAccepted = "accepted"
+	JoinRequestRejected = "rejected"
+)
+
+// Types of notifications about joining and removing participants
+const (
+	NotificationJoinRequest         = "join_request"
+	NotificationJoinRequestAccepted = "join_request_accepted"
+	NotificationJoinRequestRejected = "join_request_rejected"
+	NotificationParticipantRemoved  = "participant_removed"
+)
+
+//JoinRequest asks the organizers of an event that requires approval to let
+//a user join it
+type JoinRequest struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	EventID    uint  `gorm:"unique_index:idx_join_request"`
+	UserID     uint  `gorm:"unique_index:idx_join_request;index"`
+	User       *User `json:",omitempty" gorm:"foreignkey:UserID"`
+	SkillLevel int
+	Status     string `gorm:"size:20"`
+}
+
+//EventBan keeps a user out of every event of a creator
+type EventBan struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	CreatorID uint  `gorm:"unique_index:idx_event_ban"`
+	UserID    uint  `gorm:"unique_index:idx_event_ban"`
+	User      *User `json:",omitempty" gorm:"foreignkey:UserID"`
+	// EventID is the event the user was removed from when banned
+	EventID uint
+	Reason  string `gorm:"size:255"`
+}
+
+//RequestToJoin creates a pending join request for an event that requires
+//approval and lets its organizers know. Rejected users can not ask again
+func RequestToJoin(w http.ResponseWriter, event Event, user User, skillLevel int) {
+	var request JoinRequest
+	if !db.Where("event_id = ? AND user_id = ?", event.ID, user.ID).First(&request).RecordNotFound() {
+		switch request.Status {
+		case JoinRequestPending:
+			w.WriteHeader(http.StatusConflict)
+			JSONResponse(struct{ Error string }{"You already asked to join the event"}, w)
+			return
+		case JoinRequestRejected:
+			w.WriteHeader(http.StatusForbidden)
+			JSONResponse(struct{ Error string }{"Your request to join the event was rejected"}, w)
+			return
+		}
+		//Users that were accepted before and left ask again
+		db.Model(&request).Updates(map[string]interface{}{"status": JoinRequestPending, "skill_level": skillLevel})
+	} else {
+		request = JoinRequest{EventID: event.ID, UserID: user.ID, SkillLevel: skillLevel, Status: JoinRequestPending}
+		db.Create(&request)
+	}
+
+	NotifyUsers(eventOrganizerIDs(event), NotificationJoinRequest, event.ID,
+		fmt.Sprintf("%s asked to join %s", user.Username, eventSummary(event)))
+
+	w.WriteHeader(http.StatusAccepted)
+	JSONResponse(request, w)
+	return
+}
+
+//GetJoinRequests lists the join requests of an event, pending ones unless
+//another status is asked for. e.x ?status=rejected
+func GetJoinRequests(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = JoinRequestPending
+	}
+
+	requests := []JoinRequest{}
+	db.Preload("User").Where("event_id = ? AND status = ?", event.ID, status).Order("id").Find(&requests)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(requests, w)
+	return
+}
+
+//AcceptJoinRequest lets the user of a pending join request into the event
+func AcceptJoinRequest(w http.ResponseWriter, r *http.Request) {
+	answerJoinRequest(w, r, JoinRequestAccepted)
+}
+
+//RejectJoinRequest turns down a pending join request
+func RejectJoinRequest(w http.ResponseWriter, r *http.Request) {
+	answerJoinRequest(w, r, JoinRequestRejected)
+}
+
+// answerJoinRequest accepts or rejects the join request of the user from
+// /events/{id}/requests/{userID}
+func answerJoinRequest(w http.ResponseWriter, r *http.Request, status string) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	var request JoinRequest
+	if db.Where("event_id = ? AND user_id = ? AND status = ?", event.ID, mux.Vars(r)["userID"], JoinRequestPending).
+		First(&request).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	var user User
+	db.First(&user, request.UserID)
+
+	if status == JoinRequestAccepted {
+		//The event may have filled up or closed since the request was made
+		if err := JoinableBy(event, user); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			JSONResponse(struct{ Error string }{err.Error()}, w)
+			return
+		}
+		if !isParticipant(event.ID, user.ID) {
+			AddParticipant(&event, &user)
+		}
+		if request.SkillLevel != 0 {
+			db.Model(&EventParticipant{}).Where("event_id = ? AND user_id = ?", event.ID, user.ID).
+				Updates(map[string]interface{}{"skill_level": request.SkillLevel})
+		}
+		NotifyUsers([]uint{user.ID}, NotificationJoinRequestAccepted, event.ID,
+			"You can join "+eventSummary(event))
+	} else {
+		NotifyUsers([]uint{user.ID}, NotificationJoinRequestRejected, event.ID,
+			"Your request to join "+eventSummary(event)+" was turned down")
+	}
+	db.Model(&request).Updates(JoinRequest{Status: status})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(request, w)
+	return
+}
+
+//RemoveParticipant removes a participant from an event. Both the reason
+//and banning the user from later events of the creator are optional, only
+//the owner of the event can ban. e.x {"Reason": "No show", "Ban": true}
+func RemoveParticipant(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+	session, _ := sessionStore.Get(r, "Access-token")
+	actorID := session.Values["userID"].(uint)
+
+	//Gets user id from /events/{id}/users/{userID}
+	var user User
+	if db.First(&user, mux.Vars(r)["userID"]).RecordNotFound() || !isParticipant(event.ID, user.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		Reason string
+		Ban    bool
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	//Bans apply to every event of the creator, so co-organizers can not ban
+	if requestData.Ban && !IsEventOwner(event, actorID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{ Error string }{"Only the owner of the event can ban users"}, w)
+		return
+	}
+
+	//Organizers of the event can not be banned from it
+	if requestData.Ban && CanManageEvent(event, user.ID) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Organizers of the event can not be banned"}, w)
+		return
+	}
+
+	db.Model(&event).Association("Users").Delete(&user)
+	RemoveFromTeams(event.ID, user.ID)
+	countParticipants(&event)
+	writeAuditLog(event.ID, actorID, AuditParticipantRemoved, user.ID, requestData.Reason)
+	if requestData.Ban {
+		ban := EventBan{CreatorID: event.CreatorID, UserID: user.ID, EventID: event.ID, Reason: truncate(requestData.Reason, 255)}
+		db.Where(EventBan{CreatorID: event.CreatorID, UserID: user.ID}).Assign(ban).FirstOrCreate(&ban)
+		writeAuditLog(event.ID, actorID, AuditUserBanned, user.ID, requestData.Reason)
+	}
+
+	PublishEventUpdate(event, UpdateParticipantLeft, participantUpdate(event, user))
+	message := "You were removed from " + eventSummary(event)
+	if requestData.Reason != "" {
+		message += ": " + requestData.Reason
+	}
+	NotifyUsers([]uint{user.ID}, NotificationParticipantRemoved, event.ID, message)
+	PromoteFromWaitlist(&event)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetBans lists the users banned from the events of the logged in user
+func GetBans(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	bans := []EventBan{}
+	db.Preload("User").Where("creator_id = ?", session.Values["userID"].(uint)).Order("id DESC").Find(&bans)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(bans, w)
+	return
+}
+
+//Unban lets a banned user join the events of the logged in user again
+func Unban(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets user id from /account/bans/{userID}
+	if db.Where("creator_id = ? AND user_id = ?", session.Values["userID"].(uint), mux.Vars(r)["userID"]).
+		Delete(EventBan{}).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//IsBanned checks if the creator banned the user from their events
+func IsBanned(creatorID uint, userID uint) bool {
+	var count int
+	db.Model(&EventBan{}).Where("creator_id = ? AND user_id = ?", creatorID, userID).Count(&count)
+	return count != 0
+}
+
+// countParticipants counts the creator and the joined users of an event
+// again and stores the number, so it can not drift from the participants
+func countParticipants(event *Event) {
+	var joined int
+	db.Table("events_joined").Where("event_id = ?", event.ID).Count(&joined)
+	event.Participants = joined + 1
+	db.Model(event).Updates(map[string]interface{}{"participants": event.Participants})
+}
+
+// eventOrganizerIDs returns the ids of the creator and co-organizers of an
+// event
+func eventOrganizerIDs(event Event) []uint {
+	var ids []uint
+	db.Model(&EventOrganizer{}).Where("event_id = ?", event.ID).Pluck("user_id", &ids)
+	return append(ids, event.CreatorID)
+}
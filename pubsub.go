@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+//PubSub delivers messages published on a topic to every subscriber of
+//that topic
+type PubSub interface {
+	Publish(topic string, payload []byte) error
+	// Subscribe calls handler for every message on the topic until the
+	// returned function is called
+	Subscribe(topic string, handler func(payload []byte)) (unsubscribe func())
+}
+
+//Broker is a message broker shared by several server instances, e.g. Redis
+//or NATS. BrokerPubSub turns it into a PubSub
+type Broker interface {
+	Publish(topic string, payload []byte) error
+	// Receive blocks and calls handler with every message published
+	// through the broker by any instance
+	Receive(handler func(topic string, payload []byte)) error
+}
+
+//LocalPubSub is an in-process PubSub, messages only reach subscribers
+//of the same server instance
+type LocalPubSub struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[string]map[int]func([]byte)
+}
+
+//NewLocalPubSub creates an empty in-process PubSub
+func NewLocalPubSub() *LocalPubSub {
+	return &LocalPubSub{handlers: map[string]map[int]func([]byte){}}
+}
+
+//Publish calls the handlers of the topic. Handlers must not block
+func (ps *LocalPubSub) Publish(topic string, payload []byte) error {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	for _, handler := range ps.handlers[topic] {
+		handler(payload)
+	}
+	return nil
+}
+
+//Subscribe adds a handler to the topic
+func (ps *LocalPubSub) Subscribe(topic string, handler func([]byte)) func() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.nextID++
+	id := ps.nextID
+	if ps.handlers[topic] == nil {
+		ps.handlers[topic] = map[int]func([]byte){}
+	}
+	ps.handlers[topic][id] = handler
+
+	return func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+
+		delete(ps.handlers[topic], id)
+		if len(ps.handlers[topic]) == 0 {
+			delete(ps.handlers, topic)
+		}
+	}
+}
+
+//BrokerPubSub publishes through a broker so every server instance
+//receives the message and hands it to its own local subscribers
+type BrokerPubSub struct {
+	broker Broker
+	local  *LocalPubSub
+}
+
+//NewBrokerPubSub starts receiving messages from the broker
+func NewBrokerPubSub(broker Broker) *BrokerPubSub {
+	ps := &BrokerPubSub{broker: broker, local: NewLocalPubSub()}
+	go func() {
+		err := broker.Receive(func(topic string, payload []byte) {
+			ps.local.Publish(topic, payload)
+		})
+		log.Println("Message broker stopped:", err)
+	}()
+	return ps
+}
+
+//Publish sends the message to every instance through the broker
+func (ps *BrokerPubSub) Publish(topic string, payload []byte) error {
+	return ps.broker.Publish(topic, payload)
+}
+
+//Subscribe adds a handler for messages of the topic arriving from the broker
+func (ps *BrokerPubSub) Subscribe(topic string, handler func([]byte)) func() {
+	return ps.local.Subscribe(topic, handler)
+}
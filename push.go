@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+//NotificationReminderPush turns off reminders by Web Push
+const NotificationReminderPush = "event_reminder_push"
+
+// pushRecordSize is the record size written in the aes128gcm header
+const pushRecordSize = 4096
+
+// privateNetworks are the address ranges push messages are never sent to,
+// so subscriptions can not make the server call its own network
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+//PushSubscription is a browser subscription to Web Push messages
+type PushSubscription struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"index"`
+	Endpoint  string `gorm:"size:500;unique_index"`
+	// P256dh and Auth are the base64url keys of the browser
+	P256dh string `gorm:"size:100"`
+	Auth   string `gorm:"size:50"`
+}
+
+//PushChannel sends reminders with the Web Push protocol. Messages are
+//encrypted with aes128gcm (RFC 8291) and signed with VAPID (RFC 8292)
+type PushChannel struct {
+	privateKey *ecdsa.PrivateKey
+	// publicKey is the uncompressed VAPID public key in base64url, the
+	// frontend needs it to subscribe
+	publicKey string
+	subject   string
+	client    *http.Client
+}
+
+//NewPushChannel creates a channel from a base64url encoded VAPID private
+//key. subject is a mailto: or https: contact of the server
+func NewPushChannel(privateKey string, subject string) (*PushChannel, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("VAPID_PRIVATE_KEY must be a base64url encoded P-256 private key")
+	}
+
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	if subject == "" {
+		subject = "mailto:admin@semestroprojektasktu2020"
+	}
+
+	return &PushChannel{
+		privateKey: key,
+		publicKey:  base64.RawURLEncoding.EncodeToString(elliptic.Marshal(curve, key.X, key.Y)),
+		subject:    subject,
+		client:     newPushClient(),
+	}, nil
+}
+
+// newPushClient creates a client that refuses to connect to private
+// addresses. The check runs on the address that is dialed, so host names
+// that resolve to another address later are refused as well
+func newPushClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicIP(net.ParseIP(host)) {
+				return errors.Errorf("push endpoint %s is not a public address", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}
+}
+
+// publicEndpoint checks that every address the host of endpoint resolves
+// to is public
+func publicEndpoint(endpoint *url.URL) bool {
+	ips, err := net.LookupIP(endpoint.Hostname())
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicIP checks that ip is not in one of the private networks
+func publicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNetworks parses CIDR ranges
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+//Name of the channel
+func (channel *PushChannel) Name() string { return "push" }
+
+//Preference that turns the channel off
+func (channel *PushChannel) Preference() string { return NotificationReminderPush }
+
+//Send pushes the reminder to every browser the user subscribed with.
+//Subscriptions the push service reports as gone are deleted
+func (channel *PushChannel) Send(reminder Reminder) error {
+	var subscriptions []PushSubscription
+	db.Where("user_id = ?", reminder.User.ID).Find(&subscriptions)
+
+	payload, _ := json.Marshal(struct {
+		Title   string
+		Body    string
+		EventID uint
+	}{reminder.Subject, reminder.Body, reminder.Event.ID})
+
+	var lastErr error
+	for _, subscription := range subscriptions {
+		status, err := channel.push(subscription, payload)
+		if status == http.StatusNotFound || status == http.StatusGone {
+			db.Delete(&subscription)
+			continue
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// push sends an encrypted message to one subscription
+func (channel *PushChannel) push(subscription PushSubscription, payload []byte) (int, error) {
+	body, err := encryptPushMessage(subscription, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid push endpoint")
+	}
+	token, err := channel.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return 0, err
+	}
+
+	request, err := http.NewRequest("POST", subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", "86400")
+	request.Header.Set("Urgency", "normal")
+	request.Header.Set("Authorization", "vapid t="+token+", k="+channel.publicKey)
+
+	response, err := channel.client.Do(request)
+	if err != nil {
+		return 0, errors.Wrap(err, "sending push message")
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 300 {
+		return response.StatusCode, errors.Errorf("push service answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// vapidToken signs a JWT for the push service with ES256
+func (channel *PushChannel) vapidToken(audience string) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, _ := json.Marshal(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}{audience, time.Now().Add(12 * time.Hour).Unix(), channel.subject})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, channel.privateKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	//ES256 signatures are r and s as 32 byte big endian numbers
+	signature := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rBytes):32], rBytes)
+	copy(signature[64-len(sBytes):], sBytes)
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// encryptPushMessage encrypts the payload for the subscription as a single
+// aes128gcm record, see RFC 8291
+func encryptPushMessage(subscription PushSubscription, payload []byte) ([]byte, error) {
+	curve := elliptic.P256()
+
+	uaPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(subscription.P256dh, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid p256dh key")
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(subscription.Auth, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid auth secret")
+	}
+
+	//A new key pair and salt for every message
+	asPrivate, _, _, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return encryptPushRecord(uaPublic, authSecret, asPrivate, salt, payload)
+}
+
+// encryptPushRecord encrypts the payload for the user agent key and auth
+// secret with the given application server private key and salt
+func encryptPushRecord(uaPublic []byte, authSecret []byte, asPrivate []byte, salt []byte, payload []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	asX, asY := curve.ScalarBaseMult(asPrivate)
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sharedBytes := sharedX.Bytes()
+	copy(ecdhSecret[32-len(sharedBytes):], sharedBytes)
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	//0x02 marks the last record
+	plaintext := append(append([]byte{}, payload...), 0x02)
+
+	header := make([]byte, 21, 21+len(asPublic))
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:20], pushRecordSize)
+	header[20] = byte(len(asPublic))
+	header = append(header, asPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+//GetPushSubscriptions returns the VAPID public key the frontend subscribes
+//with and the subscriptions of the user
+func GetPushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var publicKey string
+	for _, channel := range reminderChannels {
+		if push, ok := channel.(*PushChannel); ok {
+			publicKey = push.publicKey
+		}
+	}
+
+	subscriptions := []PushSubscription{}
+	db.Where("user_id = ?", session.Values["userID"]).Find(&subscriptions)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		PublicKey     string
+		Subscriptions []PushSubscription
+	}{publicKey, subscriptions}, w)
+	return
+}
+
+//AddPushSubscription stores the PushSubscription of a browser, the body is
+//the JSON of the browser subscription
+func AddPushSubscription(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var requestData struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256dh string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	endpoint, err := url.Parse(requestData.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || requestData.Keys.P256dh == "" || requestData.Keys.Auth == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	if !publicEndpoint(endpoint) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Push endpoint must be a public address"}, w)
+		return
+	}
+
+	//Endpoints are unique, one subscribed by another user is not taken over
+	userID := session.Values["userID"].(uint)
+	var count int
+	db.Model(&PushSubscription{}).Where("endpoint = ? AND user_id <> ?", requestData.Endpoint, userID).Count(&count)
+	if count != 0 {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Push endpoint is subscribed by another user"}, w)
+		return
+	}
+
+	//A browser that subscribes again replaces its previous subscription
+	var subscription PushSubscription
+	db.Where(PushSubscription{UserID: userID, Endpoint: requestData.Endpoint}).FirstOrInit(&subscription)
+	subscription.P256dh = requestData.Keys.P256dh
+	subscription.Auth = requestData.Keys.Auth
+	db.Save(&subscription)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(subscription, w)
+	return
+}
+
+//DeletePushSubscription removes a subscription of the user by its endpoint
+func DeletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var requestData struct {
+		Endpoint string `json:"endpoint"`
+	}
+	json.NewDecoder(r.Body).Decode(&requestData)
+
+	db.Where("user_id = ? AND endpoint = ?", session.Values["userID"], requestData.Endpoint).Delete(PushSubscription{})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// decryptPushMessage decrypts an aes128gcm message the way a user agent
+// does, see RFC 8291 section 3.4 and RFC 8188 section 2
+func decryptPushMessage(uaPrivate []byte, authSecret []byte, message []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	if len(message) < 21 || len(message) < 21+int(message[20]) {
+		return nil, errors.Errorf("message of %d bytes is too short", len(message))
+	}
+	salt := message[:16]
+	if recordSize := binary.BigEndian.Uint32(message[16:20]); recordSize != pushRecordSize {
+		return nil, errors.Errorf("record size %d, want %d", recordSize, pushRecordSize)
+	}
+	asPublic := message[21 : 21+int(message[20])]
+	ciphertext := message[21+int(message[20]):]
+
+	asX, asY := elliptic.Unmarshal(curve, asPublic)
+	if asX == nil {
+		return nil, errors.New("the key id is not a P-256 public key")
+	}
+	uaX, uaY := curve.ScalarBaseMult(uaPrivate)
+	uaPublic := elliptic.Marshal(curve, uaX, uaY)
+	sharedX, _ := curve.ScalarMult(asX, asY, uaPrivate)
+	ecdhSecret := make([]byte, 32)
+	sharedBytes := sharedX.Bytes()
+	copy(ecdhSecret[32-len(sharedBytes):], sharedBytes)
+
+	derive := func(secret []byte, salt []byte, info string, size int) []byte {
+		key := make([]byte, size)
+		io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+		return key
+	}
+	ikm := derive(ecdhSecret, authSecret, "WebPush: info\x00"+string(uaPublic)+string(asPublic), 32)
+	cek := derive(ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce := derive(ikm, salt, "Content-Encoding: nonce\x00", 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	//The last record ends with 0x02 followed by optional zero padding
+	end := bytes.LastIndexByte(plaintext, 0x02)
+	if end < 0 || len(bytes.Trim(plaintext[end+1:], "\x00")) != 0 {
+		return nil, errors.New("the record has no last record delimiter")
+	}
+	return plaintext[:end], nil
+}
+
+func TestEncryptPushMessage(t *testing.T) {
+	curve := elliptic.P256()
+	uaPrivate, uaX, uaY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	subscription := PushSubscription{
+		P256dh: base64.RawURLEncoding.EncodeToString(elliptic.Marshal(curve, uaX, uaY)),
+		Auth:   base64.URLEncoding.EncodeToString(authSecret),
+	}
+
+	for _, payload := range [][]byte{[]byte(`{"title":"Football starts in an hour"}`), {}} {
+		first, err := encryptPushMessage(subscription, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := decryptPushMessage(uaPrivate, authSecret, first); err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("decrypted %q, %v, want %q", got, err, payload)
+		}
+		//Every message uses its own key pair and salt
+		second, _ := encryptPushMessage(subscription, payload)
+		if bytes.Equal(first[:16], second[:16]) || bytes.Equal(first[21:86], second[21:86]) {
+			t.Error("two messages share a salt or a key")
+		}
+	}
+
+	//A different auth secret can not decrypt the message
+	message, _ := encryptPushMessage(subscription, []byte("secret"))
+	if _, err := decryptPushMessage(uaPrivate, make([]byte, 16), message); err == nil {
+		t.Error("the message was decrypted with a wrong auth secret")
+	}
+
+	for _, invalid := range []PushSubscription{
+		{P256dh: "not base64!", Auth: subscription.Auth},
+		{P256dh: subscription.P256dh, Auth: "not base64!"},
+		{P256dh: base64.RawURLEncoding.EncodeToString(make([]byte, 65)), Auth: subscription.Auth},
+	} {
+		if _, err := encryptPushMessage(invalid, []byte("hi")); err == nil {
+			t.Errorf("subscription %+v was accepted", invalid)
+		}
+	}
+}
+
+func TestEncryptPushRecordExample(t *testing.T) {
+	//Example from RFC 8291 appendix A
+	decode := func(value string) []byte {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	uaPublic := decode("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	uaPrivate := decode("q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94")
+	asPrivate := decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	authSecret := decode("BTBZMqHH6r4Tts7J_aSIgg")
+	salt := decode("DGv6ra1nlYgDCS1FRnbzlw")
+	plaintext := []byte("When I grow up, I want to be a watermelon")
+	want := decode("DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6Tlz" +
+		"AC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+
+	got, err := encryptPushRecord(uaPublic, authSecret, asPrivate, salt, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %s\nwant %s", base64.RawURLEncoding.EncodeToString(got), base64.RawURLEncoding.EncodeToString(want))
+	}
+	if decrypted, err := decryptPushMessage(uaPrivate, authSecret, want); err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted %q, %v", decrypted, err)
+	}
+}
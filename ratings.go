@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rules of rating events and participants
+const (
+	// ratingWindow is how long after an event ends it can be rated
+	ratingWindow    = 14 * 24 * time.Hour
+	maxReviewLength = 1000
+	// Organizer scores are averaged with reputationPriorWeight ratings of
+	// reputationPrior, so a single rating does not make a perfect organizer
+	reputationPrior       = 3.0
+	reputationPriorWeight = 5.0
+)
+
+//EventRating is the score a participant gave a finished event and its organizer
+type EventRating struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	EventID     uint `gorm:"unique_index:idx_event_rating"`
+	RaterID     uint `gorm:"unique_index:idx_event_rating"`
+	Rater       User `gorm:"foreignkey:RaterID"`
+	OrganizerID uint `gorm:"index"`
+	Score       int
+	Review      string `gorm:"size:1000"`
+}
+
+//ParticipantRating is the feedback an organizer gave a participant of a
+//finished event. NoShow marks participants that did not come
+type ParticipantRating struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	EventID     uint `gorm:"unique_index:idx_participant_rating"`
+	UserID      uint `gorm:"unique_index:idx_participant_rating;index"`
+	OrganizerID uint
+	NoShow      bool
+	// Score is 1 to 5, or 0 when the organizer only marked attendance
+	Score   int
+	Comment string `gorm:"size:1000"`
+}
+
+//Reputation sums up the ratings of a user as an organizer and a participant
+type Reputation struct {
+	// OrganizerScore is the weighted average score of the events the user
+	// organized, 0 when nobody rated them yet
+	OrganizerScore   float64
+	OrganizerAverage float64
+	OrganizerRatings int
+	ParticipantScore float64
+	NoShows          int
+}
+
+//RateEvent lets a participant rate a finished event from 1 to 5 with an
+//optional review. Rating again within the window changes the rating
+func RateEvent(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	event, ok := loadRatedEvent(w, r)
+	if !ok {
+		return
+	}
+
+	//Organizers can not rate their own events and only participants that
+	//came can rate them
+	if event.CreatorID == userID {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"Organizers can not rate their own events"}, w)
+		return
+	}
+	if !isParticipant(event.ID, userID) || isNoShow(event.ID, userID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{"Only participants of the event can rate it"}, w)
+		return
+	}
+
+	requestData := struct {
+		Score  int
+		Review string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	requestData.Review = strings.TrimSpace(requestData.Review)
+
+	if requestData.Score < 1 || requestData.Score > 5 || len(requestData.Review) > maxReviewLength {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var rating EventRating
+	db.Where(EventRating{EventID: event.ID, RaterID: userID}).FirstOrInit(&rating)
+	rating.OrganizerID = event.CreatorID
+	rating.Score = requestData.Score
+	rating.Review = requestData.Review
+	db.Save(&rating)
+	db.First(&rating.Rater, userID)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(rating, w)
+	return
+}
+
+//GetEventRatings returns the ratings of an event and their average
+func GetEventRatings(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	//Gets id from /events/{id}/ratings
+	eventID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var event Event
+	if db.First(&event, eventID).RecordNotFound() || !CanViewEvent(event, userID, r.URL.Query().Get("invite")) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	ratings := []EventRating{}
+	db.Preload("Rater").Where("event_id = ?", event.ID).Order("created_at").Find(&ratings)
+
+	var average float64
+	for _, rating := range ratings {
+		average += float64(rating.Score)
+	}
+	if len(ratings) != 0 {
+		average /= float64(len(ratings))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Ratings []EventRating
+		Average float64
+	}{ratings, average}, w)
+	return
+}
+
+//RateParticipant lets the organizer of a finished event mark a participant
+//as a no-show or rate them
+func RateParticipant(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	event, ok := loadRatedEvent(w, r)
+	if !ok {
+		return
+	}
+
+	if event.CreatorID != userID {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets participant id from /events/{id}/users/{userID}/rating
+	participantID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil || !isParticipant(event.ID, uint(participantID)) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		NoShow  bool
+		Score   int
+		Comment string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	requestData.Comment = strings.TrimSpace(requestData.Comment)
+
+	//No-shows are not scored, everyone else can be rated from 1 to 5
+	if requestData.NoShow {
+		requestData.Score = 0
+	}
+	if requestData.Score < 0 || requestData.Score > 5 || len(requestData.Comment) > maxReviewLength ||
+		(!requestData.NoShow && requestData.Score == 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var rating ParticipantRating
+	db.Where(ParticipantRating{EventID: event.ID, UserID: uint(participantID)}).FirstOrInit(&rating)
+	rating.OrganizerID = userID
+	rating.NoShow = requestData.NoShow
+	rating.Score = requestData.Score
+	rating.Comment = requestData.Comment
+	db.Save(&rating)
+
+	//A no-show can not keep a rating of the event they did not come to
+	if rating.NoShow {
+		SetAttendance(event.ID, uint(participantID), AttendanceNoShow)
+		db.Where("event_id = ? AND rater_id = ?", event.ID, participantID).Delete(EventRating{})
+	} else {
+		//A participant that is scored came after all, so a no-show marked
+		//earlier is withdrawn
+		var participant EventParticipant
+		db.Where("event_id = ? AND user_id = ?", event.ID, participantID).First(&participant)
+		if participant.Attendance == AttendanceNoShow {
+			SetAttendance(event.ID, uint(participantID), AttendanceCheckedIn)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(rating, w)
+	return
+}
+
+//GetReputation sums up the ratings a user got
+func GetReputation(userID uint) Reputation {
+	var reputation Reputation
+
+	var organizer struct {
+		Total float64
+		Count int
+	}
+	db.Model(&EventRating{}).Select("COALESCE(SUM(score), 0) AS total, COUNT(*) AS count").
+		Where("organizer_id = ?", userID).Scan(&organizer)
+	if organizer.Count != 0 {
+		reputation.OrganizerRatings = organizer.Count
+		reputation.OrganizerAverage = organizer.Total / float64(organizer.Count)
+		reputation.OrganizerScore = (reputationPrior*reputationPriorWeight + organizer.Total) /
+			(reputationPriorWeight + float64(organizer.Count))
+	}
+
+	var participant struct {
+		Total float64
+		Count int
+	}
+	db.Model(&ParticipantRating{}).Select("COALESCE(SUM(score), 0) AS total, COUNT(*) AS count").
+		Where("user_id = ? AND no_show = ?", userID, false).Scan(&participant)
+	if participant.Count != 0 {
+		reputation.ParticipantScore = participant.Total / float64(participant.Count)
+	}
+	reputation.NoShows = GetAttendanceStatsOf(userID).NoShows
+
+	return reputation
+}
+
+// isNoShow checks if the user was marked as not coming to the event
+func isNoShow(eventID uint, userID uint) bool {
+	var count int
+	db.Model(&EventParticipant{}).
+		Where("event_id = ? AND user_id = ? AND attendance = ?", eventID, userID, AttendanceNoShow).Count(&count)
+	return count != 0
+}
+
+// loadRatedEvent loads the event from /events/{id}/... and checks that it
+// can be rated. Writes the error response when it can not
+func loadRatedEvent(w http.ResponseWriter, r *http.Request) (event Event, ok bool) {
+	eventID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	if db.First(&event, eventID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return event, false
+	}
+
+	if event.Status != EventStatusFinished {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Only finished events can be rated"}, w)
+		return event, false
+	}
+	if time.Since(event.EndTime) > ratingWindow {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The rating period of the event is over"}, w)
+		return event, false
+	}
+
+	return event, true
+}
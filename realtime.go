@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Types of updates pushed to WebSocket clients
+const (
+	UpdateParticipantJoined = "participant_joined"
+	UpdateParticipantLeft   = "participant_left"
+	UpdateEventEdited       = "event_edited"
+	UpdateEventDeleted      = "event_deleted"
+	UpdateCommentCreated    = "comment_created"
+)
+
+// Timings and limits of WebSocket connections
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = 4096
+	// wsSendBuffer is how many updates can wait for a client before it is
+	// considered too slow and disconnected
+	wsSendBuffer = 64
+)
+
+// eventsTopic carries the updates of every event, clients subscribed with
+// a filter pick the ones they are interested in
+const eventsTopic = "events"
+
+// eventTopic is the topic of the updates of a single event
+func eventTopic(eventID uint) string {
+	return fmt.Sprintf("event:%d", eventID)
+}
+
+// The upgrader keeps the default same origin check so other sites can not
+// open connections with the session cookie of the user
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+//EventUpdate is a change of an event pushed to subscribed clients.
+//Sport, Location, CreatorID, Visibility and Status are used to match filters
+type EventUpdate struct {
+	Type       string
+	EventID    uint
+	Sport      string
+	Location   string
+	CreatorID  uint
+	Visibility string
+	Status     string
+	Hidden     bool
+	Data       interface{}
+}
+
+//EventFilter selects events from the list of all events, like the
+//filters of GET /events. Empty fields match every event
+type EventFilter struct {
+	Sport     string
+	Location  string
+	CreatorID uint
+}
+
+// matches checks if the update is about an event the filter selects
+func (filter EventFilter) matches(update EventUpdate) bool {
+	return (filter.Sport == "" || filter.Sport == update.Sport) &&
+		(filter.Location == "" || filter.Location == update.Location) &&
+		(filter.CreatorID == 0 || filter.CreatorID == update.CreatorID)
+}
+
+//PublishEventUpdate pushes a change of the event to the clients subscribed
+//to it or to a filter that selects it
+func PublishEventUpdate(event Event, updateType string, data interface{}) {
+	payload, err := json.Marshal(EventUpdate{
+		Type:       updateType,
+		EventID:    event.ID,
+		Sport:      event.Sport,
+		Location:   event.Location,
+		CreatorID:  event.CreatorID,
+		Visibility: event.Visibility,
+		Status:     event.Status,
+		Hidden:     event.Hidden,
+		Data:       data,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err = pubsub.Publish(eventTopic(event.ID), payload); err != nil {
+		log.Println(err)
+	}
+	if err = pubsub.Publish(eventsTopic, payload); err != nil {
+		log.Println(err)
+	}
+}
+
+// participantUpdate is the data of joined and left updates
+func participantUpdate(event Event, user User) interface{} {
+	return struct {
+		UserID       uint
+		Username     string
+		Participants int
+	}{user.ID, user.Username, event.Participants}
+}
+
+// wsCommand is a message sent by a client to change its subscriptions.
+// Action is subscribe or unsubscribe, with either an EventID or a Filter
+type wsCommand struct {
+	Action  string
+	EventID uint
+	Invite  string
+	Filter  *EventFilter
+}
+
+// wsMessage is a message queued for a client. Updates that still have to
+// be checked against what the client may see carry the update
+type wsMessage struct {
+	payload []byte
+	update  *EventUpdate
+}
+
+// wsClient is a WebSocket connection and its subscriptions
+type wsClient struct {
+	conn      *websocket.Conn
+	userID    uint
+	send      chan wsMessage
+	closeOnce sync.Once
+
+	mu          sync.Mutex
+	events      map[uint]func()
+	unsubscribe func()
+	// filters and the ids of followed events have their own lock as they
+	// are read while publishing
+	filtersMu sync.RWMutex
+	filters   []EventFilter
+	followed  map[uint]bool
+}
+
+//EventUpdates upgrades the request to a WebSocket that pushes updates of
+//the events the client subscribes to
+func EventUpdates(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//The upgrader writes the error response itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	client := &wsClient{
+		conn:     conn,
+		userID:   session.Values["userID"].(uint),
+		send:     make(chan wsMessage, wsSendBuffer),
+		events:   map[uint]func(){},
+		followed: map[uint]bool{},
+	}
+	go client.writePump()
+	client.readPump()
+}
+
+// deliver queues a message for the client without waiting
+func (client *wsClient) deliver(payload []byte) {
+	client.queue(wsMessage{payload: payload})
+}
+
+// queue adds a message to the queue of the client. Clients that do not
+// keep up are disconnected instead of slowing down the publisher
+func (client *wsClient) queue(message wsMessage) {
+	select {
+	case client.send <- message:
+	default:
+		client.close()
+	}
+}
+
+// close closes the connection, readPump then cleans up the subscriptions
+func (client *wsClient) close() {
+	client.closeOnce.Do(func() {
+		client.conn.Close()
+	})
+}
+
+// readPump handles the commands of the client until the connection is
+// closed or the client stops answering pings
+func (client *wsClient) readPump() {
+	defer func() {
+		client.mu.Lock()
+		for _, unsubscribe := range client.events {
+			unsubscribe()
+		}
+		if client.unsubscribe != nil {
+			client.unsubscribe()
+		}
+		client.mu.Unlock()
+		close(client.send)
+		client.close()
+	}()
+
+	client.conn.SetReadLimit(wsMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var command wsCommand
+		//Closed connections and anything that is not valid json end the loop
+		if err := client.conn.ReadJSON(&command); err != nil {
+			return
+		}
+		client.handle(command)
+	}
+}
+
+// writePump sends queued updates and pings to the client
+func (client *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			if ok && message.update != nil && !client.listed(*message.update) {
+				continue
+			}
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if client.conn.WriteMessage(websocket.TextMessage, message.payload) != nil {
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if client.conn.WriteMessage(websocket.PingMessage, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle changes the subscriptions of the client
+func (client *wsClient) handle(command wsCommand) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	switch {
+	case command.Action == "subscribe" && command.EventID != 0:
+		if client.events[command.EventID] != nil {
+			return
+		}
+		//Private events can only be followed by users that can see them
+		var event Event
+		if db.First(&event, command.EventID).RecordNotFound() ||
+			!CanViewEvent(event, client.userID, command.Invite) {
+			client.reply("error", command.EventID, "Event not found")
+			return
+		}
+		client.events[event.ID] = pubsub.Subscribe(eventTopic(event.ID), client.deliver)
+		client.filtersMu.Lock()
+		client.followed[event.ID] = true
+		client.filtersMu.Unlock()
+		client.reply("subscribed", event.ID, "")
+
+	case command.Action == "unsubscribe" && command.EventID != 0:
+		if unsubscribe := client.events[command.EventID]; unsubscribe != nil {
+			unsubscribe()
+			delete(client.events, command.EventID)
+			client.filtersMu.Lock()
+			delete(client.followed, command.EventID)
+			client.filtersMu.Unlock()
+		}
+		client.reply("unsubscribed", command.EventID, "")
+
+	case command.Action == "subscribe" && command.Filter != nil:
+		client.filtersMu.Lock()
+		client.filters = append(client.filters, *command.Filter)
+		client.filtersMu.Unlock()
+		if client.unsubscribe == nil {
+			client.unsubscribe = pubsub.Subscribe(eventsTopic, client.deliverFiltered)
+		}
+		client.reply("subscribed", 0, "")
+
+	case command.Action == "unsubscribe" && command.Filter != nil:
+		client.filtersMu.Lock()
+		filters := client.filters[:0]
+		for _, filter := range client.filters {
+			if filter != *command.Filter {
+				filters = append(filters, filter)
+			}
+		}
+		client.filters = filters
+		client.filtersMu.Unlock()
+		if len(filters) == 0 && client.unsubscribe != nil {
+			client.unsubscribe()
+			client.unsubscribe = nil
+		}
+		client.reply("unsubscribed", 0, "")
+
+	default:
+		client.reply("error", command.EventID, "Unknown command")
+	}
+}
+
+// reply answers a command of the client
+func (client *wsClient) reply(replyType string, eventID uint, message string) {
+	payload, _ := json.Marshal(struct {
+		Type    string
+		EventID uint
+		Error   string `json:",omitempty"`
+	}{replyType, eventID, message})
+	client.deliver(payload)
+}
+
+// deliverFiltered delivers updates from the list of all events that match
+// one of the filters of the client and would be listed to them. Updates of
+// followed events already arrive through their own topic
+func (client *wsClient) deliverFiltered(payload []byte) {
+	var update EventUpdate
+	if json.Unmarshal(payload, &update) != nil {
+		return
+	}
+
+	client.filtersMu.RLock()
+	matched := false
+	for _, filter := range client.filters {
+		if !client.followed[update.EventID] && filter.matches(update) {
+			matched = true
+			break
+		}
+	}
+	client.filtersMu.RUnlock()
+	if !matched {
+		return
+	}
+
+	switch {
+	//Drafts and events hidden by a moderator are only listed to their creator
+	case update.Status == EventStatusDraft || update.Hidden:
+		if update.CreatorID == client.userID {
+			client.deliver(payload)
+		}
+	case update.Visibility == "" || update.Visibility == VisibilityPublic:
+		client.deliver(payload)
+	//Other events are checked against the database by writePump, so the
+	//publisher does not wait for it
+	default:
+		client.queue(wsMessage{payload, &update})
+	}
+}
+
+// listed checks if GET /events would show the event of the update to the
+// client, so private and members events do not leak through filters
+func (client *wsClient) listed(update EventUpdate) bool {
+	var count int
+	db.Model(&Event{}).Scopes(VisibleTo(client.userID)).Where("id = ?", update.EventID).Count(&count)
+	return count != 0
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Supported RFC 5545 recurrence frequencies
+const (
+	FrequencyDaily   = "DAILY"
+	FrequencyWeekly  = "WEEKLY"
+	FrequencyMonthly = "MONTHLY"
+	FrequencyYearly  = "YEARLY"
+)
+
+// Layouts used by RFC 5545 DATE-TIME (UTC form) and DATE values
+const (
+	icalDateTimeLayout = "20060102T150405Z"
+	icalDateLayout     = "20060102"
+)
+
+// maxRecurrenceIterations protects against rules that never produce
+// an instance (e.g. FREQ=MONTHLY starting on the 31st with BYDAY filters)
+const maxRecurrenceIterations = 100000
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+//RecurrenceRule is a parsed RRULE value. Only the FREQ, INTERVAL, BYDAY,
+//UNTIL and COUNT parts are supported
+type RecurrenceRule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Until    time.Time
+	Count    int
+}
+
+//ParseRecurrenceRule parses an RRULE value such as
+//"FREQ=WEEKLY;BYDAY=TU,TH;UNTIL=20201231T235959Z"
+func ParseRecurrenceRule(value string) (rule RecurrenceRule, err error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return rule, errors.New("Empty recurrence rule")
+	}
+
+	rule.Interval = 1
+	for _, part := range strings.Split(value, ";") {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return rule, errors.Errorf("Malformed recurrence rule part %q", part)
+		}
+		key, val := strings.ToUpper(keyValue[0]), strings.ToUpper(keyValue[1])
+
+		switch key {
+		case "FREQ":
+			switch val {
+			case FrequencyDaily, FrequencyWeekly, FrequencyMonthly, FrequencyYearly:
+				rule.Freq = val
+			default:
+				return rule, errors.Errorf("Unsupported recurrence frequency %q", val)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err != nil || rule.Interval < 1 {
+				return rule, errors.Errorf("Invalid recurrence interval %q", val)
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+			if err != nil || rule.Count < 1 {
+				return rule, errors.Errorf("Invalid recurrence count %q", val)
+			}
+		case "UNTIL":
+			rule.Until, err = parseRecurrenceUntil(val)
+			if err != nil {
+				return rule, err
+			}
+		case "BYDAY":
+			for _, code := range strings.Split(val, ",") {
+				weekday, ok := weekdayCodes[code]
+				if !ok {
+					return rule, errors.Errorf("Unsupported BYDAY value %q", code)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "WKST":
+			if val != "MO" {
+				return rule, errors.New("Only WKST=MO is supported")
+			}
+		default:
+			return rule, errors.Errorf("Unsupported recurrence rule part %q", key)
+		}
+	}
+
+	if rule.Freq == "" {
+		return rule, errors.New("Recurrence rule is missing FREQ")
+	}
+	if rule.Count != 0 && !rule.Until.IsZero() {
+		return rule, errors.New("Recurrence rule can not contain both UNTIL and COUNT")
+	}
+	if rule.Freq == FrequencyYearly && len(rule.ByDay) != 0 {
+		return rule, errors.New("BYDAY is not supported with FREQ=YEARLY")
+	}
+
+	return rule, nil
+}
+
+//String formats the rule back into its RRULE value
+func (rule RecurrenceRule) String() string {
+	parts := []string{"FREQ=" + rule.Freq}
+	if rule.Interval > 1 {
+		parts = append(parts, fmt.Sprint("INTERVAL=", rule.Interval))
+	}
+	if len(rule.ByDay) != 0 {
+		codes := make([]string, 0, len(rule.ByDay))
+		for _, weekday := range rule.ByDay {
+			for code, day := range weekdayCodes {
+				if day == weekday {
+					codes = append(codes, code)
+				}
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	if rule.Count != 0 {
+		parts = append(parts, fmt.Sprint("COUNT=", rule.Count))
+	}
+	if !rule.Until.IsZero() {
+		parts = append(parts, "UNTIL="+rule.Until.UTC().Format(icalDateTimeLayout))
+	}
+	return strings.Join(parts, ";")
+}
+
+//Occurrences returns the start times of every instance of the rule that
+//falls in (after, before], skipping the excluded dates. dtstart must be in
+//the location the series is defined in so that the wall clock time is kept
+//across daylight saving changes
+func (rule RecurrenceRule) Occurrences(dtstart time.Time, after time.Time, before time.Time, exDates []time.Time) []time.Time {
+	var occurrences []time.Time
+
+	rule.expand(dtstart, func(start time.Time) bool {
+		if start.After(before) {
+			return false
+		}
+		if start.After(after) && !containsTime(exDates, start) {
+			occurrences = append(occurrences, start)
+		}
+		return true
+	})
+
+	return occurrences
+}
+
+//CountBefore returns how many instances the rule generates before the
+//given time, ignoring EXDATE as RFC 5545 does for COUNT
+func (rule RecurrenceRule) CountBefore(dtstart time.Time, before time.Time) int {
+	count := 0
+	rule.expand(dtstart, func(start time.Time) bool {
+		if !start.Before(before) {
+			return false
+		}
+		count++
+		return true
+	})
+	return count
+}
+
+// expand calls fn with every instance start time in chronological order
+// until fn returns false or the rule is exhausted
+func (rule RecurrenceRule) expand(dtstart time.Time, fn func(time.Time) bool) {
+	interval := rule.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	generated := 0
+
+	emit := func(start time.Time) bool {
+		if start.Before(dtstart) {
+			return true
+		}
+		if !rule.Until.IsZero() && start.After(rule.Until) {
+			return false
+		}
+		if rule.Count != 0 && generated >= rule.Count {
+			return false
+		}
+		generated++
+		return fn(start)
+	}
+
+	year, month, day := dtstart.Date()
+	hour, min, sec := dtstart.Clock()
+	loc := dtstart.Location()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hour, min, sec, 0, loc)
+	}
+
+	for period := 0; period < maxRecurrenceIterations; period++ {
+		var candidates []time.Time
+
+		switch rule.Freq {
+		case FrequencyDaily:
+			start := at(year, month, day+period*interval)
+			if len(rule.ByDay) == 0 || containsWeekday(rule.ByDay, start.Weekday()) {
+				candidates = append(candidates, start)
+			}
+		case FrequencyWeekly:
+			// Weeks start on monday (WKST=MO)
+			offset := (int(dtstart.Weekday()) + 6) % 7
+			weekStart := at(year, month, day-offset+period*interval*7)
+			weekdays := rule.ByDay
+			if len(weekdays) == 0 {
+				weekdays = []time.Weekday{dtstart.Weekday()}
+			}
+			for _, weekday := range weekdays {
+				dayOffset := (int(weekday) + 6) % 7
+				candidates = append(candidates, weekStart.AddDate(0, 0, dayOffset))
+			}
+		case FrequencyMonthly:
+			monthStart := time.Date(year, month+time.Month(period*interval), 1, 0, 0, 0, 0, loc)
+			if len(rule.ByDay) == 0 {
+				start := at(monthStart.Year(), monthStart.Month(), day)
+				// Months without the starting day are skipped
+				if start.Day() == day {
+					candidates = append(candidates, start)
+				}
+			} else {
+				for d := 1; d <= 31; d++ {
+					start := at(monthStart.Year(), monthStart.Month(), d)
+					if start.Month() != monthStart.Month() {
+						break
+					}
+					if containsWeekday(rule.ByDay, start.Weekday()) {
+						candidates = append(candidates, start)
+					}
+				}
+			}
+		case FrequencyYearly:
+			start := at(year+period*interval, month, day)
+			if start.Day() == day {
+				candidates = append(candidates, start)
+			}
+		default:
+			return
+		}
+
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		for _, start := range candidates {
+			if !emit(start) {
+				return
+			}
+		}
+	}
+}
+
+// parseRecurrenceUntil parses an UNTIL value given as a DATE-TIME in UTC
+// form or as a DATE
+func parseRecurrenceUntil(value string) (time.Time, error) {
+	if t, err := time.Parse(icalDateTimeLayout, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(icalDateLayout, value); err == nil {
+		// A DATE UNTIL includes the whole day
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	return time.Time{}, errors.Errorf("Invalid date %q, expected YYYYMMDDTHHMMSSZ", value)
+}
+
+func containsWeekday(weekdays []time.Weekday, weekday time.Weekday) bool {
+	for _, day := range weekdays {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTime(times []time.Time, t time.Time) bool {
+	for _, other := range times {
+		if other.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrenceRule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"FREQ=DAILY", "FREQ=DAILY", false},
+		{"RRULE:freq=weekly;byday=TU,TH;COUNT=6", "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=6", false},
+		{"FREQ=WEEKLY;INTERVAL=1;WKST=MO", "FREQ=WEEKLY", false},
+		{"FREQ=MONTHLY;INTERVAL=2;UNTIL=20210601", "FREQ=MONTHLY;INTERVAL=2;UNTIL=20210601T235959Z", false},
+		{"FREQ=YEARLY;UNTIL=20301231T100000Z", "FREQ=YEARLY;UNTIL=20301231T100000Z", false},
+		{"", "", true},
+		{"FREQ", "", true},
+		{"FREQ=HOURLY", "", true},
+		{"INTERVAL=2", "", true},
+		{"FREQ=DAILY;INTERVAL=0", "", true},
+		{"FREQ=DAILY;COUNT=-1", "", true},
+		{"FREQ=DAILY;COUNT=2;UNTIL=20201231", "", true},
+		{"FREQ=DAILY;UNTIL=2020-12-31", "", true},
+		{"FREQ=WEEKLY;BYDAY=1TU", "", true},
+		{"FREQ=WEEKLY;WKST=SU", "", true},
+		{"FREQ=YEARLY;BYDAY=MO", "", true},
+		{"FREQ=DAILY;BYHOUR=10", "", true},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRecurrenceRule(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseRecurrenceRule(%q) = %s, want an error", test.value, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecurrenceRule(%q) failed: %v", test.value, err)
+			continue
+		}
+		if got := rule.String(); got != test.want {
+			t.Errorf("ParseRecurrenceRule(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	vilnius, err := time.LoadLocation("Europe/Vilnius")
+	if err != nil {
+		t.Skip("time zone data is not available")
+	}
+
+	tests := []struct {
+		name    string
+		rule    string
+		dtstart time.Time
+		after   time.Time
+		before  time.Time
+		exDates []time.Time
+		want    []string
+	}{
+		{
+			name:    "daily with interval and count",
+			rule:    "FREQ=DAILY;INTERVAL=2;COUNT=3",
+			dtstart: time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-10-01T10:00:00Z", "2020-10-03T10:00:00Z", "2020-10-05T10:00:00Z"},
+		},
+		{
+			name:    "daily limited to weekdays",
+			rule:    "FREQ=DAILY;BYDAY=SA,SU;COUNT=3",
+			dtstart: time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-10-03T10:00:00Z", "2020-10-04T10:00:00Z", "2020-10-10T10:00:00Z"},
+		},
+		{
+			name:    "weekly by day skips days before dtstart",
+			rule:    "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=3",
+			dtstart: time.Date(2020, 10, 21, 18, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-10-23T18:00:00Z", "2020-10-26T18:00:00Z", "2020-10-30T18:00:00Z"},
+		},
+		{
+			name:    "weekly count includes excluded dates",
+			rule:    "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=4",
+			dtstart: time.Date(2020, 10, 6, 18, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			exDates: []time.Time{time.Date(2020, 10, 8, 18, 0, 0, 0, time.UTC)},
+			want:    []string{"2020-10-06T18:00:00Z", "2020-10-13T18:00:00Z", "2020-10-15T18:00:00Z"},
+		},
+		{
+			name:    "weekly keeps the wall clock time across daylight saving",
+			rule:    "FREQ=WEEKLY;BYDAY=TU",
+			dtstart: time.Date(2020, 10, 13, 19, 0, 0, 0, vilnius),
+			before:  time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-10-13T16:00:00Z", "2020-10-20T16:00:00Z", "2020-10-27T17:00:00Z"},
+		},
+		{
+			name:    "window is exclusive of after and inclusive of before",
+			rule:    "FREQ=DAILY",
+			dtstart: time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC),
+			after:   time.Date(2020, 10, 2, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2020, 10, 4, 10, 0, 0, 0, time.UTC),
+			want:    []string{"2020-10-03T10:00:00Z", "2020-10-04T10:00:00Z"},
+		},
+		{
+			name:    "monthly skips months without the day",
+			rule:    "FREQ=MONTHLY;UNTIL=20200801",
+			dtstart: time.Date(2020, 1, 31, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-01-31T10:00:00Z", "2020-03-31T10:00:00Z", "2020-05-31T10:00:00Z", "2020-07-31T10:00:00Z"},
+		},
+		{
+			name:    "monthly by day",
+			rule:    "FREQ=MONTHLY;BYDAY=SU;UNTIL=20201130",
+			dtstart: time.Date(2020, 10, 20, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: []string{"2020-10-25T10:00:00Z", "2020-11-01T10:00:00Z", "2020-11-08T10:00:00Z",
+				"2020-11-15T10:00:00Z", "2020-11-22T10:00:00Z", "2020-11-29T10:00:00Z"},
+		},
+		{
+			name:    "until is inclusive",
+			rule:    "FREQ=DAILY;UNTIL=20201003T100000Z",
+			dtstart: time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-10-01T10:00:00Z", "2020-10-02T10:00:00Z", "2020-10-03T10:00:00Z"},
+		},
+		{
+			name:    "yearly on a leap day",
+			rule:    "FREQ=YEARLY;COUNT=2",
+			dtstart: time.Date(2020, 2, 29, 10, 0, 0, 0, time.UTC),
+			before:  time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:    []string{"2020-02-29T10:00:00Z", "2024-02-29T10:00:00Z"},
+		},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRecurrenceRule(test.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var got []string
+		for _, start := range rule.Occurrences(test.dtstart, test.after, test.before, test.exDates) {
+			got = append(got, start.UTC().Format(time.RFC3339))
+		}
+		if !equalStrings(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRecurrenceCountBefore(t *testing.T) {
+	dtstart := time.Date(2020, 10, 20, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule   string
+		before time.Time
+		want   int
+	}{
+		{"FREQ=WEEKLY;BYDAY=TU,TH", dtstart, 0},
+		{"FREQ=WEEKLY;BYDAY=TU,TH", dtstart.Add(time.Second), 1},
+		{"FREQ=WEEKLY;BYDAY=TU,TH", dtstart.AddDate(0, 0, 7), 2},
+		{"FREQ=WEEKLY;BYDAY=TU,TH", dtstart.AddDate(0, 0, 8), 3},
+		{"FREQ=WEEKLY;BYDAY=TU,TH;COUNT=2", dtstart.AddDate(1, 0, 0), 2},
+		{"FREQ=DAILY;UNTIL=20201022T180000Z", dtstart.AddDate(1, 0, 0), 3},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseRecurrenceRule(test.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", test.rule, err)
+		}
+		if got := rule.CountBefore(dtstart, test.before); got != test.want {
+			t.Errorf("%s before %s: got %d, want %d", test.rule, test.before, got, test.want)
+		}
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
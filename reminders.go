@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//NotificationEventReminder is the in-app notification sent before an
+//event starts
+const NotificationEventReminder = "event_reminder"
+
+// defaultReminderOffsets is how long before the start of an event
+// reminders are sent when REMINDER_OFFSETS is not set
+const defaultReminderOffsets = "24h,1h"
+
+//Reminder is a reminder about an upcoming event for one user
+type Reminder struct {
+	User   User
+	Event  Event
+	Offset time.Duration
+	// Subject and Body are written in the time zone of the user
+	Subject string
+	Body    string
+}
+
+//ReminderChannel delivers reminders to users, e.g. by email or push
+type ReminderChannel interface {
+	// Name identifies the channel in the delivery log
+	Name() string
+	// Preference is the notification type users turn off to stop getting
+	// reminders through the channel, empty if it can not be turned off
+	Preference() string
+	Send(reminder Reminder) error
+}
+
+//ReminderDelivery records a reminder sent through a channel. The unique
+//index keeps a reminder from being sent twice, also across restarts.
+//Rescheduled events get their reminders again for the new start time
+type ReminderDelivery struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	EventID       uint      `gorm:"unique_index:idx_reminder_delivery"`
+	UserID        uint      `gorm:"unique_index:idx_reminder_delivery"`
+	StartTime     time.Time `gorm:"unique_index:idx_reminder_delivery"`
+	OffsetMinutes int       `gorm:"unique_index:idx_reminder_delivery"`
+	Channel       string    `gorm:"size:20;unique_index:idx_reminder_delivery"`
+	Error         string    `gorm:"size:255"`
+}
+
+//ParseReminderOffsets parses a comma separated list of durations like
+//"24h,1h" and sorts them from the longest to the shortest
+func ParseReminderOffsets(value string) ([]time.Duration, error) {
+	var offsets []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(part)
+		if err != nil || offset <= 0 {
+			return nil, errors.Errorf("invalid reminder offset %q", part)
+		}
+		offsets = append(offsets, offset)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets, nil
+}
+
+//ReminderChannelsFromEnv sets up the channels that are configured with
+//environment variables. In-app notifications are always sent
+func ReminderChannelsFromEnv() []ReminderChannel {
+	channels := []ReminderChannel{AppChannel{}}
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		channels = append(channels, &EmailChannel{
+			Address:  host + ":" + port,
+			Host:     host,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		})
+	}
+
+	if privateKey := os.Getenv("VAPID_PRIVATE_KEY"); privateKey != "" {
+		push, err := NewPushChannel(privateKey, os.Getenv("VAPID_SUBJECT"))
+		if err != nil {
+			log.Println("Web Push reminders are disabled:", err)
+		} else {
+			channels = append(channels, push)
+		}
+	}
+
+	if path := os.Getenv("REMINDER_LOG_FILE"); path != "" {
+		channels = append(channels, &FileChannel{Path: path})
+	}
+
+	return channels
+}
+
+//SendDueReminders sends the reminders of events that start within one of
+//the reminder offsets. Only the shortest due offset is sent, so an event
+//created an hour before it starts does not get the day before reminder too
+func SendDueReminders(now time.Time) error {
+	if len(reminderOffsets) == 0 {
+		return nil
+	}
+
+	var events []Event
+	err := db.Where("status = ? AND start_time > ? AND start_time <= ?",
+		EventStatusPublished, now, now.Add(reminderOffsets[0])).Find(&events).Error
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		offset := dueReminderOffset(event, now)
+
+		var users []User
+		db.Where("id IN (?)", eventUserIDs(event, 0)).Find(&users)
+		for _, user := range users {
+			sendReminder(newReminder(user, event, offset, now))
+		}
+	}
+	return nil
+}
+
+// dueReminderOffset returns the shortest offset whose time has come
+func dueReminderOffset(event Event, now time.Time) time.Duration {
+	due := reminderOffsets[0]
+	for _, offset := range reminderOffsets {
+		if !event.StartTime.Add(-offset).After(now) {
+			due = offset
+		}
+	}
+	return due
+}
+
+// newReminder writes the reminder text in the time zone of the user
+func newReminder(user User, event Event, offset time.Duration, now time.Time) Reminder {
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	return Reminder{
+		User:    user,
+		Event:   event,
+		Offset:  offset,
+		Subject: fmt.Sprintf("%s starts in %s", eventSummary(event), formatUntil(event.StartTime.Sub(now))),
+		Body: fmt.Sprintf("%s starts at %s", eventSummary(event),
+			event.StartTime.In(location).Format("Monday, January 2 15:04 MST")) + eventLocation(event),
+	}
+}
+
+// eventLocation describes where an event takes place
+func eventLocation(event Event) string {
+	if event.Location == "" {
+		return ""
+	}
+	return " in " + event.Location
+}
+
+// formatUntil rounds the time left until an event to hours or minutes
+func formatUntil(left time.Duration) string {
+	if left >= time.Hour {
+		hours := int(math.Round(left.Hours()))
+		if hours == 1 {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", hours)
+	}
+	minutes := int(math.Ceil(left.Minutes()))
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// sendReminder sends the reminder through every channel the user did not
+// turn off. A delivery is recorded before sending, when it already exists
+// the reminder was sent before and is skipped
+func sendReminder(reminder Reminder) {
+	preferences := notificationPreferences(reminder.User.ID)
+
+	for _, channel := range reminderChannels {
+		if channel.Preference() != "" && !preferences[channel.Preference()] {
+			continue
+		}
+
+		delivery := ReminderDelivery{
+			EventID:       reminder.Event.ID,
+			UserID:        reminder.User.ID,
+			StartTime:     reminder.Event.StartTime,
+			OffsetMinutes: int(reminder.Offset / time.Minute),
+			Channel:       channel.Name(),
+		}
+		if db.Create(&delivery).Error != nil {
+			continue
+		}
+
+		if err := channel.Send(reminder); err != nil {
+			log.Printf("Sending %s reminder to user %d failed: %v", channel.Name(), reminder.User.ID, err)
+			db.Model(&delivery).Updates(ReminderDelivery{Error: truncate(err.Error(), 255)})
+		}
+	}
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+//AppChannel sends reminders as in-app notifications
+type AppChannel struct{}
+
+//Name of the channel
+func (AppChannel) Name() string { return "app" }
+
+//Preference that turns the channel off
+func (AppChannel) Preference() string { return NotificationEventReminder }
+
+//Send records the notification, NotifyUsers pushes it to open streams
+func (AppChannel) Send(reminder Reminder) error {
+	NotifyUsers([]uint{reminder.User.ID}, NotificationEventReminder, reminder.Event.ID, reminder.Subject)
+	return nil
+}
+
+//FileChannel appends reminders to a file, useful for development and tests
+type FileChannel struct {
+	Path string
+}
+
+//Name of the channel
+func (channel *FileChannel) Name() string { return "file" }
+
+//Preference is empty, the file channel can not be turned off
+func (channel *FileChannel) Preference() string { return "" }
+
+//Send appends a line with the reminder
+func (channel *FileChannel) Send(reminder Reminder) error {
+	file, err := os.OpenFile(channel.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s\tuser=%d\tevent=%d\toffset=%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339),
+		reminder.User.ID, reminder.Event.ID, reminder.Offset, reminder.Subject, reminder.Body)
+	return err
+}
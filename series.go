@@ -0,0 +1,617 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// seriesHorizon is how far ahead occurrences of a series are materialized
+// as Event rows. The horizon is extended once less than a day of it is left
+const seriesHorizon = 28 * 24 * time.Hour
+
+// scopeFuture makes edits and deletes of an occurrence apply to every
+// later occurrence of its series as well
+const scopeFuture = "future"
+
+//ErrSeriesNotManaged is returned when a series is changed by a user that
+//does not manage it
+var ErrSeriesNotManaged = errors.New("You do not manage this series")
+
+//EventSeries is the definition of a recurring event. Occurrences are stored
+//as ordinary Event rows pointing back at the series
+type EventSeries struct {
+	ID                uint `gorm:"primary_key"`
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	DeletedAt         *time.Time `json:"-"`
+	CreatorID         uint
+	CreatorName       string
+	Description       string
+	Sport             string
+	SportID           uint
+	GroupID           uint   `gorm:"index"`
+	Level             string `gorm:"size:20"`
+	Location          string
+	StartTime         time.Time
+	EndTime           time.Time
+	Limit             int
+	RRule             string
+	ExDates           string
+	TimeZone          string
+	Visibility        string    `gorm:"size:20"`
+	MaterializedUntil time.Time `json:"-"`
+	Users             []*User   `gorm:"many2many:series_joined;"`
+	// RequiresApproval is copied to every occurrence, a series that needs
+	// approval is joined one occurrence at a time
+	RequiresApproval bool
+}
+
+// location returns the time zone the recurrence rule is expanded in
+func (series *EventSeries) location() *time.Location {
+	loc, err := time.LoadLocation(series.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// exDates parses the comma separated EXDATE list
+func (series *EventSeries) exDates() []time.Time {
+	var dates []time.Time
+	for _, value := range strings.Split(series.ExDates, ",") {
+		if date, err := time.Parse(icalDateTimeLayout, value); err == nil {
+			dates = append(dates, date)
+		}
+	}
+	return dates
+}
+
+// setExDates formats dates into the comma separated EXDATE list
+func (series *EventSeries) setExDates(dates []time.Time) {
+	values := make([]string, 0, len(dates))
+	for _, date := range dates {
+		values = append(values, date.UTC().Format(icalDateTimeLayout))
+	}
+	series.ExDates = strings.Join(values, ",")
+}
+
+//CreateSeries stores a new recurring event using template as the first
+//occurrence and materializes the occurrences inside the horizon
+func CreateSeries(creator User, template Event, rrule string, exDates []time.Time, timeZone string) (series EventSeries, err error) {
+	rule, err := ParseRecurrenceRule(rrule)
+	if err != nil {
+		return series, err
+	}
+	if !template.EndTime.After(template.StartTime) {
+		return series, errors.New("Event must end after it starts")
+	}
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	if _, err = time.LoadLocation(timeZone); err != nil {
+		return series, errors.Errorf("Unknown time zone %q", timeZone)
+	}
+
+	series = EventSeries{
+		CreatorID:        creator.ID,
+		CreatorName:      creator.Username,
+		Description:      template.Description,
+		Sport:            template.Sport,
+		SportID:          template.SportID,
+		GroupID:          template.GroupID,
+		Level:            template.Level,
+		Location:         template.Location,
+		StartTime:        template.StartTime.UTC(),
+		EndTime:          template.EndTime.UTC(),
+		Limit:            template.Limit,
+		RRule:            rule.String(),
+		TimeZone:         timeZone,
+		Visibility:       template.Visibility,
+		RequiresApproval: template.RequiresApproval,
+	}
+	series.setExDates(exDates)
+
+	if err = db.Create(&series).Error; err != nil {
+		return series, err
+	}
+
+	return series, MaterializeSeries(&series, time.Now().Add(seriesHorizon))
+}
+
+//MaterializeSeries creates Event rows for the occurrences of the series
+//that start before horizon and have not been created yet. Users that
+//joined the whole series are added to every new occurrence with room left
+func MaterializeSeries(series *EventSeries, horizon time.Time) error {
+	rule, err := ParseRecurrenceRule(series.RRule)
+	if err != nil {
+		return err
+	}
+
+	var subscribers []*User
+	db.Model(series).Association("Users").Find(&subscribers)
+
+	duration := series.EndTime.Sub(series.StartTime)
+	dtstart := series.StartTime.In(series.location())
+	occurrences := rule.Occurrences(dtstart, series.MaterializedUntil, horizon, series.exDates())
+
+	for _, start := range occurrences {
+		occurrenceStart := start.UTC()
+		occurrence := Event{
+			CreatorName:      series.CreatorName,
+			CreatorID:        series.CreatorID,
+			Description:      series.Description,
+			Sport:            series.Sport,
+			SportID:          series.SportID,
+			GroupID:          series.GroupID,
+			Level:            series.Level,
+			Location:         series.Location,
+			StartTime:        occurrenceStart,
+			EndTime:          start.Add(duration).UTC(),
+			Limit:            series.Limit,
+			Participants:     1,
+			Status:           EventStatusPublished,
+			Visibility:       series.Visibility,
+			SeriesID:         series.ID,
+			OccurrenceStart:  &occurrenceStart,
+			RequiresApproval: series.RequiresApproval,
+		}
+		if err = db.Create(&occurrence).Error; err != nil {
+			return err
+		}
+
+		//Users of the whole series are not added to occurrences that need
+		//approval, they ask to join each of them
+		if occurrence.RequiresApproval {
+			subscribers = nil
+		}
+		for _, user := range subscribers {
+			if occurrence.Limit != 0 && occurrence.Participants >= occurrence.Limit {
+				break
+			}
+			if IsBanned(series.CreatorID, user.ID) {
+				continue
+			}
+			db.Model(&occurrence).Association("Users").Append(user)
+			occurrence.Participants++
+		}
+		countParticipants(&occurrence)
+	}
+
+	series.MaterializedUntil = horizon
+	return db.Model(series).Updates(EventSeries{MaterializedUntil: horizon}).Error
+}
+
+//MaterializeAllSeries extends the rolling horizon of every series that is
+//about to run out of materialized occurrences
+func MaterializeAllSeries() error {
+	horizon := time.Now().Add(seriesHorizon)
+
+	var seriesList []EventSeries
+	if err := db.Where("materialized_until < ?", horizon.Add(-24*time.Hour)).Find(&seriesList).Error; err != nil {
+		return err
+	}
+
+	//One broken series does not stop the others from being materialized
+	var lastErr error
+	for i := range seriesList {
+		if err := MaterializeSeries(&seriesList[i], horizon); err != nil {
+			log.Println(err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+//EditFutureOccurrences applies changes to occurrence and every later
+//occurrence of its series. Unless occurrence is the first one, the series
+//is split in two so the earlier occurrences keep their original schedule.
+//requiresApproval changes whether joining needs approval when it is set.
+//Returns ErrSeriesNotManaged unless userID manages the series
+func EditFutureOccurrences(occurrence Event, changes Event, requiresApproval *bool, userID uint) error {
+	series, err := loadManagedSeries(occurrence, userID)
+	if err != nil {
+		return err
+	}
+	rule, err := ParseRecurrenceRule(series.RRule)
+	if err != nil {
+		return err
+	}
+
+	newStart, newEnd := occurrence.StartTime, occurrence.EndTime
+	if changes.StartTime.Year() != 1 {
+		newStart = changes.StartTime
+	}
+	if changes.EndTime.Year() != 1 {
+		newEnd = changes.EndTime
+	}
+	if !newEnd.After(newStart) {
+		return errors.New("Event must end after it starts")
+	}
+	shift := newStart.Sub(occurrence.StartTime)
+	duration := newEnd.Sub(newStart)
+	splitAt := *occurrence.OccurrenceStart
+
+	target := series
+	if splitAt.After(series.StartTime) {
+		// End the current series right before this occurrence and continue
+		// with a new one from here on
+		var earlier, later []time.Time
+		for _, date := range series.exDates() {
+			if date.Before(splitAt) {
+				earlier = append(earlier, date)
+			} else {
+				later = append(later, date)
+			}
+		}
+
+		dtstart := series.StartTime.In(series.location())
+		endedRule := rule
+		if rule.Count != 0 {
+			endedRule.Count = rule.CountBefore(dtstart, splitAt)
+			rule.Count -= endedRule.Count
+		} else {
+			endedRule.Until = splitAt.Add(-time.Second)
+		}
+		series.RRule = endedRule.String()
+		series.setExDates(earlier)
+		db.Model(&series).Updates(map[string]interface{}{"r_rule": series.RRule, "ex_dates": series.ExDates})
+
+		target = series
+		target.ID = 0
+		target.CreatedAt = time.Time{}
+		target.Users = nil
+		target.StartTime = splitAt
+		target.EndTime = splitAt.Add(occurrence.EndTime.Sub(occurrence.StartTime))
+		target.setExDates(later)
+		if err = db.Create(&target).Error; err != nil {
+			return err
+		}
+
+		var subscribers []*User
+		db.Model(&series).Association("Users").Find(&subscribers)
+		if len(subscribers) != 0 {
+			db.Model(&target).Association("Users").Append(subscribers)
+		}
+	}
+
+	// Moves the series pattern by the same amount the occurrence moved
+	rule.ByDay = shiftWeekdays(rule.ByDay, splitAt.In(target.location()), splitAt.Add(shift).In(target.location()))
+	if !rule.Until.IsZero() {
+		rule.Until = rule.Until.Add(shift)
+	}
+	shiftedExDates := target.exDates()
+	for i := range shiftedExDates {
+		shiftedExDates[i] = shiftedExDates[i].Add(shift)
+	}
+	target.setExDates(shiftedExDates)
+	target.RRule = rule.String()
+	target.StartTime = target.StartTime.Add(shift)
+	target.EndTime = target.StartTime.Add(duration)
+	target.MaterializedUntil = target.MaterializedUntil.Add(shift)
+	if changes.Description != "" {
+		target.Description = changes.Description
+	}
+	if changes.Limit != 0 {
+		target.Limit = changes.Limit
+	}
+	if changes.SportID != 0 {
+		target.SportID, target.Sport = changes.SportID, changes.Sport
+	}
+	if changes.Level != "" {
+		target.Level = changes.Level
+	}
+	if requiresApproval != nil {
+		target.RequiresApproval = *requiresApproval
+	}
+	if err = db.Model(&target).Updates(map[string]interface{}{
+		"r_rule":             target.RRule,
+		"ex_dates":           target.ExDates,
+		"start_time":         target.StartTime,
+		"end_time":           target.EndTime,
+		"materialized_until": target.MaterializedUntil,
+		"description":        target.Description,
+		"limit":              target.Limit,
+		"sport":              target.Sport,
+		"sport_id":           target.SportID,
+		"level":              target.Level,
+		"requires_approval":  target.RequiresApproval,
+	}).Error; err != nil {
+		return err
+	}
+
+	// Moves the already materialized occurrences over to the new series.
+	// Occurrences edited on their own keep their times and details
+	var later []Event
+	db.Where("series_id = ? AND occurrence_start >= ?", occurrence.SeriesID, splitAt).Find(&later)
+	for _, event := range later {
+		movedStart := event.OccurrenceStart.Add(shift)
+		updates := map[string]interface{}{
+			"series_id":        target.ID,
+			"occurrence_start": movedStart,
+			"sequence":         event.Sequence + 1,
+		}
+		if !event.Detached {
+			updates["start_time"] = event.StartTime.Add(shift)
+			updates["end_time"] = event.StartTime.Add(shift).Add(duration)
+			updates["description"] = target.Description
+			updates["limit"] = target.Limit
+			updates["sport"] = target.Sport
+			updates["sport_id"] = target.SportID
+			updates["level"] = target.Level
+			updates["requires_approval"] = target.RequiresApproval
+		}
+		db.Model(&event).Updates(updates)
+	}
+
+	return nil
+}
+
+//DeleteFutureOccurrences ends the series of occurrence right before it and
+//deletes every occurrence from it onwards. Returns ErrSeriesNotManaged
+//unless userID manages the series
+func DeleteFutureOccurrences(occurrence Event, userID uint) error {
+	series, err := loadManagedSeries(occurrence, userID)
+	if err != nil {
+		return err
+	}
+	rule, err := ParseRecurrenceRule(series.RRule)
+	if err != nil {
+		return err
+	}
+	splitAt := *occurrence.OccurrenceStart
+
+	var later []Event
+	db.Where("series_id = ? AND occurrence_start >= ?", series.ID, splitAt).Find(&later)
+	for i := range later {
+		purgeEvent(&later[i])
+	}
+
+	if rule.Count != 0 {
+		rule.Count = rule.CountBefore(series.StartTime.In(series.location()), splitAt)
+	} else {
+		rule.Until = splitAt.Add(-time.Second)
+	}
+
+	// Nothing is left of a series that is deleted from its first occurrence
+	if rule.Count == 0 && !splitAt.After(series.StartTime) {
+		db.Model(&series).Association("Users").Clear()
+		return db.Delete(&series).Error
+	}
+
+	return db.Model(&series).Updates(map[string]interface{}{"r_rule": rule.String()}).Error
+}
+
+//ExcludeOccurrence adds the occurrence to the EXDATE list of its series so
+//it is never materialized again. Series userID does not manage are left alone
+func ExcludeOccurrence(occurrence Event, userID uint) {
+	series, err := loadManagedSeries(occurrence, userID)
+	if err != nil {
+		return
+	}
+	series.setExDates(append(series.exDates(), *occurrence.OccurrenceStart))
+	db.Model(&series).Updates(map[string]interface{}{"ex_dates": series.ExDates})
+}
+
+// loadManagedSeries loads the series of occurrence. The series has to be
+// created by the creator of the occurrence and userID has to manage both
+func loadManagedSeries(occurrence Event, userID uint) (EventSeries, error) {
+	var series EventSeries
+	if occurrence.SeriesID == 0 || occurrence.OccurrenceStart == nil ||
+		db.First(&series, occurrence.SeriesID).RecordNotFound() {
+		return series, errors.New("Event is not part of a series")
+	}
+	if series.CreatorID != occurrence.CreatorID || !CanManageEvent(occurrence, userID) {
+		return series, ErrSeriesNotManaged
+	}
+	return series, nil
+}
+
+// shiftWeekdays moves every weekday by the number of days between from and to
+func shiftWeekdays(weekdays []time.Weekday, from time.Time, to time.Time) []time.Weekday {
+	fromDate := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDate := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	days := int(toDate.Sub(fromDate).Hours() / 24)
+	if days%7 == 0 {
+		return weekdays
+	}
+
+	shifted := make([]time.Weekday, len(weekdays))
+	for i, weekday := range weekdays {
+		shifted[i] = time.Weekday(((int(weekday)+days)%7 + 7) % 7)
+	}
+	return shifted
+}
+
+func GetSeries(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	//Gets id from /series/{id}
+	params := mux.Vars(r)
+	seriesID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var series EventSeries
+	if db.Preload("Users").First(&series, seriesID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var occurrences []Event
+	db.Preload("Users").Scopes(VisibleTo(session.Values["userID"])).
+		Where("series_id = ?", series.ID).Order("start_time").Find(&occurrences)
+
+	//Private series are only shown to users invited to one of the occurrences
+	if series.Visibility == VisibilityPrivate && len(occurrences) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Series      EventSeries
+		Occurrences []Event
+	}{series, occurrences}, w)
+	return
+}
+
+func JoinSeries(w http.ResponseWriter, r *http.Request) {
+	//Get user id from auth token
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets id from /series/{id}/users
+	params := mux.Vars(r)
+	seriesID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+
+	var series EventSeries
+	db.First(&series, seriesID)
+
+	//Check if series and user exist and user is not the creator
+	if series.ID == 0 || user.ID == 0 || series.CreatorID == user.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if IsBanned(series.CreatorID, user.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{ Error string }{ErrBanned.Error()}, w)
+		return
+	}
+
+	//Organizers approve users one occurrence at a time
+	if series.RequiresApproval {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"This series needs approval, ask to join its events instead"}, w)
+		return
+	}
+
+	//Members series can only be joined by members of the group
+	if series.Visibility == VisibilityMembers && !IsGroupMember(series.GroupID, user.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Private series can be joined by users invited to one of the occurrences
+	if series.Visibility == VisibilityPrivate {
+		var invited int
+		db.Model(&Event{}).Scopes(VisibleTo(user.ID)).Where("series_id = ?", series.ID).Count(&invited)
+		if invited == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+	}
+
+	db.Model(&series).Association("Users").Append(&user)
+
+	//Joins every upcoming occurrence the user could join on its own. Full,
+	//unpublished, hidden and detached occurrences are skipped, as are the
+	//ones that need approval or an invitation the user does not have
+	var occurrences []Event
+	db.Preload("Users").Where("series_id = ? AND start_time > ?", series.ID, time.Now()).Find(&occurrences)
+	for i := range occurrences {
+		occurrence := &occurrences[i]
+		if occurrence.Detached || occurrence.RequiresApproval || hasUser(occurrence.Users, user.ID) {
+			continue
+		}
+		if JoinableBy(*occurrence, user) != nil || !AuthorizeJoin(*occurrence, user, "") {
+			continue
+		}
+		AddParticipant(occurrence, &user)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+func LeaveSeries(w http.ResponseWriter, r *http.Request) {
+	//Get user id from auth token
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets id from /series/{id}/users
+	params := mux.Vars(r)
+	seriesID, err := strconv.Atoi(params["id"])
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var user User
+	db.First(&user, session.Values["userID"].(uint))
+
+	var series EventSeries
+	db.First(&series, seriesID)
+
+	if series.ID == 0 || user.ID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	db.Model(&series).Association("Users").Delete(&user)
+
+	//Leaves every upcoming occurrence
+	var occurrences []Event
+	db.Preload("Users").Where("series_id = ? AND start_time > ?", series.ID, time.Now()).Find(&occurrences)
+	for _, occurrence := range occurrences {
+		if !hasUser(occurrence.Users, user.ID) {
+			continue
+		}
+		db.Model(&occurrence).Association("Users").Delete(&user)
+		RemoveFromTeams(occurrence.ID, user.ID)
+		countParticipants(&occurrence)
+		PromoteFromWaitlist(&occurrence)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+// hasUser checks if a user with the given id is in users
+func hasUser(users []*User, userID uint) bool {
+	for _, user := range users {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Skill levels of events and of users in a sport
+const (
+	LevelBeginner     = "beginner"
+	LevelIntermediate = "intermediate"
+	LevelAdvanced     = "advanced"
+)
+
+//Sport is an entry of the sports catalog events are created in
+type Sport struct {
+	ID uint `gorm:"primary_key"`
+	// Slug is the stable name of the sport used by clients, e.g. basketball
+	Slug   string `gorm:"size:30;unique_index"`
+	Name   string `gorm:"size:50"`
+	NameLT string `gorm:"size:50"`
+	Icon   string `gorm:"size:100"`
+	// MinPlayers and MaxPlayers bound the participant limit of events,
+	// 0 when the sport has no bound
+	MinPlayers int
+	MaxPlayers int
+	// TeamSize is the number of players in a team, 0 for individual sports
+	TeamSize int
+}
+
+//UserSport is a sport the user plays with their own assessment of their level
+type UserSport struct {
+	ID      uint   `gorm:"primary_key"`
+	UserID  uint   `gorm:"unique_index:idx_user_sport"`
+	SportID uint   `gorm:"unique_index:idx_user_sport"`
+	Sport   Sport  `gorm:"foreignkey:SportID"`
+	Level   string `gorm:"size:20"`
+}
+
+// defaultSports is the catalog the database is seeded with
+var defaultSports = []Sport{
+	{Slug: "basketball", Name: "Basketball", NameLT: "Krepšinis", Icon: "basketball", MinPlayers: 2, MaxPlayers: 10, TeamSize: 5},
+	{Slug: "football", Name: "Football", NameLT: "Futbolas", Icon: "football", MinPlayers: 2, MaxPlayers: 22, TeamSize: 11},
+	{Slug: "volleyball", Name: "Volleyball", NameLT: "Tinklinis", Icon: "volleyball", MinPlayers: 4, MaxPlayers: 12, TeamSize: 6},
+	{Slug: "tennis", Name: "Tennis", NameLT: "Tenisas", Icon: "tennis", MinPlayers: 2, MaxPlayers: 4},
+	{Slug: "table-tennis", Name: "Table tennis", NameLT: "Stalo tenisas", Icon: "table-tennis", MinPlayers: 2, MaxPlayers: 4},
+	{Slug: "badminton", Name: "Badminton", NameLT: "Badmintonas", Icon: "badminton", MinPlayers: 2, MaxPlayers: 4},
+	{Slug: "running", Name: "Running", NameLT: "Bėgimas", Icon: "running"},
+	{Slug: "cycling", Name: "Cycling", NameLT: "Dviračių sportas", Icon: "cycling"},
+	{Slug: "swimming", Name: "Swimming", NameLT: "Plaukimas", Icon: "swimming"},
+	{Slug: "hockey", Name: "Hockey", NameLT: "Ledo ritulys", Icon: "hockey", MinPlayers: 2, MaxPlayers: 12, TeamSize: 6},
+}
+
+// Reasons an event does not fit the catalog
+var (
+	ErrUnknownSport = errors.New("Unknown sport")
+	ErrUnknownLevel = errors.New("Level must be beginner, intermediate or advanced")
+)
+
+//SeedSports adds the default sports missing from the catalog
+func SeedSports() {
+	for _, sport := range defaultSports {
+		db.Where(Sport{Slug: sport.Slug}).FirstOrCreate(&sport)
+	}
+}
+
+//GetSports lists the sports catalog. Names are in Lithuanian with ?lang=lt
+func GetSports(w http.ResponseWriter, r *http.Request) {
+	sports := []Sport{}
+	db.Order("name").Find(&sports)
+
+	if r.URL.Query().Get("lang") == "lt" {
+		for i := range sports {
+			if sports[i].NameLT != "" {
+				sports[i].Name = sports[i].NameLT
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(sports, w)
+	return
+}
+
+//CreateSport adds a sport to the catalog. Admins only
+func CreateSport(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var sport Sport
+	json.NewDecoder(r.Body).Decode(&sport)
+	sport.ID = 0
+	if !validSport(sport) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	if !db.Where("slug = ?", sport.Slug).First(&Sport{}).RecordNotFound() {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Sport already exists"}, w)
+		return
+	}
+	db.Create(&sport)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(sport, w)
+	return
+}
+
+//EditSport changes a sport of the catalog. Events keep the name they were
+//created with. Admins only
+func EditSport(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	//Gets id from /sports/{id}
+	var sport Sport
+	if db.First(&sport, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Fields missing from the body keep their values
+	updated := sport
+	json.NewDecoder(r.Body).Decode(&updated)
+	updated.ID = sport.ID
+	updated.Slug = sport.Slug
+	if !validSport(updated) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	db.Save(&updated)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(updated, w)
+	return
+}
+
+//DeleteSport removes a sport no event uses from the catalog. Admins only
+func DeleteSport(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	//Gets id from /sports/{id}
+	var sport Sport
+	if db.First(&sport, mux.Vars(r)["id"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var count int
+	db.Unscoped().Model(&Event{}).Where("sport_id = ?", sport.ID).Count(&count)
+	if count != 0 {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Sport is used by events"}, w)
+		return
+	}
+
+	db.Where("sport_id = ?", sport.ID).Delete(UserSport{})
+	db.Delete(&sport)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//GetUserSports lists the sports of a user. Defaults to the logged in user
+func GetUserSports(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	var userID uint
+	if id := r.URL.Query().Get("id"); id != "" {
+		parsed, err := strconv.Atoi(id)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		userID = uint(parsed)
+	} else if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(userSports(userID), w)
+	return
+}
+
+//SetUserSport adds a sport to the profile of the logged in user or changes
+//their level in it. e.x {"Level": "intermediate"}
+func SetUserSport(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	userID := session.Values["userID"].(uint)
+
+	//Gets sport id from /account/sports/{sportID}
+	var sport Sport
+	if db.First(&sport, mux.Vars(r)["sportID"]).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		Level string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	if !validLevel(requestData.Level) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{ErrUnknownLevel.Error()}, w)
+		return
+	}
+
+	var userSport UserSport
+	db.Where(UserSport{UserID: userID, SportID: sport.ID}).FirstOrInit(&userSport)
+	userSport.Level = requestData.Level
+	db.Save(&userSport)
+	userSport.Sport = sport
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(userSport, w)
+	return
+}
+
+//DeleteUserSport removes a sport from the profile of the logged in user
+func DeleteUserSport(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	if session.Values["userID"] == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	//Gets sport id from /account/sports/{sportID}
+	if db.Where("user_id = ? AND sport_id = ?", session.Values["userID"], mux.Vars(r)["sportID"]).
+		Delete(UserSport{}).RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//ApplySport checks the sport, level and limit of an event against the
+//catalog. The sport can be given by id or by its slug or name, either way
+//both SportID and Sport are filled in. Events without a sport are allowed
+func ApplySport(event *Event) error {
+	if !validLevel(event.Level) && event.Level != "" {
+		return ErrUnknownLevel
+	}
+	if event.SportID == 0 && event.Sport == "" {
+		return nil
+	}
+
+	var sport Sport
+	var notFound bool
+	if event.SportID != 0 {
+		notFound = db.First(&sport, event.SportID).RecordNotFound()
+	} else {
+		name := strings.TrimSpace(event.Sport)
+		notFound = db.Where("LOWER(slug) = LOWER(?) OR LOWER(name) = LOWER(?) OR LOWER(name_lt) = LOWER(?)",
+			name, name, name).First(&sport).RecordNotFound()
+	}
+	if notFound {
+		return ErrUnknownSport
+	}
+	event.SportID = sport.ID
+	event.Sport = sport.Name
+
+	//Events of sports with a player range get the largest one by default
+	if event.Limit == 0 {
+		event.Limit = sport.MaxPlayers
+	}
+	if event.Limit != 0 && event.Limit < sport.MinPlayers {
+		return errors.Errorf("%s events are for at least %d players", sport.Name, sport.MinPlayers)
+	}
+	if sport.MaxPlayers != 0 && event.Limit > sport.MaxPlayers {
+		return errors.Errorf("%s events are for at most %d players", sport.Name, sport.MaxPlayers)
+	}
+	return nil
+}
+
+// userSports loads the sports of a user
+func userSports(userID uint) []UserSport {
+	sports := []UserSport{}
+	db.Preload("Sport").Where("user_id = ?", userID).Order("id").Find(&sports)
+	return sports
+}
+
+// validLevel checks a skill level of an event or user
+func validLevel(level string) bool {
+	return level == LevelBeginner || level == LevelIntermediate || level == LevelAdvanced
+}
+
+// validSport checks a sport of the catalog
+func validSport(sport Sport) bool {
+	return sport.Slug != "" && len(sport.Slug) <= 30 && sport.Name != "" && len(sport.Name) <= 50 &&
+		len(sport.NameLT) <= 50 && len(sport.Icon) <= 100 && sport.MinPlayers >= 0 && sport.TeamSize >= 0 &&
+		(sport.MaxPlayers == 0 || sport.MaxPlayers >= sport.MinPlayers)
+}
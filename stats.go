@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Badges users earn
+const (
+	BadgeFirstEvent = "first_event"
+	BadgeTenGames   = "ten_games"
+	BadgeOrganizer  = "organizer"
+)
+
+// Limits of the stats job
+const (
+	// statsBatchSize is how many events and users a run looks at
+	statsBatchSize = 500
+	// badgeNotifyAfter is how recent the last game of a user has to be for
+	// new badges to notify them
+	badgeNotifyAfter = 7 * 24 * time.Hour
+)
+
+// NotificationBadgeAwarded lets users know they earned a badge
+const NotificationBadgeAwarded = "badge_awarded"
+
+// badgeRule awards a badge to users whose stats reach it
+type badgeRule struct {
+	badge  string
+	title  string
+	earned func(stats UserStats) bool
+}
+
+// badgeRules are the badges users can earn, in the order they are listed
+var badgeRules = []badgeRule{
+	{BadgeFirstEvent, "First event", func(stats UserStats) bool { return stats.GamesPlayed >= 1 }},
+	{BadgeTenGames, "10 games", func(stats UserStats) bool { return stats.GamesPlayed >= 10 }},
+	{BadgeOrganizer, "Organizer of 5 events", func(stats UserStats) bool { return stats.EventsOrganized >= 5 }},
+}
+
+//UserStats sums up the finished events a user played and organized. The
+//update_user_stats job recalculates users whose events changed, so the
+//stats are not counted on every request
+type UserStats struct {
+	UserID    uint `gorm:"primary_key;auto_increment:false"`
+	UpdatedAt time.Time
+	// GamesPlayed counts the finished events the user organized or joined
+	// and did not miss
+	GamesPlayed     int
+	EventsOrganized int
+	HoursPlayed     float64
+	// AttendanceRate is the share of marked events the user came to, from
+	// 0 to 1, or -1 when no attendance was recorded yet
+	AttendanceRate float64
+	// Streaks count weeks in a row, in the time zone of the user, with at
+	// least one game. The current streak ends when a week is skipped
+	CurrentStreak int
+	LongestStreak int
+	LastPlayedAt  *time.Time
+	// Stale users are recalculated by the next run of the job
+	Stale  bool             `json:"-" gorm:"index"`
+	Sports []UserSportStats `gorm:"-"`
+	Badges []UserBadge      `gorm:"-"`
+}
+
+//UserSportStats counts the games a user played of one sport
+type UserSportStats struct {
+	ID      uint `gorm:"primary_key"`
+	UserID  uint `gorm:"index"`
+	SportID uint
+	// Sport is the name of the sport, events without one from the catalog
+	// use the name they were created with
+	Sport string `gorm:"size:50"`
+	Games int
+	Hours float64
+}
+
+//UserBadge is a badge a user earned. Badges are kept when the stats that
+//earned them drop again, e.g. when old events are purged
+type UserBadge struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"unique_index:idx_user_badge"`
+	Badge     string `gorm:"size:30;unique_index:idx_user_badge"`
+	Title     string `gorm:"-"`
+	AwardedAt time.Time
+}
+
+//GetUserStats returns the stats and badges of a user. Defaults to the
+//logged in user when no id is given. e.x ?id=4
+func GetUserStats(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+
+	var userID uint
+	if id := r.URL.Query().Get("id"); id != "" {
+		parsed, err := strconv.Atoi(id)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			JSONResponse(struct{}{}, w)
+			return
+		}
+		userID = uint(parsed)
+	} else if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var user User
+	if db.First(&user, userID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(GetUserStatsOf(user), w)
+	return
+}
+
+//GetUserStatsOf loads the stats the job calculated for the user. Users it
+//did not get to yet have empty stats
+func GetUserStatsOf(user User) UserStats {
+	stats := UserStats{UserID: user.ID, AttendanceRate: -1}
+	db.Where("user_id = ?", user.ID).First(&stats)
+
+	stats.Sports = []UserSportStats{}
+	db.Where("user_id = ?", user.ID).Order("games DESC, sport").Find(&stats.Sports)
+	stats.Badges = []UserBadge{}
+	db.Where("user_id = ?", user.ID).Order("awarded_at, id").Find(&stats.Badges)
+	for i := range stats.Badges {
+		stats.Badges[i].Title = badgeTitle(stats.Badges[i].Badge)
+	}
+
+	//The streak was counted when the user last played, it is over once
+	//a whole week went by without a game
+	if stats.LastPlayedAt != nil {
+		location := userLocation(user)
+		lastWeek := weekStart(*stats.LastPlayedAt, location)
+		if lastWeek.AddDate(0, 0, 7).Before(weekStart(time.Now(), location)) {
+			stats.CurrentStreak = 0
+		}
+	}
+	return stats
+}
+
+//UpdateUserStats marks the organizers and participants of newly finished
+//events for recalculation and recalculates a batch of marked users. Every
+//finished event is only looked at once
+func UpdateUserStats() error {
+	var eventIDs []uint
+	err := db.Model(&Event{}).Where("status = ? AND stats_counted = ?", EventStatusFinished, false).
+		Order("id").Limit(statsBatchSize).Pluck("id", &eventIDs).Error
+	if err != nil {
+		return err
+	}
+	if len(eventIDs) != 0 {
+		var userIDs, joined []uint
+		db.Model(&Event{}).Where("id IN (?)", eventIDs).Pluck("creator_id", &userIDs)
+		db.Table("events_joined").Where("event_id IN (?)", eventIDs).Pluck("user_id", &joined)
+		MarkStatsStale(append(userIDs, joined...)...)
+		//UpdateColumns leaves updated_at alone, the events did not change
+		err = db.Model(&Event{}).Where("id IN (?)", eventIDs).UpdateColumns(map[string]interface{}{"stats_counted": true}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var stale []uint
+	err = db.Model(&UserStats{}).Where("stale = ?", true).Order("user_id").Limit(statsBatchSize).Pluck("user_id", &stale).Error
+	if err != nil {
+		return err
+	}
+	for _, userID := range stale {
+		if err := RecalculateUserStats(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//MarkStatsStale makes the next run of the update_user_stats job
+//recalculate the users
+func MarkStatsStale(userIDs ...uint) {
+	if len(userIDs) == 0 {
+		return
+	}
+	db.Model(&UserStats{}).Where("user_id IN (?)", userIDs).UpdateColumns(map[string]interface{}{"stale": true})
+
+	var existing []uint
+	db.Model(&UserStats{}).Where("user_id IN (?)", userIDs).Pluck("user_id", &existing)
+	known := map[uint]bool{}
+	for _, userID := range existing {
+		known[userID] = true
+	}
+	for _, userID := range userIDs {
+		if !known[userID] {
+			known[userID] = true
+			db.Create(&UserStats{UserID: userID, AttendanceRate: -1, Stale: true})
+		}
+	}
+}
+
+//RecalculateUserStats counts the stats of a user again from their finished
+//events and awards the badges they reached
+func RecalculateUserStats(userID uint) error {
+	//Clears the mark first, so users marked while counting are counted
+	//again by the next run
+	db.Model(&UserStats{}).Where("user_id = ?", userID).UpdateColumns(map[string]interface{}{"stale": false})
+
+	var user User
+	if db.First(&user, userID).RecordNotFound() {
+		db.Where("user_id = ?", userID).Delete(UserStats{})
+		db.Where("user_id = ?", userID).Delete(UserSportStats{})
+		return nil
+	}
+	location := userLocation(user)
+
+	var events []Event
+	err := db.Select("id, creator_id, sport, sport_id, start_time, end_time").
+		Where("status = ? AND (creator_id = ? OR id IN (SELECT event_id FROM events_joined "+
+			"WHERE user_id = ? AND (attendance IS NULL OR attendance <> ?)))",
+			EventStatusFinished, userID, userID, AttendanceNoShow).
+		Order("start_time").Find(&events).Error
+	if err != nil {
+		return err
+	}
+
+	var catalog []Sport
+	db.Find(&catalog)
+	sportNames := map[uint]string{}
+	for _, sport := range catalog {
+		sportNames[sport.ID] = sport.Name
+	}
+
+	stats := UserStats{UserID: userID, AttendanceRate: GetAttendanceStatsOf(userID).Reliability}
+	sports := map[string]*UserSportStats{}
+	var lastEnd time.Time
+	var previousWeek time.Time
+	streak := 0
+	for _, event := range events {
+		hours := event.EndTime.Sub(event.StartTime).Hours()
+		stats.GamesPlayed++
+		stats.HoursPlayed += hours
+		if event.CreatorID == userID {
+			stats.EventsOrganized++
+		}
+
+		name := sportNames[event.SportID]
+		if name == "" {
+			name = event.Sport
+		}
+		if sports[name] == nil {
+			sports[name] = &UserSportStats{UserID: userID, SportID: event.SportID, Sport: truncate(name, 50)}
+		}
+		sports[name].Games++
+		sports[name].Hours += hours
+
+		//Events are sorted by start, so weeks come in order
+		week := weekStart(event.StartTime, location)
+		if !week.Equal(previousWeek) {
+			if !previousWeek.IsZero() && previousWeek.AddDate(0, 0, 7).Equal(week) {
+				streak++
+			} else {
+				streak = 1
+			}
+			previousWeek = week
+		}
+		if streak > stats.LongestStreak {
+			stats.LongestStreak = streak
+		}
+		startTime := event.StartTime
+		stats.LastPlayedAt = &startTime
+		if event.EndTime.After(lastEnd) {
+			lastEnd = event.EndTime
+		}
+	}
+	stats.CurrentStreak = streak
+	stats.HoursPlayed = roundHours(stats.HoursPlayed)
+
+	db.Where(UserStats{UserID: userID}).FirstOrCreate(&UserStats{UserID: userID})
+	err = db.Model(&UserStats{}).Where("user_id = ?", userID).Updates(map[string]interface{}{
+		"games_played":     stats.GamesPlayed,
+		"events_organized": stats.EventsOrganized,
+		"hours_played":     stats.HoursPlayed,
+		"attendance_rate":  stats.AttendanceRate,
+		"current_streak":   stats.CurrentStreak,
+		"longest_streak":   stats.LongestStreak,
+		"last_played_at":   stats.LastPlayedAt,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	db.Where("user_id = ?", userID).Delete(UserSportStats{})
+	names := make([]string, 0, len(sports))
+	for name := range sports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sports[name].Hours = roundHours(sports[name].Hours)
+		db.Create(sports[name])
+	}
+
+	//Badges reached by counting old events the first time are awarded
+	//quietly, only recent games notify the user
+	notify := time.Since(lastEnd) < badgeNotifyAfter
+	for _, rule := range badgeRules {
+		if !rule.earned(stats) {
+			continue
+		}
+		badge := UserBadge{UserID: userID, Badge: rule.badge}
+		if !db.Where(badge).First(&UserBadge{}).RecordNotFound() {
+			continue
+		}
+		badge.AwardedAt = time.Now()
+		if db.Create(&badge).Error == nil && notify {
+			NotifyUsers([]uint{userID}, NotificationBadgeAwarded, 0,
+				fmt.Sprintf("You earned the %s badge", rule.title))
+		}
+	}
+	return nil
+}
+
+// badgeTitle is the name of a badge shown to users
+func badgeTitle(badge string) string {
+	for _, rule := range badgeRules {
+		if rule.badge == badge {
+			return rule.title
+		}
+	}
+	return badge
+}
+
+// userLocation is the time zone of the user, UTC when it is not set
+func userLocation(user User) *time.Location {
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// weekStart is the midnight of the Monday of the week of t
+func weekStart(t time.Time, location *time.Location) time.Time {
+	t = t.In(location)
+	year, month, day := t.Date()
+	return time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, location)
+}
+
+// roundHours rounds hours to one decimal
+func roundHours(hours float64) float64 {
+	return math.Round(hours*10) / 10
+}
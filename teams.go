@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Strategies for splitting participants into teams
+const (
+	TeamStrategyRandom   = "random"
+	TeamStrategyBalanced = "balanced"
+	TeamStrategyFriends  = "friends"
+)
+
+// Skill levels participants declare when joining, from 1 to 5.
+// Participants that did not declare one count as average
+const (
+	minSkillLevel     = 1
+	maxSkillLevel     = 5
+	defaultSkillLevel = 3
+)
+
+// levelSkills turns the level users gave themselves in a sport into the
+// skill level of participants that did not declare one when joining
+var levelSkills = map[string]int{
+	LevelBeginner:     1,
+	LevelIntermediate: 3,
+	LevelAdvanced:     5,
+}
+
+//NotificationTeamsLocked tells players which team they are in
+const NotificationTeamsLocked = "teams_locked"
+
+//UpdateTeamsChanged is pushed when the lineup of an event changes
+const UpdateTeamsChanged = "teams_changed"
+
+//Team is a team of players of an event
+type Team struct {
+	ID      uint `gorm:"primary_key"`
+	EventID uint `gorm:"index"`
+	Number  int
+	Name    string  `gorm:"size:50"`
+	Members []*User `gorm:"many2many:team_members;"`
+}
+
+// teamPlayer is a participant being placed in a team
+type teamPlayer struct {
+	user  User
+	skill int
+}
+
+// teamUnit are players that go to the same team, e.g. friends
+type teamUnit []teamPlayer
+
+//CreateTeams splits the creator and participants of an event into teams.
+//The body has the number of teams, the strategy and for the friends
+//strategy the groups of user ids that play together. e.x
+//{"Count": 2, "Strategy": "friends", "Groups": [[3, 4]]}
+func CreateTeams(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadTeamsEvent(w, r)
+	if !ok {
+		return
+	}
+
+	requestData := struct {
+		Count    int
+		Strategy string
+		Groups   [][]uint
+		Names    []string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	if requestData.Strategy == "" {
+		requestData.Strategy = TeamStrategyRandom
+	}
+
+	players := teamPlayers(event)
+	//Without a count the team size of the sport decides it
+	var sport Sport
+	if requestData.Count == 0 && event.SportID != 0 && !db.First(&sport, event.SportID).RecordNotFound() &&
+		sport.TeamSize != 0 {
+		requestData.Count = len(players) / sport.TeamSize
+		if requestData.Count < 2 {
+			requestData.Count = 2
+		}
+	}
+	if requestData.Count < 2 || requestData.Count > len(players) {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{fmt.Sprintf("Count must be between 2 and %d", len(players))}, w)
+		return
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var lineup [][]teamPlayer
+	switch requestData.Strategy {
+	case TeamStrategyRandom:
+		random.Shuffle(len(players), func(i, j int) { players[i], players[j] = players[j], players[i] })
+		lineup = make([][]teamPlayer, requestData.Count)
+		for i, player := range players {
+			lineup[i%requestData.Count] = append(lineup[i%requestData.Count], player)
+		}
+	case TeamStrategyBalanced:
+		lineup = SplitTeams(singleUnits(players), requestData.Count, random)
+	case TeamStrategyFriends:
+		lineup = SplitTeams(friendUnits(players, requestData.Groups), requestData.Count, random)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{ Error string }{"Unknown strategy " + requestData.Strategy}, w)
+		return
+	}
+
+	//Replaces the previous lineup
+	deleteTeams(event.ID)
+	for i, members := range lineup {
+		team := Team{EventID: event.ID, Number: i + 1, Name: fmt.Sprintf("Team %d", i+1)}
+		if i < len(requestData.Names) && requestData.Names[i] != "" {
+			team.Name = truncate(requestData.Names[i], 50)
+		}
+		db.Create(&team)
+		//Members are appended after the insert so their user rows are not saved again
+		users := make([]*User, len(members))
+		for j := range members {
+			users[j] = &members[j].user
+		}
+		db.Model(&team).Association("Members").Append(users)
+	}
+
+	teams := loadTeams(event.ID)
+	PublishEventUpdate(event, UpdateTeamsChanged, teams)
+
+	w.WriteHeader(http.StatusCreated)
+	JSONResponse(teams, w)
+	return
+}
+
+//GetTeams returns the teams of an event
+func GetTeams(w http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "Access-token")
+	var userID uint
+	if session.Values["userID"] != nil {
+		userID = session.Values["userID"].(uint)
+	}
+
+	//Gets id from /events/{id}/teams
+	eventID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var event Event
+	if db.First(&event, eventID).RecordNotFound() || !CanViewEvent(event, userID, r.URL.Query().Get("invite")) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct {
+		Teams  []Team
+		Locked bool
+	}{loadTeams(event.ID), event.TeamsLocked}, w)
+	return
+}
+
+//MoveTeamPlayer moves a player to another team of the event
+func MoveTeamPlayer(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadTeamsEvent(w, r)
+	if !ok {
+		return
+	}
+
+	//Gets ids from /events/{id}/teams/{teamID}/users/{userID}
+	params := mux.Vars(r)
+	teamID, err1 := strconv.Atoi(params["teamID"])
+	userID, err2 := strconv.Atoi(params["userID"])
+	if err1 != nil || err2 != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var team Team
+	if db.First(&team, "id = ? AND event_id = ?", teamID, event.ID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	var user User
+	if db.First(&user, userID).RecordNotFound() || (user.ID != event.CreatorID && !isParticipant(event.ID, user.ID)) {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	RemoveFromTeams(event.ID, user.ID)
+	db.Model(&team).Association("Members").Append(&user)
+
+	teams := loadTeams(event.ID)
+	PublishEventUpdate(event, UpdateTeamsChanged, teams)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(teams, w)
+	return
+}
+
+//RenameTeam changes the name of a team
+func RenameTeam(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadTeamsEvent(w, r)
+	if !ok {
+		return
+	}
+
+	var team Team
+	if db.First(&team, "id = ? AND event_id = ?", mux.Vars(r)["teamID"], event.ID).RecordNotFound() {
+		w.WriteHeader(http.StatusNotFound)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+
+	requestData := struct {
+		Name string
+	}{}
+	json.NewDecoder(r.Body).Decode(&requestData)
+	if requestData.Name == "" || len(requestData.Name) > 50 {
+		w.WriteHeader(http.StatusBadRequest)
+		JSONResponse(struct{}{}, w)
+		return
+	}
+	db.Model(&team).Updates(Team{Name: requestData.Name})
+	db.Model(&team).Association("Members").Find(&team.Members)
+
+	PublishEventUpdate(event, UpdateTeamsChanged, loadTeams(event.ID))
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(team, w)
+	return
+}
+
+//DeleteTeams removes the teams of an event
+func DeleteTeams(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadTeamsEvent(w, r)
+	if !ok {
+		return
+	}
+
+	deleteTeams(event.ID)
+	PublishEventUpdate(event, UpdateTeamsChanged, []Team{})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//LockTeams locks the lineup and tells every player their team
+func LockTeams(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadTeamsEvent(w, r)
+	if !ok {
+		return
+	}
+
+	teams := loadTeams(event.ID)
+	if len(teams) == 0 {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The event has no teams"}, w)
+		return
+	}
+
+	db.Model(&event).Updates(Event{TeamsLocked: true})
+
+	for _, team := range teams {
+		var userIDs []uint
+		for _, member := range team.Members {
+			if member.ID == event.CreatorID {
+				continue
+			}
+			userIDs = append(userIDs, member.ID)
+		}
+		NotifyUsers(userIDs, NotificationTeamsLocked, event.ID,
+			fmt.Sprintf("You play in %s at %s", team.Name, eventSummary(event)))
+	}
+	PublishEventUpdate(event, UpdateTeamsChanged, teams)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(teams, w)
+	return
+}
+
+//UnlockTeams lets the creator change a locked lineup again
+func UnlockTeams(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	db.Model(&event).Updates(map[string]interface{}{"teams_locked": false})
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(struct{}{}, w)
+	return
+}
+
+//SplitTeams places units of players in count teams. Bigger units are placed
+//first, each in the team with the fewest players and then the lowest total
+//skill, so teams end up with even sizes and similar strength. Units larger
+//than a team are split
+func SplitTeams(units []teamUnit, count int, random *rand.Rand) [][]teamPlayer {
+	players := 0
+	for _, unit := range units {
+		players += len(unit)
+	}
+	capacity := (players + count - 1) / count
+
+	//Splits units that do not fit in a team
+	var placed []teamUnit
+	for _, unit := range units {
+		for len(unit) > capacity {
+			placed = append(placed, unit[:capacity])
+			unit = unit[capacity:]
+		}
+		placed = append(placed, unit)
+	}
+
+	//Shuffles first so players of equal skill are not always placed alike
+	random.Shuffle(len(placed), func(i, j int) { placed[i], placed[j] = placed[j], placed[i] })
+	sort.SliceStable(placed, func(i, j int) bool {
+		if len(placed[i]) != len(placed[j]) {
+			return len(placed[i]) > len(placed[j])
+		}
+		return placed[i].skill() > placed[j].skill()
+	})
+
+	teams := make([][]teamPlayer, count)
+	skills := make([]int, count)
+	for _, unit := range placed {
+		best := -1
+		for i := range teams {
+			if len(teams[i])+len(unit) > capacity {
+				continue
+			}
+			if best == -1 || len(teams[i]) < len(teams[best]) ||
+				(len(teams[i]) == len(teams[best]) && skills[i] < skills[best]) {
+				best = i
+			}
+		}
+		//Every team is too full for the unit, it goes to the smallest one
+		if best == -1 {
+			best = 0
+			for i := range teams {
+				if len(teams[i]) < len(teams[best]) {
+					best = i
+				}
+			}
+		}
+		teams[best] = append(teams[best], unit...)
+		skills[best] += unit.skill()
+	}
+	return teams
+}
+
+// skill is the total skill of the unit
+func (unit teamUnit) skill() int {
+	total := 0
+	for _, player := range unit {
+		total += player.skill
+	}
+	return total
+}
+
+// singleUnits puts every player in a unit of their own
+func singleUnits(players []teamPlayer) []teamUnit {
+	units := make([]teamUnit, len(players))
+	for i, player := range players {
+		units[i] = teamUnit{player}
+	}
+	return units
+}
+
+// friendUnits puts the players of each group in one unit. Ids that are not
+// players are ignored and a player is only in the first group they are in
+func friendUnits(players []teamPlayer, groups [][]uint) []teamUnit {
+	byID := map[uint]teamPlayer{}
+	for _, player := range players {
+		byID[player.user.ID] = player
+	}
+
+	var units []teamUnit
+	used := map[uint]bool{}
+	for _, group := range groups {
+		var unit teamUnit
+		for _, userID := range group {
+			if player, ok := byID[userID]; ok && !used[userID] {
+				used[userID] = true
+				unit = append(unit, player)
+			}
+		}
+		if len(unit) != 0 {
+			units = append(units, unit)
+		}
+	}
+	for _, player := range players {
+		if !used[player.user.ID] {
+			units = append(units, teamUnit{player})
+		}
+	}
+	return units
+}
+
+// teamPlayers loads the creator and participants of the event with the
+// skill level they declared when joining, or else the level of their
+// profile in the sport of the event
+func teamPlayers(event Event) []teamPlayer {
+	var participants []EventParticipant
+	db.Where("event_id = ?", event.ID).Find(&participants)
+	skills := map[uint]int{}
+	userIDs := []uint{event.CreatorID}
+	for _, participant := range participants {
+		skills[participant.UserID] = participant.SkillLevel
+		userIDs = append(userIDs, participant.UserID)
+	}
+
+	levels := map[uint]string{}
+	if event.SportID != 0 {
+		var userSports []UserSport
+		db.Where("sport_id = ? AND user_id IN (?)", event.SportID, userIDs).Find(&userSports)
+		for _, userSport := range userSports {
+			levels[userSport.UserID] = userSport.Level
+		}
+	}
+
+	var users []User
+	db.Where("id IN (?)", userIDs).Order("id").Find(&users)
+
+	players := make([]teamPlayer, len(users))
+	for i, user := range users {
+		skill := skills[user.ID]
+		if skill == 0 {
+			skill = levelSkills[levels[user.ID]]
+		}
+		if skill < minSkillLevel || skill > maxSkillLevel {
+			skill = defaultSkillLevel
+		}
+		players[i] = teamPlayer{user, skill}
+	}
+	return players
+}
+
+// loadTeams loads the teams of an event with their members
+func loadTeams(eventID uint) []Team {
+	teams := []Team{}
+	db.Preload("Members").Where("event_id = ?", eventID).Scopes(orderTeams).Find(&teams)
+	return teams
+}
+
+// orderTeams sorts preloaded teams by their number
+func orderTeams(tx *gorm.DB) *gorm.DB {
+	return tx.Order("number")
+}
+
+// deleteTeams deletes the teams of an event and their members
+func deleteTeams(eventID uint) {
+	db.Exec("DELETE FROM team_members WHERE team_id IN (SELECT id FROM teams WHERE event_id = ?)", eventID)
+	db.Where("event_id = ?", eventID).Delete(Team{})
+}
+
+//RemoveFromTeams takes a player out of the teams of an event, e.g. when
+//they leave it
+func RemoveFromTeams(eventID uint, userID uint) {
+	db.Exec("DELETE FROM team_members WHERE user_id = ? AND team_id IN (SELECT id FROM teams WHERE event_id = ?)",
+		userID, eventID)
+}
+
+// loadTeamsEvent loads the event of the creator and checks that its teams
+// can be changed. Writes the error response when they can not
+func loadTeamsEvent(w http.ResponseWriter, r *http.Request) (event Event, ok bool) {
+	event, ok = loadCreatorEvent(w, r)
+	if !ok {
+		return event, false
+	}
+
+	if event.TeamsLocked {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"The teams are locked"}, w)
+		return event, false
+	}
+	if event.Status == EventStatusCancelled || event.Status == EventStatusFinished {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"Cancelled and finished events can not change teams"}, w)
+		return event, false
+	}
+	return event, true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+//NotificationWaitlistPromoted tells a user on the waitlist that a place
+//opened up and they joined the event
+const NotificationWaitlistPromoted = "waitlist_promoted"
+
+//WaitlistEntry keeps a place in line for a user that tried to join a full
+//event. Users are let in in the order they joined the waitlist
+type WaitlistEntry struct {
+	ID         uint `gorm:"primary_key"`
+	CreatedAt  time.Time
+	EventID    uint  `gorm:"unique_index:idx_waitlist_entry"`
+	UserID     uint  `gorm:"unique_index:idx_waitlist_entry;index"`
+	User       *User `json:",omitempty" gorm:"foreignkey:UserID"`
+	SkillLevel int
+}
+
+//JoinWaitlist puts the user in line for a full event and tells them their
+//place in it
+func JoinWaitlist(w http.ResponseWriter, event Event, user User, skillLevel int) {
+	var entry WaitlistEntry
+	if !db.Where("event_id = ? AND user_id = ?", event.ID, user.ID).First(&entry).RecordNotFound() {
+		w.WriteHeader(http.StatusConflict)
+		JSONResponse(struct{ Error string }{"You are already on the waitlist of the event"}, w)
+		return
+	}
+	entry = WaitlistEntry{EventID: event.ID, UserID: user.ID, SkillLevel: skillLevel}
+	db.Create(&entry)
+
+	var position int
+	db.Model(&WaitlistEntry{}).Where("event_id = ? AND id <= ?", event.ID, entry.ID).Count(&position)
+
+	w.WriteHeader(http.StatusAccepted)
+	JSONResponse(struct {
+		Waitlisted bool
+		Position   int
+	}{true, position}, w)
+	return
+}
+
+//GetWaitlist lists the users waiting for a place in an event, first in
+//line first
+func GetWaitlist(w http.ResponseWriter, r *http.Request) {
+	event, ok := loadCreatorEvent(w, r)
+	if !ok {
+		return
+	}
+
+	entries := []WaitlistEntry{}
+	db.Preload("User").Where("event_id = ?", event.ID).Order("id").Find(&entries)
+
+	w.WriteHeader(http.StatusOK)
+	JSONResponse(entries, w)
+	return
+}
+
+//PromoteFromWaitlist lets users on the waitlist into the event in order
+//while it has room. Users that can no longer join, like banned ones, lose
+//their place. Nobody is let in while the event itself is not joinable
+func PromoteFromWaitlist(event *Event) {
+	for {
+		var entry WaitlistEntry
+		if db.Where("event_id = ?", event.ID).Order("id").First(&entry).RecordNotFound() {
+			return
+		}
+		var user User
+		db.First(&user, entry.UserID)
+
+		err := JoinableBy(*event, user)
+		if err == ErrEventFull || err == ErrEventNotJoinable || err == ErrEventHidden {
+			return
+		}
+		db.Delete(&entry)
+		if err != nil || user.ID == 0 || isParticipant(event.ID, user.ID) {
+			continue
+		}
+
+		AddParticipant(event, &user)
+		if entry.SkillLevel != 0 {
+			db.Model(&EventParticipant{}).Where("event_id = ? AND user_id = ?", event.ID, user.ID).
+				Updates(map[string]interface{}{"skill_level": entry.SkillLevel})
+		}
+		NotifyUsers([]uint{user.ID}, NotificationWaitlistPromoted, event.ID,
+			"A place opened up, you joined "+eventSummary(*event))
+	}
+}